@@ -0,0 +1,283 @@
+package admission
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dedis/crypto/random"
+
+	"zRep/util"
+	"zRep/util/canonical"
+)
+
+var ErrNoInvite = errors.New("a valid invite token is required")
+var ErrNoWork = errors.New("proof of work is missing or too weak")
+var ErrVerifierRefused = errors.New("external verifier refused the registration")
+var ErrDuplicateKey = errors.New("public key has already been registered")
+
+// Admitter decides whether a registration request is accepted.
+// params are the parameters of CLIENT_REGISTER_CONTROLLERSIDE.
+type Admitter interface {
+	// return nil if the registration is admitted
+	Admit(params map[string]interface{}) error
+}
+
+// Chain admits a registration only if every admitter does,
+// an empty chain admits everybody
+type Chain []Admitter
+
+func (c Chain) Admit(params map[string]interface{}) error {
+	for _,admitter := range c {
+		if err := admitter.Admit(params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Difficulty returns the proof-of-work difficulty required by the chain
+func (c Chain) Difficulty() int {
+	for _,admitter := range c {
+		if pow, ok := admitter.(*ProofOfWork); ok {
+			return pow.Difficulty
+		}
+	}
+	return 0
+}
+
+// Challenge returns what a proof of work of the chain must be bound to,
+// empty if no work is required
+func (c Chain) Challenge() []byte {
+	for _,admitter := range c {
+		if pow, ok := admitter.(*ProofOfWork); ok {
+			return pow.Seed
+		}
+	}
+	return []byte{}
+}
+
+// NewRound starts a new round, so that work done for older rounds expires
+func (c Chain) NewRound() {
+	for _,admitter := range c {
+		if pow, ok := admitter.(*ProofOfWork); ok {
+			pow.NewRound()
+		}
+	}
+}
+
+// Invites returns the invite tokens of the chain, nil if not configured
+func (c Chain) Invites() *InviteTokens {
+	for _,admitter := range c {
+		if invites, ok := admitter.(*InviteTokens); ok {
+			return invites
+		}
+	}
+	return nil
+}
+
+// load admitters named in "admission" as "invite,pow,external".
+// Invite tokens are checked last, so that a token is not used up by a
+// registration refused for another reason.
+func LoadChain() Chain {
+	chain := Chain{}
+	var invites *InviteTokens
+	for _,name := range strings.Split(util.GetParameter("admission"), ",") {
+		switch strings.TrimSpace(name) {
+		case "invite":
+			invites = NewInviteTokens()
+			invites.Load(util.GetParameter("admission_invite_file"))
+		case "pow":
+			chain = append(chain, NewProofOfWork(util.GetIntParameter("admission_pow_difficulty", 16)))
+		case "external":
+			chain = append(chain, &ExternalVerifier{
+				Network: "unix",
+				Addr: util.GetParameter("admission_verifier_socket"),
+				Timeout: time.Duration(util.GetIntParameter("admission_verifier_timeout_ms", 3000)) * time.Millisecond,
+			})
+		}
+	}
+	if invites != nil {
+		chain = append(chain, invites)
+	}
+	return chain
+}
+
+func bytesParam(params map[string]interface{}, name string) []byte {
+	if val, ok := params[name].([]byte); ok {
+		return val
+	}
+	return nil
+}
+
+// ****************************************************************************
+// Invite tokens
+// ****************************************************************************
+
+// InviteTokens admits each token issued by operators exactly once
+type InviteTokens struct {
+	Tokens map[string]bool
+	// file keeping the unused tokens across restarts, not kept if empty
+	Path string
+}
+
+func NewInviteTokens() *InviteTokens {
+	return &InviteTokens{Tokens: make(map[string]bool)}
+}
+
+// Issue creates a new random token
+func (t *InviteTokens) Issue() string {
+	token := hex.EncodeToString(random.Bytes(16, random.Stream))
+	t.Tokens[token] = true
+	t.save()
+	return token
+}
+
+// Load reads tokens from a file, one per line, and keeps the file
+// updated as tokens are issued and used
+func (t *InviteTokens) Load(path string) {
+	t.Path = path
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if token := strings.TrimSpace(scanner.Text()); token != "" {
+			t.Tokens[token] = true
+		}
+	}
+}
+
+func (t *InviteTokens) Admit(params map[string]interface{}) error {
+	token := string(bytesParam(params, "invite"))
+	if !t.Tokens[token] {
+		return ErrNoInvite
+	}
+	delete(t.Tokens, token)
+	t.save()
+	return nil
+}
+
+// write the unused tokens back to the file
+func (t *InviteTokens) save() {
+	if t.Path == "" {
+		return
+	}
+	var buf bytes.Buffer
+	for token := range t.Tokens {
+		buf.WriteString(token + "\n")
+	}
+	err := ioutil.WriteFile(t.Path, buf.Bytes(), 0600)
+	util.CheckErr(err)
+}
+
+// ****************************************************************************
+// Proof of work
+// ****************************************************************************
+
+// ProofOfWork admits a public key with a nonce such that SHA256 of the
+// canonical encoding of public_key, a challenge and nonce starts with
+// Difficulty zero bits. The challenge is a random seed of the current or
+// the last round, so that work cannot be done long in advance.
+type ProofOfWork struct {
+	Difficulty int
+	Seed []byte
+	PrevSeed []byte
+}
+
+func NewProofOfWork(difficulty int) *ProofOfWork {
+	pow := &ProofOfWork{Difficulty: difficulty}
+	pow.NewRound()
+	return pow
+}
+
+// NewRound draws a new seed, the seed of the last round is still accepted
+func (p *ProofOfWork) NewRound() {
+	p.PrevSeed = p.Seed
+	p.Seed = random.Bytes(16, random.Stream)
+}
+
+func (p *ProofOfWork) Admit(params map[string]interface{}) error {
+	challenge := bytesParam(params, "pow_challenge")
+	if len(challenge) == 0 || !(bytes.Equal(challenge, p.Seed) || bytes.Equal(challenge, p.PrevSeed)) {
+		return ErrNoWork
+	}
+	if !VerifyWork(bytesParam(params, "public_key"), challenge, bytesParam(params, "pow_nonce"), p.Difficulty) {
+		return ErrNoWork
+	}
+	return nil
+}
+
+func VerifyWork(publicKey []byte, challenge []byte, nonce []byte, difficulty int) bool {
+	digest := canonical.New("proof-of-work").Bytes(publicKey).Bytes(challenge).Bytes(nonce).Sum(sha256.New())
+	return leadingZeros(digest) >= difficulty
+}
+
+// SolveWork finds a nonce for the public key and challenge, used by clients
+func SolveWork(publicKey []byte, challenge []byte, difficulty int) []byte {
+	nonce := make([]byte, 8)
+	for i := uint64(0); ; i++ {
+		binary.BigEndian.PutUint64(nonce, i)
+		if VerifyWork(publicKey, challenge, nonce, difficulty) {
+			return nonce
+		}
+	}
+}
+
+func leadingZeros(digest []byte) int {
+	n := 0
+	for _,b := range digest {
+		for i := 7; i >= 0; i-- {
+			if b >> uint(i) & 1 != 0 {
+				return n
+			}
+			n++
+		}
+	}
+	return n
+}
+
+// ****************************************************************************
+// External verifier
+// ****************************************************************************
+
+// ExternalVerifier asks a local service whether to admit a registration.
+// It sends one line "<hex public key> <hex invite>" and expects "ok",
+// anything else is a refusal.
+type ExternalVerifier struct {
+	Network string
+	Addr string
+	Timeout time.Duration
+}
+
+func (v *ExternalVerifier) Admit(params map[string]interface{}) error {
+	conn, err := net.DialTimeout(v.Network, v.Addr, v.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(v.Timeout))
+
+	request := hex.EncodeToString(bytesParam(params, "public_key")) + " " + hex.EncodeToString(bytesParam(params, "invite")) + "\n"
+	if _, err = conn.Write([]byte(request)); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(reply) != "ok" {
+		return ErrVerifierRefused
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package admission
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInviteTokens(t *testing.T) {
+	invites := NewInviteTokens()
+	token := invites.Issue()
+	if invites.Admit(map[string]interface{}{"invite": []byte("xxx")}) == nil {
+		t.Error("Unknown token should have been refused")
+	}
+	if invites.Admit(map[string]interface{}{}) == nil {
+		t.Error("Missing token should have been refused")
+	}
+	if invites.Admit(map[string]interface{}{"invite": []byte(token)}) != nil {
+		t.Error("Issued token should have been admitted")
+	}
+	if invites.Admit(map[string]interface{}{"invite": []byte(token)}) == nil {
+		t.Error("Token should have been used only once")
+	}
+}
+
+func TestProofOfWork(t *testing.T) {
+	publicKey := []byte("public key")
+	pow := NewProofOfWork(8)
+	seed := pow.Seed
+	nonce := SolveWork(publicKey, seed, 8)
+	params := map[string]interface{}{"public_key": publicKey, "pow_challenge": seed, "pow_nonce": nonce}
+	if pow.Admit(params) != nil {
+		t.Error("Solved work should have been admitted")
+	}
+	if VerifyWork(publicKey, seed, nonce, 256) {
+		t.Error("Work should not have met a higher difficulty")
+	}
+	if pow.Admit(map[string]interface{}{"public_key": publicKey, "pow_challenge": seed}) == nil {
+		t.Error("Missing nonce should have been refused")
+	}
+	if pow.Admit(map[string]interface{}{"public_key": publicKey, "pow_nonce": nonce}) == nil {
+		t.Error("Work without a challenge should have been refused")
+	}
+	if (Chain{pow}).Difficulty() != 8 || (Chain{}).Difficulty() != 0 {
+		t.Error("Wrong difficulty of chain")
+	}
+
+	// work of the last round is still fine, older work has expired
+	(Chain{pow}).NewRound()
+	if pow.Admit(params) != nil {
+		t.Error("Work of the last round should have been admitted")
+	}
+	pow.NewRound()
+	if pow.Admit(params) == nil {
+		t.Error("Expired work should have been refused")
+	}
+}
+
+func TestInviteTokensFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admission")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "invites")
+
+	invites := NewInviteTokens()
+	invites.Load(path)
+	used := invites.Issue()
+	kept := invites.Issue()
+	invites.Admit(map[string]interface{}{"invite": []byte(used)})
+
+	// a restarted coordinator only knows the unused token
+	restarted := NewInviteTokens()
+	restarted.Load(path)
+	if restarted.Admit(map[string]interface{}{"invite": []byte(used)}) == nil {
+		t.Error("Used token should not survive a restart")
+	}
+	if restarted.Admit(map[string]interface{}{"invite": []byte(kept)}) != nil {
+		t.Error("Issued token should survive a restart")
+	}
+}
+
+func TestExternalVerifier(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			// admit keys starting with "00" only
+			if strings.HasPrefix(line, "00") {
+				conn.Write([]byte("ok\n"))
+			} else {
+				conn.Write([]byte("no\n"))
+			}
+			conn.Close()
+		}
+	}()
+
+	verifier := &ExternalVerifier{Network: "tcp", Addr: listener.Addr().String(), Timeout: time.Second}
+	if verifier.Admit(map[string]interface{}{"public_key": []byte{0, 1}}) != nil {
+		t.Error("Verifier should have admitted the key")
+	}
+	chain := Chain{verifier}
+	if chain.Admit(map[string]interface{}{"public_key": []byte{1, 1}}) == nil {
+		t.Error("Verifier should have refused the key")
+	}
+}
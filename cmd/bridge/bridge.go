@@ -1,6 +1,8 @@
 package bridge
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/big"
 	// "log"
@@ -11,11 +13,13 @@ import (
 
 	"github.com/dedis/crypto/abstract"
 	"zRep/util"
+	"zRep/util/canonical"
 	"zRep/primitive/pedersen"
 	"zRep/primitive/pedersen_fujiokam"
 	"zRep/primitive/fujiokam"
 )
 
+// default reputation of a newly registered client, see Policy
 const StartingCredit int = 5
 
 type Bridge struct {
@@ -23,20 +27,62 @@ type Bridge struct {
 	Nym abstract.Point // bridge provider's nym
 }
 
+// Servers only see and sign the commitment of the bridge address,
+// the address itself is sealed to the requester
 type Assignment struct {
 	NymR abstract.Point // bridge requester's nym
-	Addr string
+	AddrComm []byte // commitment of bridge address
 	Nym abstract.Point // bridge provider's nym
+	Epoch int // round the assignment was made in
 }
 
-func VerifyInd(params map[string]interface{}, PCommr abstract.Point, suite abstract.Suite, pedersenBase *pedersen.PedersenBase, fujiokamBase *fujiokam.FujiOkamBase) bool {
+var ErrAssignmentEpoch = errors.New("assignment is of another round")
+var ErrAssignmentNym = errors.New("assignment is for another requester")
+
+// CheckAssignments tells whether every assignment was made in epoch for the
+// requester nymR, who proved its reputation for them
+func CheckAssignments(assignments []Assignment, nymR abstract.Point, epoch int) error {
+	for _,assignment := range assignments {
+		if assignment.Epoch != epoch {
+			return ErrAssignmentEpoch
+		}
+		if assignment.NymR == nil || !assignment.NymR.Equal(nymR) {
+			return ErrAssignmentNym
+		}
+	}
+	return nil
+}
+
+// identify an assignment, since a bridge can be handed out several times
+func AssignmentKey(assignment *Assignment) string {
+	return assignment.NymR.String() + "|" + hex.EncodeToString(assignment.AddrComm)
+}
+
+func VerifyInd(params map[string]interface{}, PCommr abstract.Point, policy *Policy, suite abstract.Suite, pedersenBase *pedersen.PedersenBase, fujiokamBase *fujiokam.FujiOkamBase) bool {
 	ind := params["ind"].(int)
+	if !policy.Allows(ind) {
+		fmt.Println("[note]** Indicator exceeds the cap")
+		return false
+	}
+	if !policy.NeedProof(ind) {
+		fmt.Println("[debug] Indicator within the floor, no proof needed")
+		return true
+	}
+	if PCommr == nil {
+		fmt.Println("[note]** Can not find the commitment of nym")
+		return false
+	}
 	nymR := suite.Point()
 	byteNymR := params["nym"].([]byte)
 	err := nymR.UnmarshalBinary(byteNymR)
 	util.CheckErr(err)
+	return VerifyIndProof(params, ind, PCommr, suite, pedersenBase, fujiokamBase)
+}
+
+// VerifyIndProof checks the proof in params that PCommr commits to at least ind
+func VerifyIndProof(params map[string]interface{}, ind int, PCommr abstract.Point, suite abstract.Suite, pedersenBase *pedersen.PedersenBase, fujiokamBase *fujiokam.FujiOkamBase) bool {
 	PCommind := suite.Point()
-	err = PCommind.UnmarshalBinary(params["PCommind"].([]byte))
+	err := PCommind.UnmarshalBinary(params["PCommind"].([]byte))
 	util.CheckErr(err)
 	PCommd := suite.Point()
 	err = PCommd.UnmarshalBinary(params["PCommd"].([]byte))
@@ -83,45 +129,182 @@ func VerifyInd(params map[string]interface{}, PCommr abstract.Point, suite abstr
 	return true
 }
 
+// FillIndProof fills params with the proof that PCommr, a commitment to
+// reputation with randomness r, commits to at least ind
+func FillIndProof(params map[string]interface{}, suite abstract.Suite, pedersenBase *pedersen.PedersenBase, fujiokamBase *fujiokam.FujiOkamBase, ind int, reputation int, PCommr abstract.Point, r abstract.Secret) {
+	d := reputation - ind
+	bigD := new(big.Int).SetInt64(int64(d))
+	xD := suite.Secret().SetInt64(int64(d))
+
+	// compute PComm for d
+	xind := suite.Secret().SetInt64(int64(ind))
+	PCommind, rind := pedersenBase.Commit(xind)
+	PCommd := pedersenBase.Sub(PCommr, PCommind)
+	bytePCommind, err := PCommind.MarshalBinary()
+	util.CheckErr(err)
+	bytePCommd, err := PCommd.MarshalBinary()
+	util.CheckErr(err)
+	byteRind, err := rind.MarshalBinary()
+	util.CheckErr(err)
+
+	// generate ARGnonneg
+	FOCommd, rFOCommd := fujiokamBase.Commit(bigD)
+	ARGnonneg := fujiokamBase.ProveNonneg(bigD, FOCommd, rFOCommd)
+
+	// generate ARGequal
+	rd := suite.Secret().Sub(r, rind)
+	ARGequal := pedersen_fujiokam.ProveEqual(pedersenBase, fujiokamBase, xD, PCommd, rd, FOCommd, rFOCommd)
+
+	params["FOCommd"] = FOCommd.ToBinary()
+	params["PCommd"] = bytePCommd
+	params["PCommind"] = bytePCommind
+	params["rind"] = byteRind
+	params["arg_nonneg"] = util.EncodeARGnonneg(ARGnonneg)
+	params["arg_equal"] = util.EncodeARGequal(ARGequal)
+}
+
+// the fields of the proof filled by FillIndProof, empty when no proof is needed
+var IndProofParams = []string{"FOCommd", "PCommd", "PCommind", "rind", "arg_nonneg", "arg_equal"}
+
+// SignAssignmentsParams builds what the coordinator sends the servers to sign
+// the assignments made for a request. The claim and proof of the request are
+// passed on, so that every server checks them again
+func SignAssignmentsParams(assignments []Assignment, request map[string]interface{}) map[string]interface{} {
+	pm := map[string]interface{}{
+		"assignments": EncodeAssignmentList(assignments),
+		"ind": request["ind"],
+		"dim": request["dim"],
+		"nym": request["nym"],
+	}
+	for _,name := range IndProofParams {
+		pm[name] = request[name]
+	}
+	return pm
+}
+
 // ****************************************************************************
 // Extract message body from package
 // ****************************************************************************
 
-func MessageOfRequestBridges(params map[string]interface{}) (msg []byte) {
-	ind := params["ind"].(int)
-	byteInd := util.IntToByte(ind)
-	msg = append(msg, byteInd...)
-	msg = append(msg, params["nym"].([]byte)...)
-	msg = append(msg, params["FOCommd"].([]byte)...)
-	msg = append(msg, params["PCommd"].([]byte)...)
-	msg = append(msg, params["PCommind"].([]byte)...)
-	msg = append(msg, params["rind"].([]byte)...)
-	msg = append(msg, params["arg_nonneg"].([]byte)...)
-	msg = append(msg, params["arg_equal"].([]byte)...)
-	return
+// accept only messages signed for the given round, so that a signed message
+// captured in one round can not be replayed in another
+func CheckEpoch(params map[string]interface{}, epoch int) bool {
+	e, ok := params["epoch"].(int)
+	return ok && e == epoch
 }
 
-func MessageOfPostBridge(params map[string]interface{}) (msg []byte) {
-	bridgeAddr := params["bridge_addr"].(string)
-	msg = append(msg, []byte(bridgeAddr)...)
-	msg = append(msg, params["nym"].([]byte)...)
-	return
+// Every message below is built with the canonical encoding, see
+// util/canonical, under its own domain.
+
+func MessageOfRequestBridges(params map[string]interface{}) []byte {
+	e := canonical.New("request-bridges")
+	e.Int(params["epoch"].(int))
+	e.Int(params["ind"].(int))
+	e.Int(params["dim"].(int))
+	e.Bytes(params["nym"].([]byte))
+	writeIndProof(e, params)
+	return e.Encoded()
 }
 
-func MessageOfGotSignatures(params map[string]interface{}) (msg []byte) {
-	msg = append(msg, params["assignment"].([]byte)...)
-	msg = append(msg, params["signatures"].([]byte)...)
-	return
+// the proof that reputation >= params["ind"], the arguments are written
+// field by field instead of their gob encoding
+func writeIndProof(e *canonical.Encoder, params map[string]interface{}) {
+	e.Bytes(params["FOCommd"].([]byte))
+	e.Bytes(params["PCommd"].([]byte))
+	e.Bytes(params["PCommind"].([]byte))
+	e.Bytes(params["rind"].([]byte))
+	if byteArg := params["arg_nonneg"].([]byte); len(byteArg) == 0 {
+		e.Bool(false)
+	} else {
+		arg := util.DecodeARGnonneg(byteArg)
+		e.Bool(true)
+		e.BigInts([]*big.Int{arg.Commitrx, arg.C, arg.Cr, arg.R, arg.X_, arg.A_, arg.B_, arg.D_, arg.R_})
+	}
+	if byteArg := params["arg_equal"].([]byte); len(byteArg) == 0 {
+		e.Bool(false)
+	} else {
+		arg := util.DecodeARGequal(byteArg)
+		e.Bool(true)
+		e.BigInts([]*big.Int{arg.C, arg.S1, arg.S2, arg.S3})
+	}
 }
 
-func MessageOfVote(params map[string]interface{}) (msg []byte) {
-	msg = append(msg, params["nym"].([]byte)...)
-	msg = append(msg, params["assignment"].([]byte)...)
-	msg = append(msg, params["signatures"].([]byte)...)
-	feedback := params["feedback"].(int)
-	byteFeedback := big.NewInt(int64(feedback)).Bytes()
-	msg = append(msg, byteFeedback...)
-	return
+// a server signs the coordinator's nonce and its own address to join the chain
+func MessageOfServerChallenge(nonce []byte, serverAddr string) []byte {
+	return canonical.New("server-challenge").Bytes(nonce).String(serverAddr).Encoded()
+}
+
+// a server signs the registration it passes on, so that the coordinator
+// only takes a new client from the last server of the chain
+func MessageOfClientRegister(params map[string]interface{}) []byte {
+	e := canonical.New("client-register")
+	e.Bytes(params["public_key"].([]byte))
+	e.String(params["addr"].(string))
+	e.Bytes(params["pcomm"].([]byte))
+	return e.Encoded()
+}
+
+func MessageOfPostBridge(params map[string]interface{}) []byte {
+	e := canonical.New("post-bridge")
+	e.Int(params["epoch"].(int))
+	e.String(params["bridge_addr"].(string))
+	e.Bytes(params["nym"].([]byte))
+	e.Int(params["ind"].(int))
+	e.Int(params["dim"].(int))
+	writeIndProof(e, params)
+	return e.Encoded()
+}
+
+func MessageOfRebindBridge(params map[string]interface{}) []byte {
+	e := canonical.New("rebind-bridge")
+	e.Int(params["epoch"].(int))
+	e.String(params["bridge_addr"].(string))
+	e.Bytes(params["old_nym"].([]byte))
+	e.Bytes(params["nym"].([]byte))
+	e.Int(params["ind"].(int))
+	e.Int(params["dim"].(int))
+	writeIndProof(e, params)
+	return e.Encoded()
+}
+
+// what the coordinator and every server sign for an assignment
+func MessageOfAssignment(assignment *Assignment) []byte {
+	e := canonical.New("assignment")
+	writeAssignment(e, assignment)
+	return e.Encoded()
+}
+
+func writeAssignment(e *canonical.Encoder, assignment *Assignment) {
+	e.Int(assignment.Epoch)
+	e.Point(assignment.NymR)
+	e.Bytes(assignment.AddrComm)
+	e.Point(assignment.Nym)
+}
+
+func MessageOfGotSignatures(params map[string]interface{}) []byte {
+	e := canonical.New("got-signatures")
+	writeAssignment(e, DecodeAssignment(params["assignment"].([]byte)))
+	e.BytesList(util.Decode2DByteArray(params["signatures"].([]byte)))
+	e.Bytes(params["sealed_addr"].([]byte))
+	return e.Encoded()
+}
+
+func MessageOfVote(params map[string]interface{}) []byte {
+	e := canonical.New("vote")
+	e.Int(params["epoch"].(int))
+	e.Bytes(params["nym"].([]byte))
+	writeAssignment(e, DecodeAssignment(params["assignment"].([]byte)))
+	e.BytesList(util.Decode2DByteArray(params["signatures"].([]byte)))
+	e.Int(params["category"].(int))
+	// weighted vote carries a proof of the voter's reputation
+	_, weighted := params["ind"]
+	e.Bool(weighted)
+	if weighted {
+		e.Int(params["ind"].(int))
+		e.Int(params["dim"].(int))
+		writeIndProof(e, params)
+	}
+	return e.Encoded()
 }
 
 // ****************************************************************************
@@ -4,14 +4,19 @@ import (
 	"github.com/dedis/crypto/random"
 	"fmt"
 
+	"github.com/dedis/crypto/abstract"
 	"github.com/dedis/crypto/nist"
+
+	"zRep/primitive/fujiokam"
+	"zRep/primitive/pedersen"
+	"zRep/util"
 )
 
 func TestEncodingAssignment(t *testing.T) {
 	suite := nist.NewAES128SHA256QR512()
 	p1 := suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
 	p2 := suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
-	assign := Assignment{Addr:"xxx", Nym:p1, NymR:p2}
+	assign := Assignment{AddrComm:[]byte("xxx"), Nym:p1, NymR:p2, Epoch:7}
 
 	data := EncodeAssignment(&assign)
 	assign2 := *DecodeAssignment(data)
@@ -25,12 +30,32 @@ func TestEncodingAssignment(t *testing.T) {
 	}
 }
 
+func TestCheckAssignments(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	nymR := suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
+	other := suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
+	assignments := []Assignment{
+		{NymR: nymR, AddrComm: []byte("a"), Nym: other, Epoch: 3},
+		{NymR: nymR, AddrComm: []byte("b"), Nym: other, Epoch: 3},
+	}
+	if err := CheckAssignments(assignments, nymR, 3); err != nil {
+		t.Error("Assignments of the requester are refused:", err)
+	}
+	if CheckAssignments(assignments, nymR, 4) != ErrAssignmentEpoch {
+		t.Error("Assignments of another round are accepted")
+	}
+	assignments[1].NymR = other
+	if CheckAssignments(assignments, nymR, 3) != ErrAssignmentNym {
+		t.Error("An assignment for another requester is accepted")
+	}
+}
+
 func TestEncodingAssignmentList(t *testing.T) {
 	suite := nist.NewAES128SHA256QR512()
 	p1 := suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
 	p2 := suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
-	assign1 := Assignment{Addr:"xxx", Nym:p1, NymR:p2}
-	assign2 := Assignment{Addr:"yyy", Nym:p2, NymR:p1}
+	assign1 := Assignment{AddrComm:[]byte("xxx"), Nym:p1, NymR:p2}
+	assign2 := Assignment{AddrComm:[]byte("yyy"), Nym:p2, NymR:p1}
 	var alist []Assignment
 	alist = append(alist, assign1)
 	alist = append(alist, assign2)
@@ -46,4 +71,195 @@ func TestEncodingAssignmentList(t *testing.T) {
 		fmt.Println(s2)
 		t.Error("Decoded assignment list is different from the origin")
 	}
-}
\ No newline at end of file
+}
+
+func TestSealAddr(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	g := suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
+	x := suite.Secret().Pick(random.Stream)
+	nymR := suite.Point().Mul(g, x)
+	// long enough to span several points
+	addr := "a-rather-long-bridge-address.example.org:443 with a fingerprint 0123456789ABCDEF0123456789ABCDEF"
+
+	comm, salt := CommitAddr(suite, addr)
+	sealed := SealAddr(suite, g, nymR, addr, salt)
+	addr2, salt2, err := OpenAddr(suite, x, sealed)
+	if err != nil {
+		t.Error("Fails to open sealed address:", err)
+	}
+	if addr2 != addr {
+		t.Error("Opened address is different from the origin")
+	}
+	if !VerifyAddr(suite, comm, addr2, salt2) {
+		t.Error("Opened address does not match the commitment")
+	}
+	if VerifyAddr(suite, comm, "yyy", salt2) {
+		t.Error("Commitment should not open to another address")
+	}
+}
+
+func TestSealUpdate(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	g := suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
+	x := suite.Secret().Pick(random.Stream)
+	nym := suite.Point().Mul(g, x)
+	update := &Update{
+		Diffs: []int{3, -2},
+		RDiffs: []abstract.Secret{suite.Secret().Pick(random.Stream), suite.Secret().Pick(random.Stream)},
+		Breakdown: make([]int, NumCategories),
+	}
+	update.Breakdown[0] = -1
+
+	sealed := SealUpdate(suite, g, nym, update)
+	opened, err := OpenUpdate(suite, x, sealed)
+	if err != nil {
+		t.Fatal("Fails to open sealed update:", err)
+	}
+	for i := range update.Diffs {
+		if opened.Diffs[i] != update.Diffs[i] || !opened.RDiffs[i].Equal(update.RDiffs[i]) {
+			t.Error("Opened update is different from the origin")
+		}
+	}
+	for i := range update.Breakdown {
+		if opened.Breakdown[i] != update.Breakdown[i] {
+			t.Error("Opened breakdown is different from the origin")
+		}
+	}
+	// another update of the round seals to the same size
+	other := &Update{
+		Diffs: []int{0, 1 << 20},
+		RDiffs: []abstract.Secret{suite.Secret().Zero(), suite.Secret().One()},
+		Breakdown: make([]int, NumCategories),
+	}
+	if len(SealUpdate(suite, g, nym, other)) != len(sealed) {
+		t.Error("Sealed updates of a round differ in size")
+	}
+	if _, err := OpenUpdate(suite, suite.Secret().Pick(random.Stream), sealed); err == nil {
+		t.Error("Sealed update opens under another key")
+	}
+}
+
+func TestParseCategory(t *testing.T) {
+	for i := 0; i < NumCategories; i++ {
+		c, ok := ParseCategory(Category(i).String())
+		if !ok || c != Category(i) {
+			t.Error("Fails to parse category", Category(i))
+		}
+	}
+	if c, ok := ParseCategory("+1"); !ok || c != WORKS {
+		t.Error("+1 should have been parsed as works")
+	}
+	if c, ok := ParseCategory("-1"); !ok || c != BLOCKED {
+		t.Error("-1 should have been parsed as blocked")
+	}
+	if _, ok := ParseCategory("xxx"); ok {
+		t.Error("xxx should not have been parsed")
+	}
+}
+
+func TestEpoch(t *testing.T) {
+	params := map[string]interface{}{
+		"epoch": 3,
+		"bridge_addr": "127.0.0.1:9001",
+		"old_nym": []byte("old"),
+		"nym": []byte("new"),
+		"ind": 0,
+		"dim": 0,
+	}
+	for _,field := range []string{"FOCommd", "PCommd", "PCommind", "rind", "arg_nonneg", "arg_equal"} {
+		params[field] = []byte{}
+	}
+	if !CheckEpoch(params, 3) {
+		t.Error("message of the current round rejected")
+	}
+	if CheckEpoch(params, 4) {
+		t.Error("message of an earlier round accepted")
+	}
+	if CheckEpoch(map[string]interface{}{}, 0) {
+		t.Error("message without a round accepted")
+	}
+
+	msg := string(MessageOfRebindBridge(params))
+	params["epoch"] = 4
+	if msg == string(MessageOfRebindBridge(params)) {
+		t.Error("the round is not covered by the signed message")
+	}
+}
+
+// a server checks the request passed on by the coordinator against the
+// commitment of the claimed dimension
+func TestSignAssignmentsParams(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	pedersenBase := pedersen.CreateBaseFromSuite(suite)
+	fujiokamBase := fujiokam.CreateBase()
+	policy := &Policy{InitialCredit: 5, Decay: 0, MaxGain: NoLimit, MaxLoss: NoLimit, Floor: 0, Cap: NoLimit}
+	record := make([]abstract.Point, 2)
+	R := make([]abstract.Secret, 2)
+	for dim,rep := range []int{0, 7} {
+		record[dim], R[dim] = pedersenBase.Commit(suite.Secret().SetInt64(int64(rep)))
+	}
+	nym := suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
+	request := map[string]interface{}{
+		"epoch": 1,
+		"ind": 5,
+		"dim": 1,
+		"nym": util.EncodePoint(nym),
+	}
+	FillIndProof(request, suite, pedersenBase, fujiokamBase, 5, 7, record[1], R[1])
+	assignments := []Assignment{{NymR: nym, AddrComm: []byte("comm"), Nym: nym, Epoch: 1}}
+
+	pm := SignAssignmentsParams(assignments, request)
+	if len(DecodeAssignmentList(pm["assignments"].([]byte))) != 1 {
+		t.Error("Assignments are lost")
+	}
+	PCommr := CommOfDimension(record, pm)
+	if PCommr == nil || !VerifyInd(pm, PCommr, policy, suite, pedersenBase, fujiokamBase) {
+		t.Error("Fails to verify the request passed on to the servers")
+	}
+	if VerifyInd(pm, CommOfDimension(record[:1], pm), policy, suite, pedersenBase, fujiokamBase) {
+		t.Error("A proof on a dimension the record lacks passes")
+	}
+
+	// a request without a dimension is refused instead of crashing
+	delete(request, "dim")
+	pm = SignAssignmentsParams(assignments, request)
+	if PCommr := CommOfDimension(record, pm); PCommr != nil {
+		t.Error("A request without a dimension has a commitment")
+	}
+	if VerifyInd(pm, CommOfDimension(record, pm), policy, suite, pedersenBase, fujiokamBase) {
+		t.Error("A request without a dimension passes")
+	}
+}
+
+func TestMessageOfVote(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	p1 := suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
+	p2 := suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
+	assign := Assignment{AddrComm:[]byte("xxx"), Nym:p1, NymR:p2, Epoch:1}
+	params := map[string]interface{}{
+		"epoch": 1,
+		"nym": []byte("nym"),
+		"assignment": EncodeAssignment(&assign),
+		"signatures": util.Encode2DByteArray([][]byte{[]byte("ab"), []byte("c")}),
+		"category": 1,
+	}
+	msg := string(MessageOfVote(params))
+
+	// the same bytes split differently between signatures
+	params["signatures"] = util.Encode2DByteArray([][]byte{[]byte("a"), []byte("bc")})
+	if msg == string(MessageOfVote(params)) {
+		t.Error("signatures are not length-prefixed")
+	}
+	params["signatures"] = util.Encode2DByteArray([][]byte{[]byte("ab"), []byte("c")})
+	params["category"] = -1
+	if msg == string(MessageOfVote(params)) {
+		t.Error("categories 1 and -1 have the same message")
+	}
+	params["category"] = 1
+	if msg != string(MessageOfVote(params)) {
+		t.Error("message is not deterministic")
+	}
+	if msg == string(MessageOfAssignment(&assign)) {
+		t.Error("domains are not separated")
+	}
+}
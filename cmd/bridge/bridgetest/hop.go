@@ -0,0 +1,78 @@
+// Package bridgetest builds the tables and hops of a pass for the tests of
+// packages checking them.
+package bridgetest
+
+import (
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/proof"
+	"github.com/dedis/crypto/random"
+	"zRep/cmd/bridge"
+	"zRep/primitive/dleq"
+	"zRep/util"
+	"zRep/util/shuffle"
+)
+
+func RandomPoints(suite abstract.Suite, n int) []abstract.Point {
+	list := make([]abstract.Point, n)
+	for i := range list {
+		list[i] = suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
+	}
+	return list
+}
+
+func RaisePoints(suite abstract.Suite, list []abstract.Point, x abstract.Secret) []abstract.Point {
+	raised := make([]abstract.Point, len(list))
+	for i,p := range list {
+		raised[i] = suite.Point().Mul(p, x)
+	}
+	return raised
+}
+
+// what a server sends in the announcement, shuffling the table it received in params.
+// The hop is signed with serverKey unless it is nil
+func NextHop(suite abstract.Suite, params map[string]interface{}, serverKey abstract.Secret) map[string]interface{} {
+	roundkey := suite.Secret().Pick(random.Stream)
+	E := suite.Secret().Pick(random.Stream)
+	inG := suite.Point().Mul(nil, suite.Secret().One())
+	pm := map[string]interface{}{
+		"in_keys": params["keys"],
+		"in_vals": params["vals"],
+		"in_GT": params["GT"],
+		"in_HT": params["HT"],
+	}
+	if epoch, ok := params["epoch"]; ok {
+		pm["epoch"] = epoch
+	}
+	if g, ok := params["g"]; ok {
+		pm["in_g"] = g
+		inG = util.DecodePoint(suite, g.([]byte))
+	}
+	keys := RaisePoints(suite, util.ProtobufDecodePointList(params["keys"].([]byte)), roundkey)
+	vals := RaisePoints(suite, util.ProtobufDecodePointList(params["vals"].([]byte)), E)
+	pm["g"] = util.EncodePoint(suite.Point().Mul(inG, roundkey))
+	pm["GT"] = util.EncodePoint(suite.Point().Mul(util.DecodePoint(suite, params["GT"].([]byte)), E))
+	pm["HT"] = util.EncodePoint(suite.Point().Mul(util.DecodePoint(suite, params["HT"].([]byte)), E))
+
+	rand := suite.Cipher(abstract.RandomKey)
+	finalKeys, finalVals, Xbar, Ybar, prover := shuffle.ShuffleRecords(suite, keys, vals, rand)
+	prf, err := proof.HashProve(suite, "RecordShuffle", rand, prover)
+	util.CheckErr(err)
+	pm["shuffled"] = true
+	pm["prev_keys"] = util.ProtobufEncodePointList(keys)
+	pm["prev_vals"] = util.ProtobufEncodePointList(vals)
+	pm["keys"] = util.ProtobufEncodePointList(finalKeys)
+	pm["vals"] = util.ProtobufEncodePointList(finalVals)
+	pm["xbar"] = util.ProtobufEncodePointList(Xbar)
+	pm["ybar"] = util.ProtobufEncodePointList(Ybar)
+	pm["proof"] = prf
+
+	P, Q := bridge.HopKeyPairs(suite, pm, true)
+	pm["key_proof"] = dleq.Prove(suite, roundkey, P, Q)
+	P, Q = bridge.HopCommPairs(suite, pm)
+	pm["comm_proof"] = dleq.Prove(suite, E, P, Q)
+	if serverKey != nil {
+		pm["hop_signature"] = util.ElGamalSign(suite, rand, bridge.MessageOfHop(pm), serverKey, nil)
+	}
+	pm["hops"] = bridge.AppendHop(params, pm)
+	return pm
+}
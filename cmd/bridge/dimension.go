@@ -0,0 +1,74 @@
+package bridge
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/dedis/crypto/abstract"
+)
+
+// names of the reputation dimensions every deployment knows about
+const PROVIDER string = "provider"
+const REPORTER string = "reporter"
+
+// a client earns provider reputation from feedback on its bridges,
+// and reporter reputation from the votes it casts
+var DefaultDimensions = []string{PROVIDER, REPORTER}
+
+// parse dimensions in the form of "name,name,...", fall back to the defaults
+func ParseDimensions(str string) (dims []string) {
+	for _,name := range strings.Split(str, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			dims = append(dims, name)
+		}
+	}
+	if len(dims) == 0 {
+		dims = append(dims, DefaultDimensions...)
+	}
+	return
+}
+
+// Each client's reputation is a record of parallel Pedersen commitments, one
+// per dimension, all under the same GT and HT. On the wire the records of a
+// table are flattened in the order of their keys, so that servers can
+// randomize every commitment with the same E and move a record as a whole.
+func FlattenRecords(records [][]abstract.Point) []abstract.Point {
+	vals := []abstract.Point{}
+	for _,record := range records {
+		vals = append(vals, record...)
+	}
+	return vals
+}
+
+// split flattened commitments into size records
+func SplitRecords(vals []abstract.Point, size int) [][]abstract.Point {
+	records := make([][]abstract.Point, size)
+	if size == 0 {
+		return records
+	}
+	dims := len(vals) / size
+	for i := 0; i < size; i++ {
+		records[i] = vals[i*dims : (i+1)*dims]
+	}
+	return records
+}
+
+// get the commitment of the dimension claimed in params["dim"],
+// nil if no dimension is claimed or the record has no such dimension
+func CommOfDimension(record []abstract.Point, params map[string]interface{}) abstract.Point {
+	dim, ok := params["dim"].(int)
+	if !ok || dim < 0 || dim >= len(record) {
+		return nil
+	}
+	return record[dim]
+}
+
+// format reputations of all dimensions, e.g. "provider=5 reporter=3"
+func FormatReputation(policy *Policy, reputations []int) string {
+	items := []string{}
+	for i,rep := range reputations {
+		items = append(items, policy.DimensionName(i) + "=" + strconv.Itoa(policy.Effective(rep)))
+	}
+	return strings.Join(items, " ")
+}
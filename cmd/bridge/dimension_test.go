@@ -0,0 +1,57 @@
+package bridge
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/nist"
+	"github.com/dedis/crypto/random"
+)
+
+func TestParseDimensions(t *testing.T) {
+	dims := ParseDimensions(" provider, reporter ,relay")
+	if !reflect.DeepEqual(dims, []string{"provider", "reporter", "relay"}) {
+		t.Error("Wrong dimensions", dims)
+	}
+	if !reflect.DeepEqual(ParseDimensions(""), DefaultDimensions) {
+		t.Error("Missing dimensions should fall back to the defaults")
+	}
+	policy := &Policy{Dimensions: []string{"provider", "relay"}}
+	if policy.DimensionIndex("relay") != 1 || policy.DimensionIndex("reporter") != -1 {
+		t.Error("Wrong dimension index")
+	}
+	if policy.VoteDimension() != 0 {
+		t.Error("Votes should fall back to the first dimension")
+	}
+}
+
+func TestSplitRecords(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	records := make([][]abstract.Point, 3)
+	for i := range records {
+		records[i] = []abstract.Point{
+			suite.Point().Mul(nil, suite.Secret().Pick(random.Stream)),
+			suite.Point().Mul(nil, suite.Secret().Pick(random.Stream)),
+		}
+	}
+	vals := FlattenRecords(records)
+	if len(vals) != 6 {
+		t.Error("Wrong number of flattened commitments", len(vals))
+	}
+	split := SplitRecords(vals, len(records))
+	for i := range records {
+		for j := range records[i] {
+			if !split[i][j].Equal(records[i][j]) {
+				t.Error("Record", i, "changed after splitting")
+			}
+		}
+	}
+	params := map[string]interface{}{"dim": 1}
+	if !CommOfDimension(split[0], params).Equal(records[0][1]) {
+		t.Error("Wrong commitment of dimension")
+	}
+	params["dim"] = 2
+	if CommOfDimension(split[0], params) != nil {
+		t.Error("Unknown dimension should have no commitment")
+	}
+}
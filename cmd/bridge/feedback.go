@@ -0,0 +1,80 @@
+package bridge
+
+import (
+	"strconv"
+
+	"zRep/util"
+)
+
+// Category classifies a requester's experience with an assigned bridge
+type Category int
+
+const (
+	WORKS Category = iota
+	SLOW
+	BLOCKED
+	NEVER_REACHABLE
+	MALICIOUS
+)
+
+// number of feedback categories
+const NumCategories int = 5
+
+var categoryNames = []string{"works", "slow", "blocked", "never_reachable", "malicious"}
+
+// default weight of each category added to the provider's reputation
+var DefaultWeights = []int{1, 0, -1, -1, -3}
+
+func (c Category) String() string {
+	if !c.Valid() {
+		return "unknown(" + strconv.Itoa(int(c)) + ")"
+	}
+	return categoryNames[c]
+}
+
+func (c Category) Valid() bool {
+	return c >= 0 && int(c) < NumCategories
+}
+
+// parse a category by its name, or by the legacy +1/-1 vote
+func ParseCategory(str string) (Category, bool) {
+	for i,name := range categoryNames {
+		if str == name {
+			return Category(i), true
+		}
+	}
+	vote, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, false
+	}
+	if vote > 0 {
+		return WORKS, true
+	}
+	return BLOCKED, true
+}
+
+// load each category's weight from parameters named "weight_<category>"
+func LoadWeights() []int {
+	weights := make([]int, NumCategories)
+	for i,name := range categoryNames {
+		weights[i] = util.GetIntParameter("weight_" + name, DefaultWeights[i])
+	}
+	return weights
+}
+
+// format a per-category breakdown, skipping empty categories
+func FormatBreakdown(counts []int) (str string) {
+	for i,count := range counts {
+		if count == 0 {
+			continue
+		}
+		if str != "" {
+			str += ", "
+		}
+		str += Category(i).String() + ": " + strconv.Itoa(count)
+	}
+	if str == "" {
+		str = "no feedback"
+	}
+	return
+}
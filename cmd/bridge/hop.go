@@ -0,0 +1,279 @@
+package bridge
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/proof"
+	"zRep/primitive/dleq"
+	"zRep/util"
+	"zRep/util/canonical"
+	"zRep/util/shuffle"
+)
+
+// Each server in the announcement and round-end passes raises the keys to its
+// round key (or back, in round end), and g, GT, HT and every commitment to a
+// fresh E. It attaches what it received (in_keys, in_vals, in_g, in_GT, in_HT)
+// and two proofs that it used a single exponent for each:
+//  key_proof   g = roundkey * in_g and keys = roundkey * in_keys (announcement),
+//              in_keys = roundkey * keys (round end)
+//  comm_proof  GT, HT and vals = E * (in_GT, in_HT, in_vals)
+// where keys and vals are the records before the shuffle. The next hop, or the
+// coordinator after the last one, checks both with VerifyHop. A hop also
+// carries the epoch the coordinator started the pass with.
+//
+// Every hop signs these parameters with its server key (hop_signature) and
+// appends them to the chain of hops of the pass (hops), so that the
+// coordinator can hand the whole chain of the announcement to clients, who
+// check it with VerifyHops against the keys of the servers of the round. A hop
+// receiving proofs that fail sends the signed parameters to the coordinator as
+// evidence, see CheckBlame.
+var HopParams = []string{"epoch", "in_keys", "in_vals", "in_g", "in_GT", "in_HT", "keys", "vals", "g", "GT", "HT",
+	"key_proof", "comm_proof", "shuffled", "prev_keys", "prev_vals", "xbar", "ybar", "proof"}
+
+var ErrHopChain = errors.New("a hop does not start from the output of the previous one")
+var ErrHopSigner = errors.New("a hop is not signed by the server of its position")
+var ErrHopNotShuffled = errors.New("a hop of several records did not shuffle them")
+
+// the records of a hop before its shuffle
+func raisedRecords(params map[string]interface{}) (keys, vals []abstract.Point) {
+	if _, shuffled := params["shuffled"]; shuffled {
+		return util.ProtobufDecodePointList(params["prev_keys"].([]byte)),
+			util.ProtobufDecodePointList(params["prev_vals"].([]byte))
+	}
+	return util.ProtobufDecodePointList(params["keys"].([]byte)),
+		util.ProtobufDecodePointList(params["vals"].([]byte))
+}
+
+// the pairs of the key proof of a hop, Q[i] = roundkey * P[i]
+func HopKeyPairs(suite abstract.Suite, params map[string]interface{}, announcement bool) (P, Q []abstract.Point) {
+	inKeys := util.ProtobufDecodePointList(params["in_keys"].([]byte))
+	keys, _ := raisedRecords(params)
+	if !announcement {
+		// round end takes the round key off
+		return keys, inKeys
+	}
+	// the first hop starts from the base
+	inG := suite.Point().Mul(nil, suite.Secret().One())
+	if byteG, ok := params["in_g"]; ok {
+		inG = util.DecodePoint(suite, byteG.([]byte))
+	}
+	g := util.DecodePoint(suite, params["g"].([]byte))
+	return append([]abstract.Point{inG}, inKeys...), append([]abstract.Point{g}, keys...)
+}
+
+// the pairs of the commitment proof of a hop, Q[i] = E * P[i]
+func HopCommPairs(suite abstract.Suite, params map[string]interface{}) (P, Q []abstract.Point) {
+	_, vals := raisedRecords(params)
+	P = []abstract.Point{util.DecodePoint(suite, params["in_GT"].([]byte)), util.DecodePoint(suite, params["in_HT"].([]byte))}
+	Q = []abstract.Point{util.DecodePoint(suite, params["GT"].([]byte)), util.DecodePoint(suite, params["HT"].([]byte))}
+	P = append(P, util.ProtobufDecodePointList(params["in_vals"].([]byte))...)
+	Q = append(Q, vals...)
+	return
+}
+
+// VerifyHop checks the exponentiation proofs a hop attached to its pass
+func VerifyHop(suite abstract.Suite, params map[string]interface{}, announcement bool) error {
+	P, Q := HopKeyPairs(suite, params, announcement)
+	if len(P) != len(Q) {
+		return dleq.ErrLength
+	}
+	// a round end without keys has nothing to prove
+	if len(P) > 0 {
+		if err := dleq.Verify(suite, P, Q, params["key_proof"].([]byte)); err != nil {
+			return err
+		}
+	}
+	P, Q = HopCommPairs(suite, params)
+	return dleq.Verify(suite, P, Q, params["comm_proof"].([]byte))
+}
+
+// VerifyShuffle checks the shuffle proof of a hop. Only a hop of a single
+// record may skip the shuffle, otherwise it would keep the order of its input
+func VerifyShuffle(suite abstract.Suite, params map[string]interface{}) error {
+	if _, shuffled := params["shuffled"]; !shuffled {
+		if len(util.ProtobufDecodePointList(params["in_keys"].([]byte))) > 1 {
+			return ErrHopNotShuffled
+		}
+		return nil
+	}
+	// get all the necessary parameters
+	xbarList := util.ProtobufDecodePointList(params["xbar"].([]byte))
+	ybarList := util.ProtobufDecodePointList(params["ybar"].([]byte))
+	prevKeyList := util.ProtobufDecodePointList(params["prev_keys"].([]byte))
+	prevValList := util.ProtobufDecodePointList(params["prev_vals"].([]byte))
+	keyList := util.ProtobufDecodePointList(params["keys"].([]byte))
+	valList := util.ProtobufDecodePointList(params["vals"].([]byte))
+
+	// each commitment must stay with its key
+	verifier, err := shuffle.RecordVerifier(suite, prevKeyList, prevValList,
+		keyList, valList, xbarList, ybarList)
+	if err != nil {
+		return err
+	}
+	return proof.HashVerify(suite, "RecordShuffle", verifier, params["proof"].([]byte))
+}
+
+// the hop parameters of a pass message and their signature
+func HopRecord(params map[string]interface{}) map[string]interface{} {
+	hop := make(map[string]interface{})
+	for _,name := range append(HopParams, "hop_signature") {
+		if val, ok := params[name]; ok {
+			hop[name] = val
+		}
+	}
+	return hop
+}
+
+// append the hop parameters of pm to the chain of hops received in params
+func AppendHop(params, pm map[string]interface{}) []byte {
+	hops := []map[string]interface{}{}
+	if data, ok := params["hops"]; ok {
+		hops = DecodeHops(data.([]byte))
+	}
+	return EncodeHops(append(hops, HopRecord(pm)))
+}
+
+// what a server signs for its hop
+func MessageOfHop(params map[string]interface{}) []byte {
+	e := canonical.New("hop")
+	for _,name := range HopParams {
+		switch val := params[name].(type) {
+		case []byte:
+			e.Bool(true).Bytes(val)
+		case bool:
+			e.Bool(true).Bool(val)
+		case int:
+			e.Bool(true).Int(val)
+		default:
+			e.Bool(false)
+		}
+	}
+	return e.Encoded()
+}
+
+// what a server signs to blame the previous hop of a pass
+func MessageOfBlame(phase int, evidence []byte, reason string) []byte {
+	return canonical.New("blame").Int(phase).Bytes(evidence).String(reason).Encoded()
+}
+
+// CheckBlame tells whether the evidence proves that the accused server sent a
+// hop whose proofs fail: the hop is signed by its key and fails VerifyHop or
+// VerifyShuffle. Otherwise the blame is false.
+func CheckBlame(suite abstract.Suite, hop map[string]interface{}, accusedKey abstract.Point, announcement bool) bool {
+	if !SignedBy(suite, hop, accusedKey) {
+		return false
+	}
+	return CheckHop(suite, hop, announcement) != nil
+}
+
+var ErrHopMalformed = errors.New("a hop is missing or has malformed parameters")
+
+// CheckHop runs VerifyHop and VerifyShuffle on a hop received from another
+// server, and turns a malformed hop into an error instead of a panic
+func CheckHop(suite abstract.Suite, hop map[string]interface{}, announcement bool) (err error) {
+	defer func() {
+		if recover() != nil {
+			err = ErrHopMalformed
+		}
+	}()
+	if err = VerifyHop(suite, hop, announcement); err != nil {
+		return err
+	}
+	return VerifyShuffle(suite, hop)
+}
+
+func EncodeHops(hops []map[string]interface{}) []byte {
+	return encodeParamsList(hops)
+}
+
+func DecodeHops(data []byte) []map[string]interface{} {
+	return decodeParamsList(data)
+}
+
+// VerifyHops checks a whole chain of hops: the proofs of every hop, that each
+// hop starts from the output of the previous one, and that the last one ends
+// with the table in final. If start is not nil, the first hop must start from
+// it, which only the coordinator knows. If servers is not nil, there must be
+// one hop per server, the i-th hop signed by the i-th server (counting from
+// the end in round end, whose pass runs backwards).
+func VerifyHops(suite abstract.Suite, hops []map[string]interface{}, start, final map[string]interface{},
+	servers []abstract.Point, announcement bool) error {
+	_, err := FirstBadHop(suite, hops, start, final, servers, announcement)
+	return err
+}
+
+// FirstBadHop is VerifyHops, also telling the index of the first hop that
+// fails, -1 if the chain is empty or does not have one hop per server
+func FirstBadHop(suite abstract.Suite, hops []map[string]interface{}, start, final map[string]interface{},
+	servers []abstract.Point, announcement bool) (int, error) {
+	if len(hops) == 0 {
+		return -1, ErrHopChain
+	}
+	if servers != nil && len(hops) != len(servers) {
+		return -1, ErrHopSigner
+	}
+	names := []string{"keys", "vals", "GT", "HT"}
+	if announcement {
+		names = append(names, "g")
+	}
+	for i,hop := range hops {
+		if servers != nil && !SignedBy(suite, hop, hopServer(servers, i, announcement)) {
+			return i, ErrHopSigner
+		}
+		if err := CheckHop(suite, hop, announcement); err != nil {
+			return i, err
+		}
+		// every hop belongs to the round of the pass
+		if hop["epoch"] != hops[0]["epoch"] || (start != nil && hop["epoch"] != start["epoch"]) {
+			return i, ErrHopChain
+		}
+		if i == 0 {
+			// the first hop starts from the base
+			if _, ok := hop["in_g"]; ok {
+				return i, ErrHopChain
+			}
+			if start == nil {
+				continue
+			}
+			for _,name := range []string{"keys", "vals", "GT", "HT"} {
+				if !equalParam(start, name, hop, "in_" + name) {
+					return i, ErrHopChain
+				}
+			}
+			continue
+		}
+		for _,name := range names {
+			if !equalParam(hops[i-1], name, hop, "in_" + name) {
+				return i, ErrHopChain
+			}
+		}
+	}
+	for _,name := range names {
+		if !equalParam(hops[len(hops)-1], name, final, name) {
+			return len(hops)-1, ErrHopChain
+		}
+	}
+	return -1, nil
+}
+
+// the server making the i-th hop of a pass
+func hopServer(servers []abstract.Point, i int, announcement bool) abstract.Point {
+	if announcement {
+		return servers[i]
+	}
+	return servers[len(servers)-1-i]
+}
+
+// SignedBy tells whether a hop carries a signature of server
+func SignedBy(suite abstract.Suite, hop map[string]interface{}, server abstract.Point) bool {
+	sig, ok := hop["hop_signature"].([]byte)
+	return ok && util.ElGamalVerify(suite, MessageOfHop(hop), server, sig, nil) == nil
+}
+
+func equalParam(a map[string]interface{}, nameA string, b map[string]interface{}, nameB string) bool {
+	valA, okA := a[nameA].([]byte)
+	valB, okB := b[nameB].([]byte)
+	return okA && okB && bytes.Equal(valA, valB)
+}
@@ -0,0 +1,223 @@
+package bridge_test
+
+import (
+	"testing"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/nist"
+	"github.com/dedis/crypto/random"
+	"zRep/cmd/bridge"
+	"zRep/cmd/bridge/bridgetest"
+	"zRep/primitive/dleq"
+	"zRep/util"
+)
+
+// what a hop of the announcement sends, without shuffle
+func announcementHop(suite abstract.Suite, roundkey, E abstract.Secret) map[string]interface{} {
+	inG := bridgetest.RandomPoints(suite, 1)[0]
+	inKeys := bridgetest.RandomPoints(suite, 3)
+	inVals := bridgetest.RandomPoints(suite, 6)
+	GT, HT := bridgetest.RandomPoints(suite, 1)[0], bridgetest.RandomPoints(suite, 1)[0]
+	params := map[string]interface{}{
+		"in_g": util.EncodePoint(inG),
+		"in_keys": util.ProtobufEncodePointList(inKeys),
+		"in_vals": util.ProtobufEncodePointList(inVals),
+		"in_GT": util.EncodePoint(GT),
+		"in_HT": util.EncodePoint(HT),
+		"g": util.EncodePoint(suite.Point().Mul(inG, roundkey)),
+		"keys": util.ProtobufEncodePointList(bridgetest.RaisePoints(suite, inKeys, roundkey)),
+		"vals": util.ProtobufEncodePointList(bridgetest.RaisePoints(suite, inVals, E)),
+		"GT": util.EncodePoint(suite.Point().Mul(GT, E)),
+		"HT": util.EncodePoint(suite.Point().Mul(HT, E)),
+	}
+	P, Q := bridge.HopKeyPairs(suite, params, true)
+	params["key_proof"] = dleq.Prove(suite, roundkey, P, Q)
+	P, Q = bridge.HopCommPairs(suite, params)
+	params["comm_proof"] = dleq.Prove(suite, E, P, Q)
+	return params
+}
+
+func TestVerifyHop(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	roundkey := suite.Secret().Pick(random.Stream)
+	E := suite.Secret().Pick(random.Stream)
+	params := announcementHop(suite, roundkey, E)
+	if err := bridge.VerifyHop(suite, params, true); err != nil {
+		t.Error("Fails to verify a hop:", err)
+	}
+
+	// g raised to another key than the table
+	inG := util.DecodePoint(suite, params["in_g"].([]byte))
+	params["g"] = util.EncodePoint(suite.Point().Mul(inG, suite.Secret().Pick(random.Stream)))
+	if bridge.VerifyHop(suite, params, true) == nil {
+		t.Error("A hop with an inconsistent round key passes")
+	}
+
+	// one commitment raised to another E
+	params = announcementHop(suite, roundkey, E)
+	inVals := util.ProtobufDecodePointList(params["in_vals"].([]byte))
+	vals := bridgetest.RaisePoints(suite, inVals, E)
+	vals[4] = suite.Point().Mul(inVals[4], suite.Secret().Pick(random.Stream))
+	params["vals"] = util.ProtobufEncodePointList(vals)
+	if bridge.VerifyHop(suite, params, true) == nil {
+		t.Error("A hop with an inconsistent E passes")
+	}
+}
+
+func TestVerifyRoundEndHop(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	roundkey := suite.Secret().Pick(random.Stream)
+	E := suite.Secret().Pick(random.Stream)
+	// round end takes the round key off the keys
+	keys := bridgetest.RandomPoints(suite, 3)
+	params := announcementHop(suite, roundkey, E)
+	delete(params, "in_g")
+	delete(params, "g")
+	params["keys"] = util.ProtobufEncodePointList(keys)
+	params["in_keys"] = util.ProtobufEncodePointList(bridgetest.RaisePoints(suite, keys, roundkey))
+	P, Q := bridge.HopKeyPairs(suite, params, false)
+	params["key_proof"] = dleq.Prove(suite, roundkey, P, Q)
+	if err := bridge.VerifyHop(suite, params, false); err != nil {
+		t.Error("Fails to verify a round-end hop:", err)
+	}
+
+	keys[0], keys[1] = keys[1], keys[0]
+	params["keys"] = util.ProtobufEncodePointList(keys)
+	if bridge.VerifyHop(suite, params, false) == nil {
+		t.Error("A round-end hop with swapped keys passes")
+	}
+}
+
+func TestVerifyHops(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	start := map[string]interface{}{
+		"keys": util.ProtobufEncodePointList(bridgetest.RandomPoints(suite, 3)),
+		"vals": util.ProtobufEncodePointList(bridgetest.RandomPoints(suite, 6)),
+		"GT": util.EncodePoint(bridgetest.RandomPoints(suite, 1)[0]),
+		"HT": util.EncodePoint(bridgetest.RandomPoints(suite, 1)[0]),
+	}
+	final := bridgetest.NextHop(suite, bridgetest.NextHop(suite, start, nil), nil)
+	hops := bridge.DecodeHops(final["hops"].([]byte))
+	if len(hops) != 2 {
+		t.Fatal("Wrong number of hops", len(hops))
+	}
+	if err := bridge.VerifyHops(suite, hops, start, final, nil, true); err != nil {
+		t.Error("Fails to verify a chain of hops:", err)
+	}
+	if err := bridge.VerifyHops(suite, hops, nil, final, nil, true); err != nil {
+		t.Error("Fails to verify a chain of hops without its start:", err)
+	}
+
+	// a chain that does not start from what was announced
+	other := map[string]interface{}{}
+	for name, val := range start {
+		other[name] = val
+	}
+	other["keys"] = util.ProtobufEncodePointList(bridgetest.RandomPoints(suite, 3))
+	if bridge.VerifyHops(suite, hops, other, final, nil, true) != bridge.ErrHopChain {
+		t.Error("A chain from another table passes")
+	}
+
+	// a table that is not the output of the last hop
+	final["keys"] = hops[0]["keys"]
+	if bridge.VerifyHops(suite, hops, start, final, nil, true) != bridge.ErrHopChain {
+		t.Error("A table that is not the output of the chain passes")
+	}
+	final["keys"] = hops[1]["keys"]
+
+	// a hop dropped from the chain
+	if bridge.VerifyHops(suite, hops[1:], start, final, nil, true) != bridge.ErrHopChain {
+		t.Error("A chain missing a hop passes")
+	}
+
+	// a shuffle that moves commitments to other keys
+	vals := util.ProtobufDecodePointList(hops[1]["vals"].([]byte))
+	vals[0], vals[2] = vals[2], vals[0]
+	hops[1]["vals"] = util.ProtobufEncodePointList(vals)
+	final["vals"] = hops[1]["vals"]
+	if bridge.VerifyHops(suite, hops, start, final, nil, true) == nil {
+		t.Error("A chain with a broken shuffle passes")
+	}
+}
+
+func TestVerifyHopSigners(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	start := map[string]interface{}{
+		"keys": util.ProtobufEncodePointList(bridgetest.RandomPoints(suite, 3)),
+		"vals": util.ProtobufEncodePointList(bridgetest.RandomPoints(suite, 3)),
+		"GT": util.EncodePoint(bridgetest.RandomPoints(suite, 1)[0]),
+		"HT": util.EncodePoint(bridgetest.RandomPoints(suite, 1)[0]),
+	}
+	keys := []abstract.Secret{suite.Secret().Pick(random.Stream), suite.Secret().Pick(random.Stream)}
+	servers := []abstract.Point{suite.Point().Mul(nil, keys[0]), suite.Point().Mul(nil, keys[1])}
+	final := bridgetest.NextHop(suite, bridgetest.NextHop(suite, start, keys[0]), keys[1])
+	hops := bridge.DecodeHops(final["hops"].([]byte))
+	if err := bridge.VerifyHops(suite, hops, start, final, servers, true); err != nil {
+		t.Error("Fails to verify a chain of hops signed by its servers:", err)
+	}
+
+	// the servers in another order did not make the hops
+	swapped := []abstract.Point{servers[1], servers[0]}
+	if bad, err := bridge.FirstBadHop(suite, hops, start, final, swapped, true); bad != 0 || err != bridge.ErrHopSigner {
+		t.Error("A chain signed by the servers out of order passes", bad, err)
+	}
+
+	// a server making every hop of the chain
+	forged := bridgetest.NextHop(suite, bridgetest.NextHop(suite, start, keys[1]), keys[1])
+	if bad, err := bridge.FirstBadHop(suite, bridge.DecodeHops(forged["hops"].([]byte)), start, forged, servers, true); bad != 0 || err != bridge.ErrHopSigner {
+		t.Error("A chain forged by one server passes", bad, err)
+	}
+
+	// a chain skipping a server
+	short := bridgetest.NextHop(suite, start, keys[0])
+	if bad, err := bridge.FirstBadHop(suite, bridge.DecodeHops(short["hops"].([]byte)), start, short, servers, true); bad != -1 || err != bridge.ErrHopSigner {
+		t.Error("A chain with a hop less than servers passes", bad, err)
+	}
+}
+
+func TestCheckHopShuffled(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	roundkey := suite.Secret().Pick(random.Stream)
+	E := suite.Secret().Pick(random.Stream)
+	if bridge.CheckHop(suite, announcementHop(suite, roundkey, E), true) != bridge.ErrHopNotShuffled {
+		t.Error("A hop keeping the order of several records passes")
+	}
+}
+
+func TestCheckBlame(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	key := suite.Secret().Pick(random.Stream)
+	other := suite.Secret().Pick(random.Stream)
+	start := map[string]interface{}{
+		"keys": util.ProtobufEncodePointList(bridgetest.RandomPoints(suite, 3)),
+		"vals": util.ProtobufEncodePointList(bridgetest.RandomPoints(suite, 3)),
+		"GT": util.EncodePoint(bridgetest.RandomPoints(suite, 1)[0]),
+		"HT": util.EncodePoint(bridgetest.RandomPoints(suite, 1)[0]),
+	}
+	sign := func(hop map[string]interface{}, x abstract.Secret) map[string]interface{} {
+		hop["hop_signature"] = util.ElGamalSign(suite, random.Stream, bridge.MessageOfHop(hop), x, nil)
+		// what the accuser sends as evidence
+		return bridge.DecodeHops(bridge.EncodeHops([]map[string]interface{}{bridge.HopRecord(hop)}))[0]
+	}
+	accusedKey := suite.Point().Mul(nil, key)
+
+	good := bridgetest.NextHop(suite, start, nil)
+	if bridge.CheckBlame(suite, sign(good, key), accusedKey, true) {
+		t.Error("A good hop is blamed")
+	}
+
+	bad := bridgetest.NextHop(suite, start, nil)
+	bad["g"] = util.EncodePoint(bridgetest.RandomPoints(suite, 1)[0])
+	if !bridge.CheckBlame(suite, sign(bad, key), accusedKey, true) {
+		t.Error("A bad hop signed by the accused is not blamed on it")
+	}
+	if bridge.CheckBlame(suite, sign(bad, other), accusedKey, true) {
+		t.Error("A bad hop not signed by the accused is blamed on it")
+	}
+
+	malformed := bridgetest.NextHop(suite, start, nil)
+	delete(malformed, "comm_proof")
+	if !bridge.CheckBlame(suite, sign(malformed, key), accusedKey, true) {
+		t.Error("A malformed hop signed by the accused is not blamed on it")
+	}
+}
@@ -0,0 +1,265 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"strconv"
+	"strings"
+
+	"zRep/util"
+)
+
+// a limit of NoLimit is never enforced
+const NoLimit int = -1
+
+// Policy decides how reputations evolve across rounds.
+//
+// Since reputations are hidden in commitments, the coordinator can only apply
+// value-independent rules to them: per-round gain/loss limits and decay are
+// folded into the diff committed in roundEnd. Floor and cap bound the
+// reputation a client is able to prove instead: nobody can prove more than
+// Cap, and everybody is regarded as having at least Floor.
+//
+// Floor is not a bound on the committed reputation. Decay is subtracted from
+// every record each round whatever its value, so the reputation of an idle
+// client keeps falling below Floor without limit. It can still claim Floor,
+// but has to make up the whole deficit before it can prove anything above it.
+type Policy struct {
+	// reputation of a newly registered client
+	InitialCredit int
+	// subtracted from every client's reputation each round, also below Floor
+	Decay int
+	// maximum reputation gained or lost in one round
+	MaxGain int
+	MaxLoss int
+	// bounds of the reputation a client can prove
+	Floor int
+	Cap int
+	// multipliers of votes backed by proofs of the voter's reputation,
+	// sorted by level in ascending order
+	VoteBrackets []Bracket
+	// minimum reputation to post a bridge, and the number of bridges
+	// a provider proving each level can post in a round
+	PostMinimum int
+	PostQuotas []Bracket
+	// names of reputation dimensions, the rules above apply to each of them
+	Dimensions []string
+	// weight of each feedback category added to the provider's reputation,
+	// and the reporter reputation earned by each accepted vote, 0 by
+	// default. Servers tally votes with them too, so they are part of the policy.
+	Weights []int
+	ReportCredit int
+}
+
+// a client proving reputation >= Level gets Value, e.g. a vote counts
+// Value times, or Value bridges can be posted in a round
+type Bracket struct {
+	Level int
+	Value int
+}
+
+var DefaultPolicy = Policy{
+	InitialCredit: StartingCredit,
+	Decay: 0,
+	MaxGain: NoLimit,
+	MaxLoss: NoLimit,
+	Floor: 0,
+	Cap: NoLimit,
+	Dimensions: DefaultDimensions,
+	Weights: DefaultWeights,
+	ReportCredit: 0,
+}
+
+// load the policy from parameters named "policy_<field>"
+func LoadPolicy() *Policy {
+	return &Policy{
+		InitialCredit: util.GetIntParameter("policy_initial_credit", DefaultPolicy.InitialCredit),
+		Decay: util.GetIntParameter("policy_decay", DefaultPolicy.Decay),
+		MaxGain: util.GetIntParameter("policy_max_gain", DefaultPolicy.MaxGain),
+		MaxLoss: util.GetIntParameter("policy_max_loss", DefaultPolicy.MaxLoss),
+		Floor: util.GetIntParameter("policy_floor", DefaultPolicy.Floor),
+		Cap: util.GetIntParameter("policy_cap", DefaultPolicy.Cap),
+		VoteBrackets: ParseBrackets(util.GetParameter("policy_vote_brackets")),
+		PostMinimum: util.GetIntParameter("policy_post_minimum", DefaultPolicy.PostMinimum),
+		PostQuotas: ParseBrackets(util.GetParameter("policy_post_quotas")),
+		Dimensions: ParseDimensions(util.GetParameter("policy_dimensions")),
+		Weights: LoadWeights(),
+		ReportCredit: util.GetIntParameter("report_credit", DefaultPolicy.ReportCredit),
+	}
+}
+
+// parse brackets in the form of "level:value,level:value,..."
+func ParseBrackets(str string) (brackets []Bracket) {
+	for _,item := range strings.Split(str, ",") {
+		pair := strings.Split(item, ":")
+		if len(pair) != 2 {
+			continue
+		}
+		level, err1 := strconv.Atoi(strings.TrimSpace(pair[0]))
+		value, err2 := strconv.Atoi(strings.TrimSpace(pair[1]))
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		brackets = append(brackets, Bracket{Level: level, Value: value})
+	}
+	sort.Slice(brackets, func(i, j int) bool { return brackets[i].Level < brackets[j].Level })
+	return
+}
+
+// AdjustDiff turns the diff tallied from votes into the diff committed at round end.
+// Decay applies whatever the hidden reputation is, Floor does not stop it
+func (p *Policy) AdjustDiff(diff int) int {
+	if p.MaxGain != NoLimit && diff > p.MaxGain {
+		diff = p.MaxGain
+	}
+	if p.MaxLoss != NoLimit && diff < -p.MaxLoss {
+		diff = -p.MaxLoss
+	}
+	return diff - p.Decay
+}
+
+// Effective bounds a committed reputation by floor and cap
+func (p *Policy) Effective(reputation int) int {
+	if p.Cap != NoLimit && reputation > p.Cap {
+		reputation = p.Cap
+	}
+	if reputation < p.Floor {
+		reputation = p.Floor
+	}
+	return reputation
+}
+
+// NeedProof tells whether claiming ind requires a proof on the commitment.
+// Everybody is regarded as having at least Floor.
+func (p *Policy) NeedProof(ind int) bool {
+	return ind > p.Floor
+}
+
+// Allows tells whether ind can ever be claimed
+func (p *Policy) Allows(ind int) bool {
+	return p.Cap == NoLimit || ind <= p.Cap
+}
+
+// highest bracket level a client with reputation can prove,
+// false if no bracket is reachable
+func (p *Policy) bracketLevel(brackets []Bracket, reputation int) (int, bool) {
+	effective := p.Effective(reputation)
+	level, ok := 0, false
+	for _,bracket := range brackets {
+		if bracket.Level <= effective && p.Allows(bracket.Level) {
+			level, ok = bracket.Level, true
+		}
+	}
+	return level, ok
+}
+
+// value of the highest bracket not above level, def if there is none
+func bracketValue(brackets []Bracket, level int, def int) int {
+	value := def
+	for _,bracket := range brackets {
+		if bracket.Level <= level {
+			value = bracket.Value
+		}
+	}
+	return value
+}
+
+// VoteLevel returns the highest vote bracket level a client with reputation
+// can prove, and false if no bracket is reachable
+func (p *Policy) VoteLevel(reputation int) (int, bool) {
+	return p.bracketLevel(p.VoteBrackets, reputation)
+}
+
+// VoteMultiplier returns how many times a vote proving reputation >= level counts
+func (p *Policy) VoteMultiplier(level int) int {
+	return bracketValue(p.VoteBrackets, level, 1)
+}
+
+// UnweightedMultiplier returns how many times a vote without a proof of
+// reputation counts, which is the multiplier of the floor since everybody
+// is regarded as having at least Floor
+func (p *Policy) UnweightedMultiplier() int {
+	return p.VoteMultiplier(p.Floor)
+}
+
+// PostLevel returns the level a provider with reputation should prove to
+// post bridges, and false if it does not reach PostMinimum
+func (p *Policy) PostLevel(reputation int) (int, bool) {
+	if !p.Allows(p.PostMinimum) || p.Effective(reputation) < p.PostMinimum {
+		return 0, false
+	}
+	level, ok := p.bracketLevel(p.PostQuotas, reputation)
+	if !ok || level < p.PostMinimum {
+		level = p.PostMinimum
+	}
+	return level, true
+}
+
+// PostQuota returns how many bridges a provider proving reputation >= level
+// can post in a round, NoLimit if quotas are not configured
+func (p *Policy) PostQuota(level int) int {
+	if len(p.PostQuotas) == 0 {
+		return NoLimit
+	}
+	return bracketValue(p.PostQuotas, level, 0)
+}
+
+// PostDimension returns the dimension backing bridge posting, which is
+// the provider dimension if there is one
+func (p *Policy) PostDimension() int {
+	if dim := p.DimensionIndex(PROVIDER); dim >= 0 {
+		return dim
+	}
+	return 0
+}
+
+// NumDimensions returns the number of commitments in a reputation record
+func (p *Policy) NumDimensions() int {
+	return len(p.Dimensions)
+}
+
+// DimensionIndex returns the index of the named dimension, -1 if unknown
+func (p *Policy) DimensionIndex(name string) int {
+	for i,dim := range p.Dimensions {
+		if dim == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *Policy) DimensionName(dim int) string {
+	if dim < 0 || dim >= len(p.Dimensions) {
+		return strconv.Itoa(dim)
+	}
+	return p.Dimensions[dim]
+}
+
+// VoteDimension returns the dimension backing weighted votes, which is
+// the reporter dimension if there is one
+func (p *Policy) VoteDimension() int {
+	if dim := p.DimensionIndex(REPORTER); dim >= 0 {
+		return dim
+	}
+	return 0
+}
+
+func EncodePolicy(p *Policy) []byte {
+	var buf bytes.Buffer
+	encoder := gob.NewEncoder(&buf)
+	err := encoder.Encode(p)
+	if err != nil {
+		panic(err.Error())
+	}
+	return buf.Bytes()
+}
+
+func DecodePolicy(data []byte) *Policy {
+	p := new(Policy)
+	buf := bytes.NewReader(data)
+	decoder := gob.NewDecoder(buf)
+	err := decoder.Decode(p)
+	util.CheckErr(err)
+	return p
+}
@@ -0,0 +1,120 @@
+package bridge
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAdjustDiff(t *testing.T) {
+	policy := &Policy{InitialCredit: 5, Decay: 1, MaxGain: 3, MaxLoss: 2, Floor: 0, Cap: NoLimit}
+	if diff := policy.AdjustDiff(10); diff != 2 {
+		t.Error("Gain should have been limited, got", diff)
+	}
+	if diff := policy.AdjustDiff(-10); diff != -3 {
+		t.Error("Loss should have been limited, got", diff)
+	}
+	if diff := policy.AdjustDiff(0); diff != -1 {
+		t.Error("Reputation should have decayed, got", diff)
+	}
+	if diff := DefaultPolicy.AdjustDiff(-10); diff != -10 {
+		t.Error("Default policy should not change the diff, got", diff)
+	}
+}
+
+func TestEffective(t *testing.T) {
+	policy := &Policy{InitialCredit: 5, Decay: 0, MaxGain: NoLimit, MaxLoss: NoLimit, Floor: 1, Cap: 10}
+	if rep := policy.Effective(-5); rep != 1 {
+		t.Error("Reputation should have been raised to the floor, got", rep)
+	}
+	if rep := policy.Effective(20); rep != 10 {
+		t.Error("Reputation should have been lowered to the cap, got", rep)
+	}
+	if policy.NeedProof(1) || !policy.NeedProof(2) {
+		t.Error("Only indicators above the floor need proofs")
+	}
+	if !policy.Allows(10) || policy.Allows(11) {
+		t.Error("Only indicators within the cap are allowed")
+	}
+}
+
+// decay is not bounded by the floor, which only bounds what can be proved
+func TestDecayBelowFloor(t *testing.T) {
+	policy := &Policy{InitialCredit: 5, Decay: 2, MaxGain: NoLimit, MaxLoss: NoLimit, Floor: 1, Cap: NoLimit}
+	reputation := policy.InitialCredit
+	for round := 0; round < 5; round++ {
+		reputation += policy.AdjustDiff(0)
+	}
+	if reputation != -5 {
+		t.Error("Idle reputation after 5 rounds is", reputation, "instead of -5")
+	}
+	if policy.Effective(reputation) != policy.Floor {
+		t.Error("A reputation below the floor is not regarded as the floor")
+	}
+	// back in favour, the deficit is made up before anything above the floor
+	reputation += policy.AdjustDiff(7)
+	if reputation != 0 || policy.Effective(reputation) != policy.Floor {
+		t.Error("Reputation", reputation, "is not still at the floor after a gain of 7")
+	}
+}
+
+func TestEncodingPolicy(t *testing.T) {
+	policy := &Policy{InitialCredit: 5, Decay: 1, MaxGain: NoLimit, MaxLoss: 2, Floor: 0, Cap: 10}
+	policy.VoteBrackets = ParseBrackets("10:3, 5:2")
+	policy2 := DecodePolicy(EncodePolicy(policy))
+	if !reflect.DeepEqual(policy, policy2) {
+		t.Error("Decoded policy is different from the origin")
+	}
+}
+
+func TestVoteBrackets(t *testing.T) {
+	policy := &Policy{InitialCredit: 5, Decay: 0, MaxGain: NoLimit, MaxLoss: NoLimit, Floor: 0, Cap: NoLimit}
+	policy.VoteBrackets = ParseBrackets("10:3,5:2,xxx,0:1")
+	if len(policy.VoteBrackets) != 3 || policy.VoteBrackets[0].Level != 0 {
+		t.Error("Brackets should have been sorted by level", policy.VoteBrackets)
+	}
+	if level, ok := policy.VoteLevel(7); !ok || level != 5 {
+		t.Error("Reputation 7 should prove level 5, got", level)
+	}
+	if level, ok := policy.VoteLevel(-3); !ok || level != 0 {
+		t.Error("Reputation below the floor should prove level 0, got", level)
+	}
+	if multiplier := policy.VoteMultiplier(5); multiplier != 2 {
+		t.Error("Level 5 should count twice, got", multiplier)
+	}
+	if multiplier := policy.VoteMultiplier(100); multiplier != 3 {
+		t.Error("Level 100 should count three times, got", multiplier)
+	}
+	policy.Floor = 5
+	if multiplier := policy.UnweightedMultiplier(); multiplier != 2 {
+		t.Error("Unweighted votes should count like the floor, got", multiplier)
+	}
+	if _, ok := DefaultPolicy.VoteLevel(100); ok {
+		t.Error("Default policy should have no brackets")
+	}
+}
+
+func TestPostQuotas(t *testing.T) {
+	policy := &Policy{InitialCredit: 5, Decay: 0, MaxGain: NoLimit, MaxLoss: NoLimit, Floor: 0, Cap: NoLimit}
+	policy.PostMinimum = 3
+	policy.PostQuotas = ParseBrackets("3:1,10:5")
+	if _, ok := policy.PostLevel(2); ok {
+		t.Error("Reputation below the minimum should not post")
+	}
+	if level, ok := policy.PostLevel(7); !ok || level != 3 {
+		t.Error("Reputation 7 should prove level 3, got", level)
+	}
+	if level, ok := policy.PostLevel(12); !ok || level != 10 {
+		t.Error("Reputation 12 should prove level 10, got", level)
+	}
+	if quota := policy.PostQuota(10); quota != 5 {
+		t.Error("Level 10 should post 5 bridges, got", quota)
+	}
+	if quota := policy.PostQuota(2); quota != 0 {
+		t.Error("Level below all brackets should post nothing, got", quota)
+	}
+	if quota := DefaultPolicy.PostQuota(0); quota != NoLimit {
+		t.Error("Default policy should not limit posting, got", quota)
+	}
+	if level, ok := DefaultPolicy.PostLevel(-5); !ok || level != 0 {
+		t.Error("Default policy should let everybody post at the floor")
+	}
+}
@@ -0,0 +1,142 @@
+package bridge
+
+import (
+	"errors"
+
+	"github.com/dedis/crypto/abstract"
+)
+
+var ErrDuplicateBridge = errors.New("bridge has been posted by another nym")
+var ErrUnknownBridge = errors.New("bridge is not in the pool")
+var ErrNymMismatch = errors.New("old nym does not own the bridge")
+var ErrAlreadyBound = errors.New("bridge has already been bound in this round")
+
+// PoolEntry keeps a posted bridge alive for several rounds
+type PoolEntry struct {
+	Addr string
+	Nym abstract.Point // provider's nym in the round it was last bound
+	Round int // the round in which Nym is valid
+	Expiry int // the last round in which the bridge can be handed out
+	Handouts int // how many assignments of the bridge have been completed
+	Pending int // assignments made in this round but not completed yet
+	Takers map[string]bool // requesters who got the bridge in this round
+}
+
+// Pool records all bridges posted by clients. A bridge survives Lifetime
+// rounds since its last posting, as long as its provider re-binds the bridge
+// to its new nym after each announcement.
+type Pool struct {
+	Entries map[string]*PoolEntry
+	// number of rounds a posted bridge stays in the pool
+	Lifetime int
+	// maximum number of times a bridge is handed out, 0 means unlimited
+	MaxHandouts int
+	// current round
+	Round int
+}
+
+func NewPool(lifetime, maxHandouts int) *Pool {
+	return &Pool{
+		Entries: make(map[string]*PoolEntry),
+		Lifetime: lifetime,
+		MaxHandouts: maxHandouts,
+		Round: 0,
+	}
+}
+
+// Contains tells whether a bridge is in the pool
+func (p *Pool) Contains(addr string) bool {
+	_, ok := p.Entries[addr]
+	return ok
+}
+
+// Post adds a bridge provided by nym into the pool.
+// Posting a bridge again under the same nym renews its lifetime.
+func (p *Pool) Post(addr string, nym abstract.Point) error {
+	if entry, ok := p.Entries[addr]; ok {
+		if entry.Round != p.Round || !entry.Nym.Equal(nym) {
+			return ErrDuplicateBridge
+		}
+		entry.Expiry = p.Round + p.Lifetime - 1
+		return nil
+	}
+	p.Entries[addr] = &PoolEntry{
+		Addr: addr,
+		Nym: nym,
+		Round: p.Round,
+		Expiry: p.Round + p.Lifetime - 1,
+		Handouts: 0,
+		Pending: 0,
+		Takers: make(map[string]bool),
+	}
+	return nil
+}
+
+// Rebind moves a bridge from its provider's nym of last round to the
+// provider's nym of the current round
+func (p *Pool) Rebind(addr string, oldNym, newNym abstract.Point) error {
+	entry, ok := p.Entries[addr]
+	if !ok {
+		return ErrUnknownBridge
+	}
+	if entry.Round == p.Round {
+		return ErrAlreadyBound
+	}
+	if !entry.Nym.Equal(oldNym) {
+		return ErrNymMismatch
+	}
+	entry.Nym = newNym
+	entry.Round = p.Round
+	return nil
+}
+
+// Take hands out at most num bridges which are bound in the current round,
+// skipping bridges provided by nymR itself, bridges nymR already got in this
+// round and bridges reaching the cap. Handouts only count once the
+// assignment is completed, see Complete.
+func (p *Pool) Take(num int, nymR abstract.Point) []Bridge {
+	res := []Bridge{}
+	nymStr := nymR.String()
+	for _,entry := range p.Entries {
+		if len(res) >= num {
+			break
+		}
+		if entry.Round != p.Round || entry.Nym.Equal(nymR) || entry.Takers[nymStr] {
+			continue
+		}
+		// pending assignments hold a slot until the round ends
+		if p.MaxHandouts > 0 && entry.Handouts + entry.Pending >= p.MaxHandouts {
+			continue
+		}
+		entry.Pending++
+		entry.Takers[nymStr] = true
+		res = append(res, Bridge{Addr:entry.Addr, Nym:entry.Nym})
+	}
+	return res
+}
+
+// Complete counts a handout of the bridge once all signatures on its
+// assignment have been collected
+func (p *Pool) Complete(addr string) {
+	entry, ok := p.Entries[addr]
+	if !ok || entry.Pending == 0 {
+		return
+	}
+	entry.Pending--
+	entry.Handouts++
+}
+
+// NextRound drops expired bridges and bridges whose providers failed to
+// re-bind them during the round that just ended
+func (p *Pool) NextRound() {
+	for addr,entry := range p.Entries {
+		if entry.Expiry <= p.Round || entry.Round != p.Round {
+			delete(p.Entries, addr)
+			continue
+		}
+		// assignments not completed in the round are given up
+		entry.Pending = 0
+		entry.Takers = make(map[string]bool)
+	}
+	p.Round++
+}
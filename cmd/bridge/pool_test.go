@@ -0,0 +1,132 @@
+package bridge
+import (
+	"testing"
+	"github.com/dedis/crypto/random"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/nist"
+)
+
+func randomNym(suite abstract.Suite) abstract.Point {
+	return suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
+}
+
+func TestPoolDuplicate(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	nym1 := randomNym(suite)
+	nym2 := randomNym(suite)
+	pool := NewPool(2, 0)
+
+	if err := pool.Post("xxx", nym1); err != nil {
+		t.Error("Fails to post a new bridge:", err)
+	}
+	if err := pool.Post("xxx", nym1); err != nil {
+		t.Error("Fails to re-post a bridge by the same nym:", err)
+	}
+	if err := pool.Post("xxx", nym2); err != ErrDuplicateBridge {
+		t.Error("Duplicated bridge from another nym should have been rejected")
+	}
+}
+
+func TestPoolLifetime(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	nym1 := randomNym(suite)
+	nym2 := randomNym(suite)
+	nymR := randomNym(suite)
+	pool := NewPool(2, 0)
+	pool.Post("xxx", nym1)
+
+	// the bridge is not handed out until it is re-bound
+	pool.NextRound()
+	if len(pool.Take(1, nymR)) != 0 {
+		t.Error("Bridge should not be handed out before re-binding")
+	}
+	if err := pool.Rebind("xxx", nym2, nym1); err != ErrNymMismatch {
+		t.Error("Re-binding from a wrong nym should have been rejected")
+	}
+	if err := pool.Rebind("xxx", nym1, nym2); err != nil {
+		t.Error("Fails to re-bind:", err)
+	}
+	brs := pool.Take(1, nymR)
+	if len(brs) != 1 || !brs[0].Nym.Equal(nym2) {
+		t.Error("Bridge should have been handed out under the new nym")
+	}
+
+	// the bridge expires after two rounds
+	pool.NextRound()
+	if _, ok := pool.Entries["xxx"]; ok {
+		t.Error("Bridge should have expired")
+	}
+}
+
+func TestPoolMissedRebind(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	nym1 := randomNym(suite)
+	pool := NewPool(5, 0)
+	pool.Post("xxx", nym1)
+
+	pool.NextRound()
+	pool.NextRound()
+	if _, ok := pool.Entries["xxx"]; ok {
+		t.Error("Bridge should have been dropped without re-binding")
+	}
+}
+
+func TestPoolHandoutCap(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	nym1 := randomNym(suite)
+	nymR := randomNym(suite)
+	pool := NewPool(1, 2)
+	pool.Post("xxx", nym1)
+
+	if len(pool.Take(1, nym1)) != 0 {
+		t.Error("Provider should not get its own bridge")
+	}
+	for i := 0; i < 2; i++ {
+		if len(pool.Take(1, randomNym(suite))) != 1 {
+			t.Error("Bridge should have been handed out")
+		}
+		pool.Complete("xxx")
+	}
+	if len(pool.Take(1, nymR)) != 0 {
+		t.Error("Bridge should have reached its cap")
+	}
+}
+
+func TestPoolUncompletedHandout(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	nym1 := randomNym(suite)
+	nym2 := randomNym(suite)
+	nymR := randomNym(suite)
+	pool := NewPool(2, 1)
+	pool.Post("xxx", nym1)
+
+	if len(pool.Take(1, nymR)) != 1 {
+		t.Error("Bridge should have been handed out")
+	}
+	if len(pool.Take(1, randomNym(suite))) != 0 {
+		t.Error("Pending assignment should hold the only slot")
+	}
+
+	// the assignment was never completed, so the slot is free again
+	pool.NextRound()
+	pool.Rebind("xxx", nym1, nym2)
+	if len(pool.Take(1, nymR)) != 1 {
+		t.Error("Uncompleted assignment should not count against the cap")
+	}
+}
+
+func TestPoolSameRequester(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	nym1 := randomNym(suite)
+	nymR := randomNym(suite)
+	pool := NewPool(1, 0)
+	pool.Post("xxx", nym1)
+
+	if len(pool.Take(1, nymR)) != 1 {
+		t.Error("Bridge should have been handed out")
+	}
+	if len(pool.Take(1, nymR)) != 0 {
+		t.Error("Bridge should not be handed to the same requester twice in a round")
+	}
+}
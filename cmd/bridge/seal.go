@@ -0,0 +1,164 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/random"
+
+	"zRep/util"
+	"zRep/util/canonical"
+)
+
+// length of the random salt hidden in an address commitment
+const AddrSaltLen int = 16
+
+// CommitAddr hides a bridge address behind a hash of salt and addr, so that servers
+// can sign an assignment without learning its address
+func CommitAddr(suite abstract.Suite, addr string) (comm []byte, salt []byte) {
+	salt = random.Bytes(AddrSaltLen, random.Stream)
+	comm = hashAddr(suite, addr, salt)
+	return
+}
+
+// VerifyAddr checks that comm opens to addr under salt
+func VerifyAddr(suite abstract.Suite, comm []byte, addr string, salt []byte) bool {
+	return bytes.Equal(comm, hashAddr(suite, addr, salt))
+}
+
+func hashAddr(suite abstract.Suite, addr string, salt []byte) []byte {
+	return canonical.New("addr-commitment").Bytes(salt).String(addr).Sum(suite.Hash())
+}
+
+// SealAddr encrypts salt || addr to the requester's nym, where nymR = g^x.
+func SealAddr(suite abstract.Suite, g abstract.Point, nymR abstract.Point, addr string, salt []byte) []byte {
+	return Seal(suite, g, nymR, append(append([]byte{}, salt...), []byte(addr)...))
+}
+
+// OpenAddr decrypts a sealed address using the requester's private key
+func OpenAddr(suite abstract.Suite, privateKey abstract.Secret, byteSealed []byte) (addr string, salt []byte, err error) {
+	data, err := Open(suite, privateKey, byteSealed)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(data) < AddrSaltLen {
+		return "", nil, errors.New("sealed address is too short")
+	}
+	return string(data[AddrSaltLen:]), data[:AddrSaltLen], nil
+}
+
+// Seal encrypts data to a nym = g^x.
+// The payload is embedded into as many points as needed, each of which is
+// ElGamal-encrypted with a fresh ephemeral key, so data of the same length
+// is sealed into the same number of points.
+func Seal(suite abstract.Suite, g abstract.Point, nym abstract.Point, data []byte) []byte {
+	sealed := []abstract.Point{}
+	for {
+		M, remainder := suite.Point().Pick(data, random.Stream)
+		K, C, _ := util.ElGamalEncrypt(suite, nym, M, g)
+		sealed = append(sealed, K, C)
+		if len(remainder) == 0 {
+			break
+		}
+		data = remainder
+	}
+	return util.ProtobufEncodePointList(sealed)
+}
+
+// Open decrypts sealed data using the nym's private key
+func Open(suite abstract.Suite, privateKey abstract.Secret, byteSealed []byte) ([]byte, error) {
+	sealed := util.ProtobufDecodePointList(byteSealed)
+	if len(sealed) == 0 || len(sealed) % 2 != 0 {
+		return nil, errors.New("malformed sealed data")
+	}
+	data := []byte{}
+	for i := 0; i < len(sealed); i += 2 {
+		M := util.ElGamalDecrypt(suite, privateKey, sealed[i], sealed[i+1])
+		chunk, err := M.Data()
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
+// Update is what a client learns of its own record at round end: the diff
+// applied to each dimension with its opening rDiff, and the feedback on its
+// bridges in each category. Only the owner of the nym can open it.
+type Update struct {
+	Diffs []int
+	RDiffs []abstract.Secret
+	Breakdown []int
+}
+
+// SealUpdate encrypts an update to its nym. Every update of a round has the
+// same number of dimensions and categories, so every sealed update has the
+// same size and tells nothing of its content.
+func SealUpdate(suite abstract.Suite, g abstract.Point, nym abstract.Point, update *Update) []byte {
+	var buf bytes.Buffer
+	writeInts(&buf, update.Diffs)
+	writeInts(&buf, update.Breakdown)
+	for _,rDiff := range update.RDiffs {
+		data, err := rDiff.MarshalBinary()
+		util.CheckErr(err)
+		buf.Write(data)
+	}
+	return Seal(suite, g, nym, buf.Bytes())
+}
+
+// OpenUpdate decrypts a sealed update using the nym's private key
+func OpenUpdate(suite abstract.Suite, privateKey abstract.Secret, byteSealed []byte) (*Update, error) {
+	data, err := Open(suite, privateKey, byteSealed)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewReader(data)
+	update := &Update{}
+	if update.Diffs, err = readInts(buf); err != nil {
+		return nil, err
+	}
+	if update.Breakdown, err = readInts(buf); err != nil {
+		return nil, err
+	}
+	for range update.Diffs {
+		rDiff := suite.Secret()
+		if _, err := rDiff.UnmarshalFrom(buf); err != nil {
+			return nil, err
+		}
+		update.RDiffs = append(update.RDiffs, rDiff)
+	}
+	if buf.Len() != 0 {
+		return nil, errors.New("sealed update is too long")
+	}
+	return update, nil
+}
+
+// a count then each int, 8 bytes each
+func writeInts(buf *bytes.Buffer, list []int) {
+	binary.Write(buf, binary.BigEndian, int64(len(list)))
+	for _,n := range list {
+		binary.Write(buf, binary.BigEndian, int64(n))
+	}
+}
+
+func readInts(buf *bytes.Reader) ([]int, error) {
+	var n int64
+	if err := binary.Read(buf, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	if n < 0 || n > int64(buf.Len()) / 8 {
+		return nil, errors.New("malformed sealed update")
+	}
+	list := make([]int, n)
+	for i := range list {
+		var v int64
+		if err := binary.Read(buf, binary.BigEndian, &v); err != nil {
+			return nil, err
+		}
+		list[i] = int(v)
+	}
+	return list, nil
+}
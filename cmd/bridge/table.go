@@ -0,0 +1,74 @@
+package bridge
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/dedis/crypto/abstract"
+	"zRep/util"
+	"zRep/util/canonical"
+	"zRep/util/merkle"
+)
+
+// The table an announcement ends with is committed to by a Merkle tree whose
+// leaves are the records, a key followed by its commitments, in the order of
+// the table. The coordinator signs the root with the size of the table, the
+// epoch, g, GT and HT (table_signature), so that a client fetching only its
+// own record with its path knows it belongs to the table of the round.
+
+var ErrTableRoot = errors.New("table does not match the signed root")
+var ErrTableEntry = errors.New("record is not in the table of the signed root")
+
+func TableLeaf(key abstract.Point, record []abstract.Point) []byte {
+	return canonical.New("table-leaf").Point(key).Points(record).Encoded()
+}
+
+func TableTree(keys, vals []abstract.Point) *merkle.Tree {
+	records := SplitRecords(vals, len(keys))
+	leaves := make([][]byte, len(keys))
+	for i,key := range keys {
+		leaves[i] = TableLeaf(key, records[i])
+	}
+	return merkle.New(leaves)
+}
+
+// what the coordinator signs for the table of a round
+func MessageOfTableRoot(params map[string]interface{}) []byte {
+	e := canonical.New("table-root")
+	e.Int(params["epoch"].(int))
+	e.Bytes(params["g"].([]byte)).Bytes(params["GT"].([]byte)).Bytes(params["HT"].([]byte))
+	e.Bytes(params["table_root"].([]byte)).Int(params["table_size"].(int))
+	return e.Encoded()
+}
+
+// check the table root, size and their signature in params, and, if params
+// carries the whole table, that the root commits to it
+func CheckTableRoot(suite abstract.Suite, params map[string]interface{}, coordinatorKey abstract.Point) error {
+	err := util.ElGamalVerify(suite, MessageOfTableRoot(params), coordinatorKey, params["table_signature"].([]byte), nil)
+	if err != nil {
+		return err
+	}
+	if _, ok := params["keys"]; !ok {
+		return nil
+	}
+	keyList := util.ProtobufDecodePointList(params["keys"].([]byte))
+	valList := util.ProtobufDecodePointList(params["vals"].([]byte))
+	tree := TableTree(keyList, valList)
+	if tree.Size() != params["table_size"].(int) || !bytes.Equal(tree.Root(), params["table_root"].([]byte)) {
+		return ErrTableRoot
+	}
+	return nil
+}
+
+// check that the record in entry, with its index and path, is in the table
+// whose root is in params
+func VerifyTableEntry(suite abstract.Suite, params, entry map[string]interface{}) error {
+	key := util.DecodePoint(suite, entry["key"].([]byte))
+	record := util.ProtobufDecodePointList(entry["record"].([]byte))
+	proof := util.Decode2DByteArray(entry["path"].([]byte))
+	if !merkle.Verify(params["table_root"].([]byte), params["table_size"].(int), entry["index"].(int),
+		TableLeaf(key, record), proof) {
+		return ErrTableEntry
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package bridge_test
+
+import (
+	"testing"
+
+	"github.com/dedis/crypto/nist"
+	"github.com/dedis/crypto/random"
+	"zRep/cmd/bridge"
+	"zRep/cmd/bridge/bridgetest"
+	"zRep/util"
+)
+
+func TestTableRoot(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	coordinatorKey := suite.Secret().Pick(random.Stream)
+	coordinator := suite.Point().Mul(nil, coordinatorKey)
+	keys := bridgetest.RandomPoints(suite, 3)
+	vals := bridgetest.RandomPoints(suite, 6)
+	tree := bridge.TableTree(keys, vals)
+	params := map[string]interface{}{
+		"epoch": 1,
+		"g": util.EncodePoint(bridgetest.RandomPoints(suite, 1)[0]),
+		"GT": util.EncodePoint(bridgetest.RandomPoints(suite, 1)[0]),
+		"HT": util.EncodePoint(bridgetest.RandomPoints(suite, 1)[0]),
+		"table_root": tree.Root(),
+		"table_size": tree.Size(),
+	}
+	params["table_signature"] = util.ElGamalSign(suite, random.Stream, bridge.MessageOfTableRoot(params), coordinatorKey, nil)
+	if err := bridge.CheckTableRoot(suite, params, coordinator); err != nil {
+		t.Error("Fails to verify the signed root:", err)
+	}
+
+	// the whole table must be the one of the root
+	params["keys"] = util.ProtobufEncodePointList(keys)
+	params["vals"] = util.ProtobufEncodePointList(vals)
+	if err := bridge.CheckTableRoot(suite, params, coordinator); err != nil {
+		t.Error("Fails to verify the table against its root:", err)
+	}
+	vals[5], vals[4] = vals[4], vals[5]
+	params["vals"] = util.ProtobufEncodePointList(vals)
+	if bridge.CheckTableRoot(suite, params, coordinator) != bridge.ErrTableRoot {
+		t.Error("A table with swapped commitments matches the root")
+	}
+	vals[5], vals[4] = vals[4], vals[5]
+	params["table_size"] = 4
+	if bridge.CheckTableRoot(suite, params, coordinator) == nil {
+		t.Error("A root signed with another size passes")
+	}
+	params["table_size"] = 3
+
+	// each record with its path
+	records := bridge.SplitRecords(vals, 3)
+	for i := range keys {
+		entry := map[string]interface{}{
+			"index": i,
+			"key": util.EncodePoint(keys[i]),
+			"record": util.ProtobufEncodePointList(records[i]),
+			"path": util.Encode2DByteArray(tree.Prove(i)),
+		}
+		if err := bridge.VerifyTableEntry(suite, params, entry); err != nil {
+			t.Error("Fails to verify record", i, err)
+		}
+		entry["record"] = util.ProtobufEncodePointList(records[(i+1)%3])
+		if bridge.VerifyTableEntry(suite, params, entry) != bridge.ErrTableEntry {
+			t.Error("The commitments of another record pass for record", i)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package bridge
+
+import (
+	"github.com/dedis/crypto/abstract"
+	"zRep/util/canonical"
+)
+
+// Tally adds up the votes of a round into reputation diffs. The coordinator
+// and every server keep one, so that servers can cross-check the diffs the
+// coordinator applies at round end.
+type Tally struct {
+	Policy *Policy
+	// map a nym to its diff in each reputation dimension
+	Diffs map[string][]int
+	// map a provider's nym to the number of votes in each feedback category
+	Counts map[string][]int
+	// map an assignment's key to the category voted for it
+	Voted map[string]Category
+}
+
+func NewTally(policy *Policy) *Tally {
+	return &Tally{
+		Policy: policy,
+		Diffs: make(map[string][]int),
+		Counts: make(map[string][]int),
+		Voted: make(map[string]Category),
+	}
+}
+
+// record a vote for an assignment, which counts multiplier times,
+// return false if it has been voted
+func (t *Tally) Record(assignment *Assignment, category Category, multiplier int) bool {
+	key := AssignmentKey(assignment)
+	if _, ok := t.Voted[key]; ok {
+		return false
+	}
+	t.Voted[key] = category
+
+	nymStr := assignment.Nym.String()
+	if _, ok := t.Counts[nymStr]; !ok {
+		t.Counts[nymStr] = make([]int, NumCategories)
+	}
+	t.Counts[nymStr][category]++
+	t.AddDiff(assignment.Nym, PROVIDER, t.Policy.Weights[category] * multiplier)
+	return true
+}
+
+// give the requester of a voted assignment credit for reporting. It is
+// off by default, since Sybil voters could build weight just by voting.
+func (t *Tally) CreditReport(assignment *Assignment) {
+	if t.Policy.ReportCredit == 0 {
+		return
+	}
+	t.AddDiff(assignment.NymR, REPORTER, t.Policy.ReportCredit)
+}
+
+// add diff to the named dimension of a nym's reputation, ignore unknown dimensions
+func (t *Tally) AddDiff(nym abstract.Point, name string, diff int) {
+	dim := t.Policy.DimensionIndex(name)
+	if dim < 0 {
+		return
+	}
+	nymStr := nym.String()
+	if _, ok := t.Diffs[nymStr]; !ok {
+		t.Diffs[nymStr] = make([]int, t.Policy.NumDimensions())
+	}
+	t.Diffs[nymStr][dim] += diff
+}
+
+// get the tallied diff of a nym in each dimension
+func (t *Tally) Diff(nym abstract.Point) []int {
+	if diffs, ok := t.Diffs[nym.String()]; ok {
+		return diffs
+	}
+	return make([]int, t.Policy.NumDimensions())
+}
+
+// get the per-category breakdown of a provider's feedback
+func (t *Tally) Breakdown(nym abstract.Point) []int {
+	if counts, ok := t.Counts[nym.String()]; ok {
+		return counts
+	}
+	return make([]int, NumCategories)
+}
+
+// the diffs applied at round end to each key, after the policy.
+// Keys registered in this round, listed in fresh, get no diff.
+func (t *Tally) Table(keys []abstract.Point, fresh map[string]bool) [][]int {
+	table := make([][]int, len(keys))
+	for i,key := range keys {
+		table[i] = make([]int, t.Policy.NumDimensions())
+		if fresh[key.String()] {
+			continue
+		}
+		for dim,diff := range t.Diff(key) {
+			table[i][dim] = t.Policy.AdjustDiff(diff)
+		}
+	}
+	return table
+}
+
+// what every server signs to agree on the diffs of a round
+func MessageOfDiffTable(epoch int, keys []abstract.Point, table [][]int) []byte {
+	e := canonical.New("diff-table")
+	e.Int(epoch)
+	e.Points(keys)
+	e.Int(len(table))
+	for _,diffs := range table {
+		e.Int(len(diffs))
+		for _,diff := range diffs {
+			e.Int(diff)
+		}
+	}
+	return e.Encoded()
+}
+
+// the sum of each column of rows, width long, for the aggregates published
+// at round end in place of the diffs of each nym
+func ColumnTotals(rows [][]int, width int) []int {
+	totals := make([]int, width)
+	for _,row := range rows {
+		for i,n := range row {
+			totals[i] += n
+		}
+	}
+	return totals
+}
@@ -0,0 +1,68 @@
+package bridge
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/nist"
+	"github.com/dedis/crypto/random"
+)
+
+func TestTally(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	provider := suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
+	voter := suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
+	fresh := suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
+	policy := DefaultPolicy
+	policy.MaxLoss = 2
+	policy.ReportCredit = 1
+	tally := NewTally(&policy)
+
+	a1 := &Assignment{NymR:voter, Nym:provider, AddrComm:[]byte("a1")}
+	a2 := &Assignment{NymR:voter, Nym:provider, AddrComm:[]byte("a2")}
+	if !tally.Record(a1, MALICIOUS, 1) || !tally.Record(a2, WORKS, 2) {
+		t.Error("Fails to record votes")
+	}
+	if diff := tally.Diff(voter)[policy.DimensionIndex(REPORTER)]; diff != 0 {
+		t.Error("Recording a vote should not credit the voter", diff)
+	}
+	tally.CreditReport(a1)
+	tally.CreditReport(a2)
+	if tally.Record(a1, WORKS, 1) {
+		t.Error("An assignment is voted twice")
+	}
+	provDim := policy.DimensionIndex(PROVIDER)
+	repDim := policy.DimensionIndex(REPORTER)
+	if diff := tally.Diff(provider)[provDim]; diff != -3 + 2 {
+		t.Error("Wrong provider diff", diff)
+	}
+	if diff := tally.Diff(voter)[repDim]; diff != 2 {
+		t.Error("Wrong reporter diff", diff)
+	}
+	if counts := tally.Breakdown(provider); counts[MALICIOUS] != 1 || counts[WORKS] != 1 {
+		t.Error("Wrong breakdown", counts)
+	}
+
+	// the policy caps the loss, and clients registered in this round get nothing
+	tally.AddDiff(fresh, PROVIDER, 5)
+	keys := []abstract.Point{provider, voter, fresh}
+	table := tally.Table(keys, map[string]bool{fresh.String(): true})
+	if table[0][provDim] != -1 || table[1][repDim] != 2 || table[2][provDim] != 0 {
+		t.Error("Wrong diff table", table)
+	}
+
+	// the same tally gives the same signed table, another one does not
+	msg := MessageOfDiffTable(1, keys, table)
+	if !bytes.Equal(msg, MessageOfDiffTable(1, keys, tally.Table(keys, map[string]bool{fresh.String(): true}))) {
+		t.Error("The diff table is not deterministic")
+	}
+	table[1][repDim]++
+	if bytes.Equal(msg, MessageOfDiffTable(1, keys, table)) {
+		t.Error("A changed diff gives the same signed table")
+	}
+	table[1][repDim]--
+	if bytes.Equal(msg, MessageOfDiffTable(2, keys, table)) {
+		t.Error("The round is not covered by the signed table")
+	}
+}
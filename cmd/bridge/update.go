@@ -0,0 +1,118 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+
+	"github.com/dedis/crypto/abstract"
+	"zRep/util"
+	"zRep/primitive/dleq"
+	"zRep/primitive/pedersen"
+)
+
+// At round end the coordinator publishes how it updated the commitments:
+// the keys, the records before and after, and the diff and its opening rDiff
+// of every commitment, flattened in the same order, along with the signed
+// votes the diffs were tallied from and every server's signature of the diff
+// table. Servers forward these parameters
+// unchanged along the chain, and each of them checks the update.
+var UpdateParams = []string{"update_keys", "update_old", "update_new", "update_diffs", "update_rdiffs", "votes", "tally_signatures"}
+
+var ErrUpdateLength = errors.New("update has commitments, diffs and openings of different lengths")
+var ErrUpdateMismatch = errors.New("new commitment is not the old one times Commit(diff, rDiff)")
+
+// VerifyUpdate checks newVals[i] = oldVals[i] * Commit(diffs[i], rDiffs[i])
+func VerifyUpdate(base *pedersen.PedersenBase, oldVals, newVals []abstract.Point, diffs []int, rDiffs []abstract.Secret) error {
+	if len(oldVals) != len(newVals) || len(oldVals) != len(diffs) || len(oldVals) != len(rDiffs) {
+		return ErrUpdateLength
+	}
+	for i := range oldVals {
+		diff := base.Suite.Secret().SetInt64(int64(diffs[i]))
+		expected := base.Add(oldVals[i], base.CommitWithR(diff, rDiffs[i]))
+		if !expected.Equal(newVals[i]) {
+			return ErrUpdateMismatch
+		}
+	}
+	return nil
+}
+
+var ErrInitialCredit = errors.New("a new record does not open to the initial credit")
+
+// what is left of a commitment to credit once GT^credit is taken off, HT^r
+func withoutCredit(base *pedersen.PedersenBase, comm abstract.Point, credit int) abstract.Point {
+	return base.Sub(comm, base.Suite.Point().Mul(base.GT, base.Suite.Secret().SetInt64(int64(credit))))
+}
+
+// ProveInitialCredit proves that every commitment of a new record opens to
+// credit, one proof of knowledge of r per dimension. r itself is not given
+// away: with the diffs and rDiffs of the published updates it would let the
+// servers find the record in the tables of later rounds
+func ProveInitialCredit(base *pedersen.PedersenBase, record []abstract.Point, r []abstract.Secret, credit int) [][]byte {
+	proofs := make([][]byte, len(record))
+	for dim := range record {
+		proofs[dim] = dleq.Prove(base.Suite, r[dim], []abstract.Point{base.HT}, []abstract.Point{withoutCredit(base, record[dim], credit)})
+	}
+	return proofs
+}
+
+// VerifyInitialCredit checks the proofs of ProveInitialCredit
+func VerifyInitialCredit(base *pedersen.PedersenBase, record []abstract.Point, proofs [][]byte, credit int) error {
+	if len(proofs) != len(record) {
+		return ErrInitialCredit
+	}
+	for dim := range record {
+		if dleq.Verify(base.Suite, []abstract.Point{base.HT}, []abstract.Point{withoutCredit(base, record[dim], credit)}, proofs[dim]) != nil {
+			return ErrInitialCredit
+		}
+	}
+	return nil
+}
+
+var ErrOpeningLength = errors.New("record and opening have different numbers of dimensions")
+
+// CheckOpening gives the dimensions in which record does not open to
+// reputation under r, so that a client can tell whether the commitment
+// published for its nym still matches its own books
+func CheckOpening(base *pedersen.PedersenBase, record []abstract.Point, reputation []int, r []abstract.Secret) ([]int, error) {
+	if len(record) != len(reputation) || len(record) != len(r) {
+		return nil, ErrOpeningLength
+	}
+	bad := []int{}
+	for dim := range record {
+		if !base.Verify(base.Suite.Secret().SetInt64(int64(reputation[dim])), r[dim], record[dim]) {
+			bad = append(bad, dim)
+		}
+	}
+	return bad, nil
+}
+
+// copy the published update from one round-end package to the next
+func CopyUpdate(from, to map[string]interface{}) {
+	for _,name := range UpdateParams {
+		to[name] = from[name]
+	}
+}
+
+// encode the parameters of the votes accepted in a round
+func EncodeVotes(votes []map[string]interface{}) []byte {
+	return encodeParamsList(votes)
+}
+
+func DecodeVotes(data []byte) []map[string]interface{} {
+	return decodeParamsList(data)
+}
+
+func encodeParamsList(list []map[string]interface{}) []byte {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(list)
+	util.CheckErr(err)
+	return buf.Bytes()
+}
+
+func decodeParamsList(data []byte) []map[string]interface{} {
+	var list []map[string]interface{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&list)
+	util.CheckErr(err)
+	return list
+}
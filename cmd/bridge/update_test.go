@@ -0,0 +1,112 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/nist"
+	"github.com/dedis/crypto/random"
+
+	"zRep/primitive/pedersen"
+)
+
+func TestVerifyUpdate(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	base := pedersen.CreateBaseFromSuite(suite)
+	diffs := []int{3, -2, 0}
+	oldVals := make([]abstract.Point, len(diffs))
+	newVals := make([]abstract.Point, len(diffs))
+	rDiffs := make([]abstract.Secret, len(diffs))
+	for i,diff := range diffs {
+		oldVals[i], _ = base.Commit(suite.Secret().SetInt64(5))
+		diffComm, rDiff := base.Commit(suite.Secret().SetInt64(int64(diff)))
+		newVals[i] = base.Add(oldVals[i], diffComm)
+		rDiffs[i] = rDiff
+	}
+	if err := VerifyUpdate(base, oldVals, newVals, diffs, rDiffs); err != nil {
+		t.Error("honest update rejected:", err)
+	}
+
+	// claim a diff other than the one committed
+	if VerifyUpdate(base, oldVals, newVals, []int{3, 2, 0}, rDiffs) != ErrUpdateMismatch {
+		t.Error("update with a changed diff accepted")
+	}
+	// quietly change someone's commitment
+	forged := append([]abstract.Point{}, newVals...)
+	forged[2] = suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
+	if VerifyUpdate(base, oldVals, forged, diffs, rDiffs) != ErrUpdateMismatch {
+		t.Error("update with a changed commitment accepted")
+	}
+	if VerifyUpdate(base, oldVals, newVals, diffs[:2], rDiffs) != ErrUpdateLength {
+		t.Error("update with a missing diff accepted")
+	}
+}
+
+func TestCheckOpening(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	base := pedersen.CreateBaseFromSuite(suite)
+	reputation := []int{4, -1}
+	record := make([]abstract.Point, len(reputation))
+	r := make([]abstract.Secret, len(reputation))
+	for dim,rep := range reputation {
+		record[dim], r[dim] = base.Commit(suite.Secret().SetInt64(int64(rep)))
+	}
+	// the servers raise the commitments and the base to the same E
+	E := suite.Secret().Pick(random.Stream)
+	for dim := range record {
+		record[dim] = suite.Point().Mul(record[dim], E)
+	}
+	base.GT = suite.Point().Mul(base.GT, E)
+	base.HT = suite.Point().Mul(base.HT, E)
+	if bad, err := CheckOpening(base, record, reputation, r); err != nil || len(bad) != 0 {
+		t.Error("honest record does not open:", bad, err)
+	}
+
+	// the coordinator's books differ from ours in the second dimension
+	if bad, _ := CheckOpening(base, record, []int{4, 0}, r); len(bad) != 1 || bad[0] != 1 {
+		t.Error("record opens to another reputation:", bad)
+	}
+	if _, err := CheckOpening(base, record[:1], reputation, r); err != ErrOpeningLength {
+		t.Error("record with a missing dimension checked")
+	}
+}
+
+func TestInitialCredit(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	base := pedersen.CreateBaseFromSuite(suite)
+	record := make([]abstract.Point, 2)
+	r := make([]abstract.Secret, 2)
+	for dim := range record {
+		record[dim], r[dim] = base.Commit(suite.Secret().SetInt64(5))
+	}
+	proofs := ProveInitialCredit(base, record, r, 5)
+	if err := VerifyInitialCredit(base, record, proofs, 5); err != nil {
+		t.Error("A record of the initial credit is refused:", err)
+	}
+	if VerifyInitialCredit(base, record, proofs, 6) != ErrInitialCredit {
+		t.Error("A record passes for another credit")
+	}
+	if VerifyInitialCredit(base, record, proofs[:1], 5) != ErrInitialCredit {
+		t.Error("A record passes with a missing proof")
+	}
+
+	// a commitment to more than the credit, proved with its own r
+	record[1], r[1] = base.Commit(suite.Secret().SetInt64(50))
+	if VerifyInitialCredit(base, record, ProveInitialCredit(base, record, r, 5), 5) != ErrInitialCredit {
+		t.Error("A record of more than the initial credit passes")
+	}
+}
+
+func TestEncodingVotes(t *testing.T) {
+	votes := []map[string]interface{}{
+		{"epoch": 2, "nym": []byte("nym"), "category": -1, "weighted": true},
+	}
+	votes2 := DecodeVotes(EncodeVotes(votes))
+	if len(votes2) != 1 || votes2[0]["epoch"].(int) != 2 || string(votes2[0]["nym"].([]byte)) != "nym" ||
+		votes2[0]["category"].(int) != -1 || !votes2[0]["weighted"].(bool) {
+		t.Error("Decoded votes are different from the origin")
+	}
+	if len(DecodeVotes(EncodeVotes(nil))) != 0 {
+		t.Error("Decoded votes of an empty round are not empty")
+	}
+}
@@ -1,23 +1,35 @@
 package client
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"math/big"
-	// "strconv"
+	"os"
+	"strconv"
 	"zRep/cmd/bridge"
 	"zRep/primitive/fujiokam"
 	"zRep/proto"
 	"zRep/util"
-	// "github.com/dedis/crypto/abstract"
+
+	"github.com/dedis/crypto/abstract"
 )
 
 func Handle(buf []byte, dissentClient *DissentClient) {
 	// decode the whole message
 	event, _ := util.DecodeEvent(buf)
+	// drop anything not signed by our coordinator
+	if err := dissentClient.VerifyCoordinator(event); err != nil {
+		fmt.Println("[note]** Dropped event", event.EventType, "-", err)
+		return
+	}
 	switch event.EventType {
 	case proto.CLIENT_REGISTER_CONFIRMATION:
 		handleRegisterConfirmation(event.Params, dissentClient)
 		break
+	case proto.CLIENT_REGISTER_REFUSED:
+		handleRegisterRefused(event.Params, dissentClient)
+		break
 	case proto.INIT_PEDERSEN_R:
 		handleInitPedersenR(event.Params, dissentClient)
 		break
@@ -27,6 +39,12 @@ func Handle(buf []byte, dissentClient *DissentClient) {
 	case proto.ANNOUNCEMENT_FINALIZE:
 		handleAnnouncementFinalize(event.Params, dissentClient)
 		break
+	case proto.SHUFFLE_PROOFS:
+		handleShuffleProofs(event.Params, dissentClient)
+		break
+	case proto.TABLE:
+		handleTable(event.Params, dissentClient)
+		break
 	case proto.GOT_SIGNS:
 		handleGotSignatures(event.Params, dissentClient)
 		break
@@ -39,12 +57,12 @@ func Handle(buf []byte, dissentClient *DissentClient) {
 	case proto.ROUND_END:
 		handleRoundEnd(event.Params, dissentClient)
 		break
-	case proto.BCAST_PEDERSEN_RDIFF:
-		handleBroadcastPedersenRDiff(event.Params, dissentClient)
-		break
 	case proto.VOTE_REPLY:
 		handleVoteReply(event.Params)
 		break
+	case proto.QUOTA_EXCEEDED:
+		handleQuotaExceeded(event.Params)
+		break
 	// case proto.MSG_REPLY:
 	// 	handleMsgReply(event.Params)
 	// 	break
@@ -57,7 +75,7 @@ func Handle(buf []byte, dissentClient *DissentClient) {
 
 // handle protocols' configurations
 func handleRegisterConfirmation(params map[string]interface{}, dissentClient *DissentClient) {
-	dissentClient.Status = CONNECTED
+	dissentClient.SetStatus(CONNECTED)
 
 	// Fujisaki-Okamoto
 	N := new(big.Int).SetBytes(params["n"].([]byte))
@@ -71,10 +89,7 @@ func handleRegisterConfirmation(params map[string]interface{}, dissentClient *Di
 	base.H1 = base.Point().FromBinary(params["h1"].([]byte))
 	dissentClient.FujiOkamBase = base
 	dissentClient.AllGnHonestyProofPublic = util.ProtobufDecodeBigIntList(params["honesty_prf"].([]byte))
-
-	// Controller's public key
-	err := dissentClient.ControllerPublicKey.UnmarshalBinary(params["public_key"].([]byte))
-	util.CheckErr(err)
+	dissentClient.Policy = bridge.DecodePolicy(params["policy"].([]byte))
 
 	// Pedersen
 	// var HT = dissentClient.Suite.Point()
@@ -93,8 +108,34 @@ func handleRegisterConfirmation(params map[string]interface{}, dissentClient *Di
 	util.SendEvent(dissentClient.LocalAddr, dissentClient.CoordinatorAddr, event)
 }
 
+// retry with a proof of work if that is what we lack, otherwise give up
+func handleRegisterRefused(params map[string]interface{}, dissentClient *DissentClient) {
+	reason := params["reason"].(string)
+	fmt.Println("[client] Registration refused: " + reason)
+	// the round we would have joined failed, join the next one
+	if params["retry"].(bool) {
+		register()
+		return
+	}
+	// retry once for each new difficulty or challenge of the proof of work
+	difficulty := params["difficulty"].(int)
+	challenge := params["challenge"].([]byte)
+	if difficulty > 0 && (difficulty > dissentClient.PowDifficulty || !bytes.Equal(challenge, dissentClient.PowChallenge)) {
+		dissentClient.PowDifficulty = difficulty
+		dissentClient.PowChallenge = challenge
+		register()
+		return
+	}
+	os.Exit(1)
+}
+
 func handleInitPedersenR(params map[string]interface{}, dissentClient *DissentClient) {
-	dissentClient.R = util.DecodeSecret(dissentClient.Suite, params["r"].([]byte))
+	dissentClient.R = util.ProtobufDecodeSecretList(params["r"].([]byte))
+	// every dimension starts with the same credit
+	dissentClient.Reputation = make([]int, len(dissentClient.R))
+	for i := range dissentClient.Reputation {
+		dissentClient.Reputation[i] = params["credit"].(int)
+	}
 	dissentClient.G = util.DecodePoint(dissentClient.Suite, params["g"].([]byte))
 	dissentClient.OnetimePseudoNym = dissentClient.Suite.Point().Mul(dissentClient.G, dissentClient.PrivateKey)
 }
@@ -113,27 +154,61 @@ func handleGnHonestyAnswer(params map[string]interface{}, dissentClient *Dissent
 
 // handle vote start event
 func handleVotePhaseStart(dissentClient *DissentClient) {
-	if dissentClient.Status != MESSAGE {
+	if dissentClient.GetStatus() != MESSAGE {
 		return
 	}
+	// this also stops probing bridges
+	dissentClient.SetStatus(VOTE)
 	fmt.Println()
 	// print out info in client side
 	for i,info := range dissentClient.Assignments {
-		fmt.Printf("[%d] %s\n", i, info.Assignment.Addr)
+		fmt.Printf("[%d] %s\n", i, info.Addr)
+	}
+	fmt.Println("[client] Voting Phase begins.(cmd: vote <bridge_id> <works|slow|blocked|never_reachable|malicious>)")
+	if dissentClient.AutoFeedback {
+		sendAutoVotes()
 	}
-	fmt.Println("[client] Voting Phase begins.(cmd: vote <bridge_id> (+-)1)")
 	fmt.Print("cmd >> ")
 }
 
 // reset the status and prepare for the new round
 func handleRoundEnd(params map[string]interface{}, dissentClient *DissentClient) {
-	dissentClient.Status = CONNECTED
+	dissentClient.SetStatus(CONNECTED)
+	dissentClient.RecordEvent(proto.ROUND_END, params)
 
+	// only my own update is sealed to me, the rest of the round is in totals
 	keyList := util.ProtobufDecodePointList(params["keys"].([]byte))
-	diffList:= util.DecodeIntArray(params["diffs"].([]byte))
-	myDiff := util.FindIntUsingKeyList(keyList, diffList, dissentClient.OnetimePseudoNym)
-	dissentClient.Reputation += myDiff
-	fmt.Println("my new reputation:", dissentClient.Reputation)
+	sealed := util.Decode2DByteArray(params["sealed"].([]byte))
+	index := util.FindIndexWithinKeyList(keyList, dissentClient.OnetimePseudoNym)
+	if index >= 0 && len(sealed) != len(keyList) {
+		// there is no update we can tell is ours
+		dissentClient.AlertSealedUpdate(params, index, nil, errors.New("the round end has " +
+			strconv.Itoa(len(sealed)) + " sealed updates for " + strconv.Itoa(len(keyList)) + " keys"))
+	} else if index >= 0 {
+		update, err := bridge.OpenUpdate(dissentClient.Suite, dissentClient.PrivateKey, sealed[index])
+		if err == nil && (len(update.Diffs) != len(dissentClient.R) || len(update.Breakdown) != bridge.NumCategories) {
+			err = errors.New("the update has " + strconv.Itoa(len(update.Diffs)) + " diffs and " +
+				strconv.Itoa(len(update.Breakdown)) + " feedback categories")
+		}
+		if err != nil {
+			// keep the reputation we had, the alert tells how to dispute it
+			dissentClient.AlertSealedUpdate(params, index, sealed[index], err)
+		} else {
+			for dim,diff := range update.Diffs {
+				dissentClient.Reputation[dim] += diff
+				dissentClient.R[dim].Add(dissentClient.R[dim], update.RDiffs[dim])
+			}
+			history := dissentClient.CurrentHistory()
+			history.Diffs = update.Diffs
+			history.Breakdown = update.Breakdown
+			// print feedback on my bridges in each category
+			fmt.Println("feedback on my bridges:", bridge.FormatBreakdown(update.Breakdown))
+		}
+	}
+	fmt.Println("my new reputation:", bridge.FormatReputation(dissentClient.Policy, dissentClient.Reputation))
+	fmt.Println("[note]** Records updated this round:", params["updated"].(int),
+		"total diffs:", util.DecodeIntArray(params["total_diffs"].([]byte)),
+		"total feedback:", bridge.FormatBreakdown(util.DecodeIntArray(params["total_breakdown"].([]byte))))
 
 	dissentClient.ClearBuffer()
 
@@ -141,18 +216,6 @@ func handleRoundEnd(params map[string]interface{}, dissentClient *DissentClient)
 	fmt.Println("[client] Round ended. Waiting for new round start...");
 }
 
-func handleBroadcastPedersenRDiff(params map[string]interface{}, dissentClient *DissentClient) {
-	keyList := util.ProtobufDecodePointList(params["keys"].([]byte))
-	rDiffs := util.ProtobufDecodeSecretList(params["rDiffs"].([]byte))
-	index := util.FindIndexWithinKeyList(keyList, dissentClient.OnetimePseudoNym)
-	if index < 0 {
-		// client has not participated in this round
-		return
-	}
-	rDiff := rDiffs[index]
-	dissentClient.R.Add(dissentClient.R, rDiff)
-}
-
 // handle vote reply
 func handleVoteReply(params map[string]interface{}) {
 	status := params["reply"].(bool)
@@ -164,6 +227,12 @@ func handleVoteReply(params map[string]interface{}) {
 	}
 }
 
+// the coordinator dropped an action since its quota in this round is used up
+func handleQuotaExceeded(params map[string]interface{}) {
+	fmt.Println("[client] Quota exceeded: no more " + params["action"].(string) + " in this round")
+	fmt.Print("cmd >> ")
+}
+
 // handle vote reply
 // func handleMsgReply(params map[string]interface{}) {
 // 	status := params["reply"].(bool)
@@ -175,8 +244,131 @@ func handleVoteReply(params map[string]interface{}) {
 // 	}
 // }
 
-// set one-time pseudonym and g, and print out info
+// check the signed root of the new table, then the shuffle proofs if we
+// check them, and fetch our record of the table
 func handleAnnouncementFinalize(params map[string]interface{}, dissentClient *DissentClient) {
+	if err := bridge.CheckTableRoot(dissentClient.Suite, params, dissentClient.ControllerPublicKey); err != nil {
+		fmt.Println("[note]** Table root of this round is not signed by the coordinator:", err)
+		return
+	}
+	dissentClient.PendingAnnouncement = params
+	if dissentClient.VerifyShuffles {
+		// ask for the shuffle proofs first
+		event := &proto.Event{EventType:proto.SHUFFLE_PROOFS_REQUEST, Params:map[string]interface{}{}}
+		util.SendEvent(dissentClient.LocalAddr, dissentClient.CoordinatorAddr, event)
+		fmt.Println("[debug] Checking the shuffle proofs of this round...")
+		return
+	}
+	requestTable(dissentClient)
+}
+
+// ask for our record of the table with its path, or for the whole table
+// if we would rather not tell the coordinator which record is ours
+func requestTable(dissentClient *DissentClient) {
+	pm := map[string]interface{}{}
+	if !dissentClient.FullTable {
+		g := util.DecodePoint(dissentClient.Suite, dissentClient.PendingAnnouncement["g"].([]byte))
+		pm["nym"] = util.EncodePoint(dissentClient.Suite.Point().Mul(g, dissentClient.PrivateKey))
+	}
+	event := &proto.Event{EventType:proto.TABLE_REQUEST, Params:pm}
+	util.SendEvent(dissentClient.LocalAddr, dissentClient.CoordinatorAddr, event)
+}
+
+// the announcement with the whole table of params
+func withTable(announcement, params map[string]interface{}) map[string]interface{} {
+	table := make(map[string]interface{})
+	for name,val := range announcement {
+		table[name] = val
+	}
+	table["keys"] = params["keys"]
+	table["vals"] = params["vals"]
+	return table
+}
+
+// check every hop of the announcement waiting for its shuffle proofs, and accept it if they all pass
+func handleShuffleProofs(params map[string]interface{}, dissentClient *DissentClient) {
+	announcement := dissentClient.PendingAnnouncement
+	if announcement == nil {
+		return
+	}
+	dissentClient.PendingAnnouncement = nil
+	hops := bridge.DecodeHops(params["hops"].([]byte))
+	if len(hops) == 0 {
+		fmt.Println("[note]** Shuffle proofs of this round failed, the announcement is not accepted:", bridge.ErrHopChain)
+		return
+	}
+	// the last hop carries the whole table, which must be the one of the signed root
+	table := withTable(announcement, hops[len(hops)-1])
+	// the coordinator signed the keys of the servers which made the hops
+	servers := []abstract.Point{}
+	if data, ok := params["servers"].([]byte); ok {
+		for _,byteKey := range util.Decode2DByteArray(data) {
+			servers = append(servers, util.DecodePoint(dissentClient.Suite, byteKey))
+		}
+	}
+	err := bridge.VerifyHops(dissentClient.Suite, hops, nil, table, servers, true)
+	if err == nil {
+		err = bridge.CheckTableRoot(dissentClient.Suite, table, dissentClient.ControllerPublicKey)
+	}
+	if err != nil {
+		fmt.Println("[note]** Shuffle proofs of this round failed, the announcement is not accepted:", err)
+		return
+	}
+	fmt.Println("[debug] Shuffle proofs of", len(hops), "hops passed")
+	acceptTable(announcement, table, dissentClient)
+}
+
+// receive our record of the table with its path, or the whole table
+func handleTable(params map[string]interface{}, dissentClient *DissentClient) {
+	announcement := dissentClient.PendingAnnouncement
+	if announcement == nil {
+		return
+	}
+	dissentClient.PendingAnnouncement = nil
+	if _, ok := params["keys"]; ok {
+		table := withTable(announcement, params)
+		if err := bridge.CheckTableRoot(dissentClient.Suite, table, dissentClient.ControllerPublicKey); err != nil {
+			fmt.Println("[note]** Table of this round does not match its signed root, the announcement is not accepted:", err)
+			return
+		}
+		acceptTable(announcement, table, dissentClient)
+		return
+	}
+
+	g := util.DecodePoint(dissentClient.Suite, announcement["g"].([]byte))
+	nym := dissentClient.Suite.Point().Mul(g, dissentClient.PrivateKey)
+	key := util.DecodePoint(dissentClient.Suite, params["key"].([]byte))
+	if !key.Equal(nym) {
+		fmt.Println("[note]** Coordinator sent the record of another nym, the announcement is not accepted")
+		return
+	}
+	if err := bridge.VerifyTableEntry(dissentClient.Suite, announcement, params); err != nil {
+		fmt.Println("[note]** My record is not in the table of this round, the announcement is not accepted:", err)
+		return
+	}
+	record := util.ProtobufDecodePointList(params["record"].([]byte))
+	acceptAnnouncement(announcement, params["index"].(int), record, nil, dissentClient)
+}
+
+// find our record in the whole table of the new round
+func acceptTable(announcement, table map[string]interface{}, dissentClient *DissentClient) {
+	g := util.DecodePoint(dissentClient.Suite, announcement["g"].([]byte))
+	nym := dissentClient.Suite.Point().Mul(g, dissentClient.PrivateKey)
+	keyList := util.ProtobufDecodePointList(table["keys"].([]byte))
+	valList := util.ProtobufDecodePointList(table["vals"].([]byte))
+	index := util.FindIndexWithinKeyList(keyList, nym)
+	if index < 0 {
+		panic("Can not find my nym from keyList")
+	}
+	records := bridge.SplitRecords(valList, len(keyList))
+	acceptAnnouncement(announcement, index, records[index], keyList, dissentClient)
+	dissentClient.AllClientsRecords = records
+}
+
+// set One-time pseudonym, g and our record of the new round. keyList is
+// nil if we only fetched our own record.
+func acceptAnnouncement(params map[string]interface{}, index int, record []abstract.Point, keyList []abstract.Point, dissentClient *DissentClient) {
+	dissentClient.RecordEvent(proto.ANNOUNCEMENT_FINALIZE, params)
 	// set One-time pseudonym and g
 	g := dissentClient.Suite.Point()
 	// deserialize g and calculate nym
@@ -184,32 +376,36 @@ func handleAnnouncementFinalize(params map[string]interface{}, dissentClient *Di
 	nym := dissentClient.Suite.Point().Mul(g, dissentClient.PrivateKey)
 
 	// update PComm
-	keyList := util.ProtobufDecodePointList(params["keys"].([]byte))
-	valList := util.ProtobufDecodePointList(params["vals"].([]byte))
-	index := util.FindIndexWithinKeyList(keyList, nym)
-	if index < 0 {
-		panic("Can not find my nym from keyList")
-	}
 	dissentClient.Index = index
-	dissentClient.PCommr = valList[index]
+	dissentClient.PCommr = record
 
 	// set client's parameters
-	dissentClient.Status = MESSAGE
+	oldNym := dissentClient.OnetimePseudoNym
+	oldG := dissentClient.G
+	dissentClient.SetStatus(MESSAGE)
 	dissentClient.G = g
 	dissentClient.OnetimePseudoNym = nym
 	dissentClient.AllClientsPublicKeys = keyList
+	dissentClient.AllClientsRecords = nil
+	dissentClient.TableRoot = params["table_root"].([]byte)
 
 	// update GT & HT
 	GT := util.DecodePoint(dissentClient.Suite, params["GT"].([]byte))
 	HT := util.DecodePoint(dissentClient.Suite, params["HT"].([]byte))
 	dissentClient.PedersenBase.GT = GT
 	dissentClient.PedersenBase.HT = HT
+	// our record must still open to our own books
+	dissentClient.CheckCommitment(params, index, record)
+
+	// keep posted bridges alive under the new nym, proving reputation
+	// against the new record
+	rebindBridges(oldNym, oldG)
 
 	// print out the msg to suggest user to send msg or vote
 	fmt.Println("[client] One-Time pseudonym for this round is ");
 	fmt.Println(nym);
-	fmt.Println("[client] My reputation is", dissentClient.Reputation)
-	fmt.Println("[client] Messaging Phase begins.(post <addr> | get <indicator>)");
+	fmt.Println("[client] My reputation is", bridge.FormatReputation(dissentClient.Policy, dissentClient.Reputation))
+	fmt.Println("[client] Messaging Phase begins.(post <addr> | get <indicator> [dimension] | token <service> <indicator> [dimension] [nonce] | history)");
 	fmt.Print("cmd >> ");
 }
 
@@ -247,15 +443,34 @@ func handleGotSignatures(params map[string]interface{}, dissentClient *DissentCl
 	// verify signature
 	byteSig := params["signature"].([]byte)
 	msg := bridge.MessageOfGotSignatures(params)
-	err := util.ElGamalVerify(dissentClient.Suite, msg, dissentClient.ControllerPublicKey, byteSig, dissentClient.Suite.Point())
+	err := util.ElGamalVerify(dissentClient.Suite, msg, dissentClient.ControllerPublicKey, byteSig, nil)
 	if err != nil {
 		fmt.Println("[note]** Fails to verify the signatures")
 		return
 	}
 
-	// record assignment and its signatures
+	// open the sealed address and check it against the signed commitment
 	assignment := bridge.DecodeAssignment(params["assignment"].([]byte))
+	if assignment.Epoch != dissentClient.Epoch {
+		fmt.Println("[note]** Assignment was made in another round")
+		return
+	}
+	addr, salt, err := bridge.OpenAddr(dissentClient.Suite, dissentClient.PrivateKey, params["sealed_addr"].([]byte))
+	if err != nil {
+		fmt.Println("[note]** Fails to open the bridge address")
+		return
+	}
+	if !bridge.VerifyAddr(dissentClient.Suite, assignment.AddrComm, addr, salt) {
+		fmt.Println("[note]** Bridge address does not match the commitment")
+		return
+	}
+
+	// record assignment and its signatures
 	byteSignatures := params["signatures"].([]byte)
-	dissentClient.AddAssignment(assignment, byteSignatures)
-	fmt.Println("Got bridge", assignment.Addr)
+	dissentClient.AddAssignment(assignment, byteSignatures, addr)
+	fmt.Println("Got bridge", addr)
+
+	if dissentClient.AutoFeedback {
+		go probeAssignment(bridge.AssignmentKey(assignment), addr)
+	}
 }
\ No newline at end of file
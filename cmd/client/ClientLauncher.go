@@ -2,6 +2,7 @@ package client
 
 import (
 	"bufio"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"os"
@@ -11,19 +12,22 @@ import (
 	"zRep/proto"
 	"zRep/util"
 
+	"github.com/dedis/crypto/abstract"
 	"github.com/dedis/crypto/nist"
 	"github.com/dedis/crypto/random"
 
 	// "log"
 	"bytes"
 	"io"
-	"math/big"
 	"time"
 
 	"zRep/primitive/lrs"
 	"zRep/primitive/pedersen"
-	"zRep/primitive/pedersen_fujiokam"
+	"zRep/cmd/admission"
 	"zRep/cmd/bridge"
+	"zRep/cmd/probe"
+	"zRep/cmd/token"
+	"zRep/cmd/transcript"
 )
 
 // pointer to client itself
@@ -37,6 +41,14 @@ func register() {
 	bytePublicKey, _ := dissentClient.PublicKey.MarshalBinary()
 	params := map[string]interface{}{
 		"public_key": bytePublicKey,
+		"invite": []byte(dissentClient.InviteToken),
+	}
+	// the work is bound to the coordinator's challenge, which we learn
+	// from the first refusal
+	if dissentClient.PowDifficulty > 0 && len(dissentClient.PowChallenge) > 0 {
+		fmt.Println("[debug] Solving proof of work of difficulty", dissentClient.PowDifficulty)
+		params["pow_challenge"] = dissentClient.PowChallenge
+		params["pow_nonce"] = admission.SolveWork(bytePublicKey, dissentClient.PowChallenge, dissentClient.PowDifficulty)
 	}
 	event := &proto.Event{EventType:proto.CLIENT_REGISTER_CONTROLLERSIDE, Params:params}
 
@@ -63,80 +75,119 @@ func startClientListener(listener *net.TCPListener) {
   * post new bridge to server
   */
 func postBridge(bridgeAddr string) {
+	// prove the highest level of the posting quotas
+	dim := dissentClient.Policy.PostDimension()
+	ind, ok := dissentClient.Policy.PostLevel(dissentClient.Reputation[dim])
+	if !ok {
+		fmt.Println("reputation is too low to post bridges")
+		return
+	}
 	// client's nym
 	byteNym, _ := dissentClient.OnetimePseudoNym.MarshalBinary()
 
 	// wrap params
 	params := map[string]interface{}{
+		"epoch": dissentClient.Epoch,
 		"bridge_addr": bridgeAddr,
 		"nym": byteNym,
+		"ind": ind,
+		"dim": dim,
 		"signature": nil, // fill in later
 	}
+	if dissentClient.Policy.NeedProof(ind) {
+		fillIndProof(params, dim, ind)
+	} else {
+		fillEmptyProof(params)
+	}
 
-	// sign bridge address and nym
+	// sign bridge address, nym and the proof
 	byteMsg := bridge.MessageOfPostBridge(params)
-	byteMsg = append([]byte(bridgeAddr), byteNym...)
-	rand := dissentClient.Suite.Cipher([]byte("example"))
+	rand := dissentClient.Suite.Cipher(abstract.RandomKey)
 	sig := util.ElGamalSign(dissentClient.Suite, rand, byteMsg, dissentClient.PrivateKey, dissentClient.G)
 	params["signature"] = sig
 
 	event := &proto.Event{EventType:proto.POST_BRIDGE, Params:params}
 	// send to coordinator
 	util.SendEvent(dissentClient.LocalAddr, dissentClient.CoordinatorAddr, event)
+	dissentClient.AddPostedBridge(bridgeAddr)
 }
 
 /**
-  * request "ind" numbers of bridges from server
+  * move posted bridges from last round's nym to the current nym
   */
-func requestBridges(ind int) {
-	if ind > dissentClient.Reputation {
-		fmt.Println("indicator should be less or equal than reputation")
+func rebindBridges(oldNym abstract.Point, oldG abstract.Point) {
+	if len(dissentClient.PostedBridges) == 0 {
 		return
 	}
-	d := dissentClient.Reputation - ind
-	bigD := new(big.Int).SetInt64(int64(d))
-	xD := dissentClient.Suite.Secret().SetInt64(int64(d))
-
-	// compute PComm for d
-	PCommr := dissentClient.PCommr
-	xind := dissentClient.Suite.Secret().SetInt64(int64(ind))
-	PCommind, rind := dissentClient.PedersenBase.Commit(xind)
-	PCommd := dissentClient.PedersenBase.Sub(PCommr, PCommind)
-	bytePCommind, err := PCommind.MarshalBinary()
-	util.CheckErr(err)
-	bytePCommd, err := PCommd.MarshalBinary()
-	util.CheckErr(err)
-	byteRind, err := rind.MarshalBinary()
-	util.CheckErr(err)
+	// re-binding needs the same reputation as posting
+	dim := dissentClient.Policy.PostDimension()
+	ind, ok := dissentClient.Policy.PostLevel(dissentClient.Reputation[dim])
+	if !ok {
+		fmt.Println("[client] Reputation is too low to keep posted bridges")
+		dissentClient.PostedBridges = nil
+		return
+	}
+	byteOldNym := util.EncodePoint(oldNym)
+	byteNym := util.EncodePoint(dissentClient.OnetimePseudoNym)
+	for _,bridgeAddr := range dissentClient.PostedBridges {
+		params := map[string]interface{}{
+			"epoch": dissentClient.Epoch,
+			"bridge_addr": bridgeAddr,
+			"old_nym": byteOldNym,
+			"nym": byteNym,
+			"ind": ind,
+			"dim": dim,
+		}
+		if dissentClient.Policy.NeedProof(ind) {
+			fillIndProof(params, dim, ind)
+		} else {
+			fillEmptyProof(params)
+		}
 
-	// generate ARGnonneg
-	FOCommd, rFOCommd := dissentClient.FujiOkamBase.Commit(bigD)
-	ARGnonneg := dissentClient.FujiOkamBase.ProveNonneg(bigD, FOCommd, rFOCommd)
-	byteARGnonneg := util.EncodeARGnonneg(ARGnonneg)
+		// sign with both nyms to prove the ownership
+		byteMsg := bridge.MessageOfRebindBridge(params)
+		rand := dissentClient.Suite.Cipher(abstract.RandomKey)
+		params["old_signature"] = util.ElGamalSign(dissentClient.Suite, rand, byteMsg, dissentClient.PrivateKey, oldG)
+		rand = dissentClient.Suite.Cipher(abstract.RandomKey)
+		params["signature"] = util.ElGamalSign(dissentClient.Suite, rand, byteMsg, dissentClient.PrivateKey, dissentClient.G)
 
-	// generate ARGequal
-	rd := dissentClient.Suite.Secret().Sub(dissentClient.R, rind)
-	ARGequal := pedersen_fujiokam.ProveEqual(dissentClient.PedersenBase, dissentClient.FujiOkamBase, xD, PCommd, rd, FOCommd, rFOCommd)
-	byteARGequal := util.EncodeARGequal(ARGequal)
+		event := &proto.Event{EventType:proto.REBIND_BRIDGE, Params:params}
+		util.SendEvent(dissentClient.LocalAddr, dissentClient.CoordinatorAddr, event)
+	}
+}
 
+/**
+  * request "ind" numbers of bridges from server,
+  * proving reputation >= ind in dimension dim
+  */
+func requestBridges(ind int, dim int) {
+	if dim < 0 || dim >= len(dissentClient.Reputation) {
+		fmt.Println("unknown reputation dimension")
+		return
+	}
+	if ind > dissentClient.Policy.Effective(dissentClient.Reputation[dim]) {
+		fmt.Println("indicator should be less or equal than reputation")
+		return
+	}
 	byteNym, _ := dissentClient.OnetimePseudoNym.MarshalBinary()
 
 	// wrap params
 	params := map[string]interface{}{
+		"epoch": dissentClient.Epoch,
 		"ind": ind,
+		"dim": dim,
 		"nym": byteNym,
 		"signature": nil, // fill this field later
-		"FOCommd": FOCommd.ToBinary(),
-		"PCommd": bytePCommd,
-		"PCommind": bytePCommind,
-		"rind": byteRind,
-		"arg_nonneg": byteARGnonneg,
-		"arg_equal": byteARGequal,
+	}
+	if dissentClient.Policy.NeedProof(ind) {
+		fillIndProof(params, dim, ind)
+	} else {
+		fillEmptyProof(params)
 	}
 
 	// sign message
 	byteMsg := bridge.MessageOfRequestBridges(params)
-	rand := dissentClient.Suite.Cipher([]byte("example"))
+	rand := dissentClient.Suite.Cipher(abstract.RandomKey)
 	sig := util.ElGamalSign(dissentClient.Suite, rand, byteMsg, dissentClient.PrivateKey, dissentClient.G)
 	params["signature"] = sig
 
@@ -145,6 +196,23 @@ func requestBridges(ind int) {
 	util.SendEvent(dissentClient.LocalAddr, dissentClient.CoordinatorAddr, event)
 }
 
+/**
+  * everybody has at least the floor, so leave the proof empty
+  */
+func fillEmptyProof(params map[string]interface{}) {
+	for _,field := range bridge.IndProofParams {
+		params[field] = []byte{}
+	}
+}
+
+/**
+  * fill in the proof that reputation >= ind in dimension dim
+  */
+func fillIndProof(params map[string]interface{}, dim int, ind int) {
+	bridge.FillIndProof(params, dissentClient.Suite, dissentClient.PedersenBase, dissentClient.FujiOkamBase,
+		ind, dissentClient.Reputation[dim], dissentClient.PCommr[dim], dissentClient.R[dim])
+}
+
 /**
   * send message text to server
   */
@@ -178,7 +246,7 @@ func requestBridges(ind int) {
 // 	ARGequal := pedersen_fujiokam.ProveEqual(dissentClient.PedersenBase, dissentClient.FujiOkamBase, xD, PCommd, rd, FOCommd, rFOCommd)
 
 // 	// generate signature
-// 	rand := dissentClient.Suite.Cipher([]byte("example"))
+// 	rand := dissentClient.Suite.Cipher(abstract.RandomKey)
 // 	sig := util.ElGamalSign(dissentClient.Suite, rand, []byte(text), dissentClient.PrivateKey, dissentClient.G)
 // 	// serialize Point data structure
 // 	byteNym, _ := dissentClient.OnetimePseudoNym.MarshalBinary()
@@ -200,15 +268,43 @@ func requestBridges(ind int) {
 // 	util.SendEvent(dissentClient.LocalAddr, dissentClient.CoordinatorAddr, event)
 // }
 
+/**
+  * probe an assigned bridge until the posting phase ends
+  */
+func probeAssignment(key string, addr string) {
+	for i := 0; i < dissentClient.ProbeAttempts; i++ {
+		if dissentClient.GetStatus() != MESSAGE {
+			return
+		}
+		err := dissentClient.Prober.Probe(addr)
+		dissentClient.RecordProbe(key, err == nil)
+		time.Sleep(dissentClient.ProbeInterval)
+	}
+}
+
+/**
+  * vote for every assignment according to its probing result
+  */
+func sendAutoVotes() {
+	for i,info := range dissentClient.Assignments {
+		res := dissentClient.GetProbeResult(bridge.AssignmentKey(info.Assignment))
+		category, ok := dissentClient.ProbeRule.Feedback(res)
+		if !ok {
+			fmt.Printf("[client] Bridge %d is inconclusive (%d/%d reachable), vote manually\n", i, res.Successes, res.Attempts)
+			continue
+		}
+		fmt.Printf("[client] Bridge %d is %d/%d reachable, voting %s\n", i, res.Successes, res.Attempts, category)
+		sendVote(i, category)
+	}
+}
+
 /**
   * send vote to server
   */
-func sendVote(msgID, feedback int) {
-	// vote can be only 1 or -1
-	if feedback > 0 {
-		feedback = 1;
-	}else {
-		feedback = -1;
+func sendVote(msgID int, category bridge.Category) {
+	if msgID < 0 || msgID >= len(dissentClient.Assignments) {
+		fmt.Println("bridge id out of range")
+		return
 	}
 	info := dissentClient.Assignments[msgID]
 	assignment := info.Assignment
@@ -217,14 +313,28 @@ func sendVote(msgID, feedback int) {
 
 	// pack message
 	params := map[string]interface{}{
+		"epoch": dissentClient.Epoch,
 		"nym": byteNym,
 		"assignment": bridge.EncodeAssignment(assignment),
 		"signatures": byteSignatures,
-		"feedback": feedback,
+		"category": int(category),
+	}
+	if dissentClient.WeightedVotes {
+		// prove the highest level in the policy's brackets
+		dim := dissentClient.Policy.VoteDimension()
+		if level, ok := dissentClient.Policy.VoteLevel(dissentClient.Reputation[dim]); ok {
+			params["ind"] = level
+			params["dim"] = dim
+			if dissentClient.Policy.NeedProof(level) {
+				fillIndProof(params, dim, level)
+			} else {
+				fillEmptyProof(params)
+			}
+		}
 	}
 	msg := bridge.MessageOfVote(params)
 	// sign this message
-	rand := dissentClient.Suite.Cipher([]byte("example"))
+	rand := dissentClient.Suite.Cipher(abstract.RandomKey)
 	sig := util.ElGamalSign(dissentClient.Suite, rand, msg, dissentClient.PrivateKey, dissentClient.G)
 
 	// send to coordinator
@@ -261,6 +371,59 @@ func sendVote2(msgID, vote int) {
 	util.SendEvent(dissentClient.LocalAddr, dissentClient.CoordinatorAddr, event)
 }
 
+/**
+  * print a token proving to service, without telling who we are, that we are
+  * a member of this round with reputation >= ind in dimension dim
+  */
+func makeToken(service string, ind int, dim int, nonce []byte) {
+	if dim < 0 || dim >= len(dissentClient.Reputation) {
+		fmt.Println("unknown reputation dimension")
+		return
+	}
+	if ind > dissentClient.Reputation[dim] {
+		fmt.Println("indicator should be less or equal than reputation")
+		return
+	}
+	if dissentClient.AllClientsRecords == nil {
+		fmt.Println("[note]** Tokens are signed by the whole table, enable full_table to make them")
+		return
+	}
+	member := &token.Member{
+		Suite: dissentClient.Suite,
+		PrivateKey: dissentClient.PrivateKey,
+		Epoch: dissentClient.Epoch,
+		TableRoot: dissentClient.TableRoot,
+		G: dissentClient.G,
+		Keys: dissentClient.AllClientsPublicKeys,
+		Records: dissentClient.AllClientsRecords,
+		Index: dissentClient.Index,
+		Reputation: dissentClient.Reputation,
+		R: dissentClient.R,
+		PedersenBase: dissentClient.PedersenBase,
+		FujiOkamBase: dissentClient.FujiOkamBase,
+	}
+	fmt.Println("[client] Token for " + service + ":")
+	fmt.Println(hex.EncodeToString(token.Make(member, service, nonce, dim, ind)))
+	fmt.Print("cmd >> ")
+}
+
+// print our books of each round, and whether the announced commitment matched them
+func printHistory() {
+	for _,entry := range dissentClient.History {
+		status := "ok"
+		if entry.Mismatch != nil {
+			status = "MISMATCH in dimensions " + fmt.Sprint(entry.Mismatch)
+		}
+		fmt.Println("round", entry.Epoch, "reputation", entry.Reputation, "commitment", status)
+		if entry.Diffs != nil {
+			fmt.Println("  diffs", entry.Diffs, "feedback:", bridge.FormatBreakdown(entry.Breakdown))
+		}
+		if entry.Unopened {
+			fmt.Println("  the sealed round-end update did NOT open, reputation kept")
+		}
+	}
+	fmt.Print("cmd >> ")
+}
 
 /**
   * initialize anonClient and encrypted parameters
@@ -274,6 +437,18 @@ func initClient() {
 	suite := nist.NewAES128SHA256QR512()
 	a := suite.Secret().Pick(random.Stream)
 	A := suite.Point().Mul(nil, a)
+	// pin the coordinator's key published by the operator, trusting the
+	// first key seen only if explicitly asked to
+	var coordinatorKey abstract.Point
+	trustFirstKey := util.GetIntParameter("trust_first_coordinator_key", 0) != 0
+	if hexKey := config["coordinator_public_key"]; hexKey != "" {
+		byteKey, err := hex.DecodeString(hexKey)
+		util.CheckErr(err)
+		coordinatorKey = util.DecodePoint(suite, byteKey)
+	} else if !trustFirstKey {
+		fmt.Println("[note]** coordinator_public_key is not configured, set it or set trust_first_coordinator_key=1")
+		os.Exit(1)
+	}
 	dissentClient = &DissentClient{
 		CoordinatorAddr: CoordinatorAddr,
 		Socket: nil,
@@ -281,12 +456,25 @@ func initClient() {
 		Suite: suite,
 		PrivateKey: a,
 		PublicKey: A,
-		ControllerPublicKey: suite.Point(),
+		ControllerPublicKey: coordinatorKey,
+		TrustFirstKey: trustFirstKey,
 		OnetimePseudoNym: suite.Point(),
 		G: nil,
-		Reputation: bridge.StartingCredit,
+		Reputation: nil,
 		FujiOkamBase: nil,
 		PedersenBase: pedersen.CreateBaseFromSuite(suite),
+		InviteToken: util.GetParameter("invite_token"),
+		PowDifficulty: util.GetIntParameter("pow_difficulty", 0),
+		WeightedVotes: util.GetIntParameter("weighted_votes", 0) != 0,
+		VerifyShuffles: util.GetIntParameter("verify_shuffles", 0) != 0,
+		FullTable: util.GetIntParameter("full_table", 0) != 0,
+		AutoFeedback: util.GetIntParameter("auto_feedback", 0) != 0,
+		Prober: &probe.TCPProber{Timeout: time.Duration(util.GetIntParameter("probe_timeout_ms", 3000)) * time.Millisecond},
+		ProbeRule: probe.DefaultRule,
+		ProbeAttempts: util.GetIntParameter("probe_attempts", 5),
+		ProbeInterval: time.Duration(util.GetIntParameter("probe_interval_ms", 2000)) * time.Millisecond,
+		ProbeResults: make(map[string]*probe.Result),
+		Transcript: transcript.Open(config["transcript_file"], suite, a),
 	}
 }
 
@@ -310,7 +498,7 @@ func Launch() {
 	register()
 
 	// wait until register successful
-	for ; dissentClient.Status != MESSAGE ; {
+	for ; dissentClient.GetStatus() != MESSAGE ; {
 		time.Sleep(500 * time.Millisecond)
 	}
 
@@ -328,8 +516,12 @@ func Launch() {
 		// 	break
 		case "vote":
 			msgID,_ := strconv.Atoi(commands[1])
-			vote, _ := strconv.Atoi(commands[2])
-			sendVote(msgID, vote)
+			category, ok := bridge.ParseCategory(commands[2])
+			if !ok {
+				fmt.Println("unknown feedback category")
+				break
+			}
+			sendVote(msgID, category)
 			break
 		case "post":
 			bridgeAddr := commands[1]
@@ -337,7 +529,27 @@ func Launch() {
 			break
 		case "get":
 			ind,_ := strconv.Atoi(commands[1])
-			requestBridges(ind)
+			// prove the first dimension unless another one is named
+			dim := 0
+			if len(commands) > 2 {
+				dim = dissentClient.Policy.DimensionIndex(commands[2])
+			}
+			requestBridges(ind, dim)
+			break
+		case "token":
+			ind,_ := strconv.Atoi(commands[2])
+			dim := 0
+			if len(commands) > 3 {
+				dim = dissentClient.Policy.DimensionIndex(commands[3])
+			}
+			nonce := []byte{}
+			if len(commands) > 4 {
+				nonce = []byte(commands[4])
+			}
+			makeToken(commands[1], ind, dim, nonce)
+			break
+		case "history":
+			printHistory()
 			break
 		case "exit":
 			break Loop
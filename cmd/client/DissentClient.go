@@ -1,11 +1,21 @@
 package client
 
 import (
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"math/big"
 	"net"
+	"strings"
+	"sync"
+	"time"
 	"zRep/cmd/bridge"
+	"zRep/cmd/probe"
+	"zRep/cmd/transcript"
 	"zRep/primitive/fujiokam"
 	"zRep/primitive/pedersen"
+	"zRep/proto"
+	"zRep/util"
 
 	"github.com/dedis/crypto/abstract"
 )
@@ -15,6 +25,22 @@ import (
 type AssignmentInfo struct {
 	Assignment *bridge.Assignment
 	ByteSignatures []byte
+	// bridge address opened from the sealed address
+	Addr string
+}
+
+// what a client knows of its own record in a round
+type RoundHistory struct {
+	Epoch int
+	// reputation in our books when the round was announced
+	Reputation []int
+	// dimensions in which the announced commitment does not open to it
+	Mismatch []int
+	// diffs and feedback opened at round end, nil if we had no record
+	Diffs []int
+	Breakdown []int
+	// our sealed update at round end did not open
+	Unopened bool
 }
 
 type DissentClient struct {
@@ -22,32 +48,254 @@ type DissentClient struct {
 	CoordinatorAddr *net.TCPAddr
 	LocalAddr *net.TCPAddr
 	Socket *net.TCPConn
+	// read by the probing goroutines, use GetStatus and SetStatus
 	Status int
+	statusLock sync.Mutex
 	// crypto variables
 	Suite abstract.Suite
 	PrivateKey abstract.Secret
 	PublicKey abstract.Point
+	// coordinator's key, pinned from config or trusted on first use
 	ControllerPublicKey abstract.Point
+	// trust the first coordinator key seen if none is pinned, off by default
+	TrustFirstKey bool
+	// latest round announced by the coordinator
+	Epoch int
+	// sequence numbers of the coordinator's events handled in this round
+	SeenEvents map[int]bool
 	OnetimePseudoNym abstract.Point
 	G abstract.Point
-	Reputation int
+	// reputation in each dimension
+	Reputation []int
 	AllClientsPublicKeys []abstract.Point
+	// records of the table in the order of the keys, nil like the keys if
+	// we only fetched our own record
+	AllClientsRecords [][]abstract.Point
+	// signed root of the table of this round
+	TableRoot []byte
 	Index int
 	Assignments []AssignmentInfo
+	// bridges posted by this client, re-bound to the new nym every round
+	PostedBridges []string
+
+	// admission data sent with the registration
+	InviteToken string
+	PowDifficulty int
+	PowChallenge []byte
+
+	// attach a proof of reputation to votes so that they weigh more
+	WeightedVotes bool
 
-	PCommr abstract.Point
-	R abstract.Secret
+	// check the chain of shuffle proofs before accepting an announcement
+	VerifyShuffles bool
+	// fetch the whole table of each round instead of our own record, so that
+	// the coordinator does not learn which record is ours
+	FullTable bool
+	// announcement waiting for its shuffle proofs or its table
+	PendingAnnouncement map[string]interface{}
+
+	// probe assigned bridges and vote automatically
+	AutoFeedback bool
+	Prober probe.Prober
+	ProbeRule probe.Rule
+	ProbeAttempts int
+	ProbeInterval time.Duration
+	// map an assignment's key to its probing result
+	ProbeResults map[string]*probe.Result
+	probeLock sync.Mutex
+
+	// commitment and its randomness in each dimension
+	PCommr []abstract.Point
+	R []abstract.Secret
+	// our books of each round, checked against the announced commitments
+	History []*RoundHistory
+	Policy *bridge.Policy
 	FujiOkamBase *fujiokam.FujiOkamBase
 	PedersenBase *pedersen.PedersenBase
 	AllGnHonestyProofPublic []*big.Int
 	AllGnHonestyChallenge []bool
+	// signed record of the coordinator's announcements and round ends, nil if not kept
+	Transcript *transcript.Writer
+}
+
+func (dissentClient *DissentClient) GetStatus() int {
+	dissentClient.statusLock.Lock()
+	defer dissentClient.statusLock.Unlock()
+	return dissentClient.Status
+}
+
+func (dissentClient *DissentClient) SetStatus(status int) {
+	dissentClient.statusLock.Lock()
+	dissentClient.Status = status
+	dissentClient.statusLock.Unlock()
 }
 
 func (dissentClient *DissentClient) ClearBuffer() {
 	dissentClient.Assignments = nil
+	dissentClient.probeLock.Lock()
+	dissentClient.ProbeResults = make(map[string]*probe.Result)
+	dissentClient.probeLock.Unlock()
+}
+
+func (dissentClient *DissentClient) RecordProbe(key string, reachable bool) {
+	dissentClient.probeLock.Lock()
+	defer dissentClient.probeLock.Unlock()
+	res, ok := dissentClient.ProbeResults[key]
+	if !ok {
+		res = &probe.Result{}
+		dissentClient.ProbeResults[key] = res
+	}
+	res.Record(reachable)
+}
+
+func (dissentClient *DissentClient) GetProbeResult(key string) probe.Result {
+	dissentClient.probeLock.Lock()
+	defer dissentClient.probeLock.Unlock()
+	if res, ok := dissentClient.ProbeResults[key]; ok {
+		return *res
+	}
+	return probe.Result{}
+}
+
+func (dissentClient *DissentClient) AddPostedBridge(bridgeAddr string) {
+	for _,addr := range dissentClient.PostedBridges {
+		if addr == bridgeAddr {
+			return
+		}
+	}
+	dissentClient.PostedBridges = append(dissentClient.PostedBridges, bridgeAddr)
 }
 
-func (dissentClient *DissentClient) AddAssignment(assignment *bridge.Assignment, byteSignatures []byte) {
-	info := AssignmentInfo{Assignment: assignment, ByteSignatures: byteSignatures}
+func (dissentClient *DissentClient) AddAssignment(assignment *bridge.Assignment, byteSignatures []byte, addr string) {
+	info := AssignmentInfo{Assignment: assignment, ByteSignatures: byteSignatures, Addr: addr}
 	dissentClient.Assignments = append(dissentClient.Assignments, info)
-}
\ No newline at end of file
+}
+// record an event of the coordinator, with its signature, for auditors
+func (dissentClient *DissentClient) RecordEvent(eventType int, params map[string]interface{}) {
+	pm := map[string]interface{}{
+		"event_type": eventType,
+		"event": transcript.EncodeParams(params),
+	}
+	dissentClient.Transcript.Append(transcript.EVENT, dissentClient.Epoch, pm)
+}
+
+// the history of the current round, started if we have none yet
+func (dissentClient *DissentClient) CurrentHistory() *RoundHistory {
+	n := len(dissentClient.History)
+	if n > 0 && dissentClient.History[n-1].Epoch == dissentClient.Epoch {
+		return dissentClient.History[n-1]
+	}
+	entry := &RoundHistory{Epoch: dissentClient.Epoch, Reputation: append([]int{}, dissentClient.Reputation...)}
+	dissentClient.History = append(dissentClient.History, entry)
+	return entry
+}
+
+// check that the record announced for our nym opens to our reputation and
+// R under the new GT and HT. A mismatch means the coordinator's books and
+// ours disagree, so we raise an alert with what is needed to dispute it:
+// the signed root of the table, our record in it, and our diffs so far.
+func (dissentClient *DissentClient) CheckCommitment(params map[string]interface{}, index int, record []abstract.Point) {
+	entry := dissentClient.CurrentHistory()
+	bad, err := bridge.CheckOpening(dissentClient.PedersenBase, record, dissentClient.Reputation, dissentClient.R)
+	if err != nil {
+		bad = nil
+		for dim := range dissentClient.Reputation {
+			bad = append(bad, dim)
+		}
+	}
+	if len(bad) == 0 {
+		return
+	}
+	entry.Mismatch = bad
+	names := []string{}
+	for _,dim := range bad {
+		names = append(names, dissentClient.Policy.DimensionName(dim))
+	}
+	fmt.Println()
+	fmt.Println("[alert]** The commitment announced for my nym in round", entry.Epoch, "does not open to my reputation in", strings.Join(names, ", "))
+	fmt.Println("  coordinator key:", hex.EncodeToString(util.EncodePoint(dissentClient.ControllerPublicKey)))
+	fmt.Println("  table root:", hex.EncodeToString(params["table_root"].([]byte)), "size:", params["table_size"].(int),
+		"signature:", hex.EncodeToString(params["table_signature"].([]byte)))
+	fmt.Println("  my record at index", index, "of the table:")
+	for dim,comm := range record {
+		fmt.Println("   ", dissentClient.Policy.DimensionName(dim), hex.EncodeToString(util.EncodePoint(comm)))
+	}
+	fmt.Println("  my reputation:", entry.Reputation)
+	for _,past := range dissentClient.History {
+		if past.Diffs != nil {
+			fmt.Println("  diffs of round", past.Epoch, ":", past.Diffs)
+		}
+	}
+	if err != nil {
+		fmt.Println("  the record has", len(record), "dimensions instead of", len(dissentClient.Reputation))
+	}
+	if dissentClient.Transcript != nil {
+		fmt.Println("  the signed announcement is in my transcript")
+	}
+	fmt.Println("  the opening of each commitment is kept and can be disclosed to prove the mismatch")
+}
+
+// our sealed round-end update does not open, so we can not follow our
+// reputation past this round. We keep the one we had and raise an alert with
+// the round end it came in, which the coordinator signed
+func (dissentClient *DissentClient) AlertSealedUpdate(params map[string]interface{}, index int, sealed []byte, err error) {
+	entry := dissentClient.CurrentHistory()
+	entry.Unopened = true
+	fmt.Println()
+	fmt.Println("[alert]** The round-end update sealed to my nym in round", entry.Epoch, "does not open:", err)
+	fmt.Println("  coordinator key:", hex.EncodeToString(util.EncodePoint(dissentClient.ControllerPublicKey)))
+	fmt.Println("  my update at index", index, "of the round end:", hex.EncodeToString(sealed))
+	fmt.Println("  my reputation is kept at:", dissentClient.Reputation)
+	if dissentClient.Transcript != nil {
+		fmt.Println("  the signed round end is in my transcript")
+	}
+}
+
+// check that the event is signed by the coordinator for the current round,
+// and has not been handled before.
+// Without a pinned key the first key seen is trusted if TrustFirstKey is
+// set, and every later event must match it
+func (dissentClient *DissentClient) VerifyCoordinator(event *proto.Event) error {
+	byteKey, ok := event.Params["coordinator_key"].([]byte)
+	if !ok {
+		return errors.New("event is not signed by the coordinator")
+	}
+	byteSig, ok := event.Params["coordinator_signature"].([]byte)
+	if !ok {
+		return errors.New("event is not signed by the coordinator")
+	}
+	if dissentClient.ControllerPublicKey == nil {
+		if !dissentClient.TrustFirstKey {
+			return errors.New("no coordinator key is pinned")
+		}
+		key := dissentClient.Suite.Point()
+		if err := key.UnmarshalBinary(byteKey); err != nil {
+			return err
+		}
+		fmt.Println("[note]** No coordinator_public_key configured, trusting coordinator key " + hex.EncodeToString(util.EncodePoint(key)))
+		dissentClient.ControllerPublicKey = key
+	}
+	msg := util.MessageOfEvent(event, "coordinator_signature")
+	if err := util.ElGamalVerify(dissentClient.Suite, msg, dissentClient.ControllerPublicKey, byteSig, nil); err != nil {
+		return err
+	}
+	// a signed event of an earlier round may be a replay
+	epoch, ok := event.Params["epoch"].(int)
+	if !ok || epoch < dissentClient.Epoch {
+		return errors.New("event belongs to an earlier round")
+	}
+	// so may an event handled before in this round
+	seq, ok := event.Params["seq"].(int)
+	if !ok {
+		return errors.New("event has no sequence number")
+	}
+	if epoch > dissentClient.Epoch || dissentClient.SeenEvents == nil {
+		dissentClient.SeenEvents = make(map[int]bool)
+	}
+	if dissentClient.SeenEvents[seq] {
+		return errors.New("event has been handled in this round")
+	}
+	dissentClient.SeenEvents[seq] = true
+	dissentClient.Epoch = epoch
+	return nil
+}
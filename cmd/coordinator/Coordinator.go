@@ -1,25 +1,30 @@
 package coordinator
 
 import (
+	"encoding/hex"
 	"math/big"
 	"net"
+	"sync"
+	"time"
 	"zRep/primitive/fujiokam"
 	"zRep/primitive/lrs"
 	"zRep/primitive/pedersen"
+	"zRep/cmd/admission"
 	"zRep/cmd/bridge"
+	"zRep/cmd/quota"
+	"zRep/cmd/transcript"
+	"zRep/proto"
 	"zRep/util"
+	"zRep/util/merkle"
 
 	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/random"
 )
 
 type ClientTuple struct {
 	Nym abstract.Point
-	PComm abstract.Point
-}
-
-type BridgeInfo struct {
-	Nym abstract.Point
-	Used bool
+	// one commitment per reputation dimension
+	PComm []abstract.Point
 }
 
 type AssignmentSignatures struct {
@@ -30,6 +35,21 @@ type AssignmentSignatures struct {
 type ServerInfo struct {
 	Addr *net.TCPAddr
 	PublicKey abstract.Point
+	// proved to have sent a hop whose proofs fail, or to have blamed a good one
+	Faulty bool
+}
+
+// a server which has asked to join the chain
+type PendingServer struct {
+	// host of the connection the registration came from, and the address
+	// it claims, together they key the pending server
+	Key string
+	Addr *net.TCPAddr
+	PublicKey abstract.Point
+	// nonce the server has to sign with its private key
+	Nonce []byte
+	// whether the server has proved it holds the private key
+	Proved bool
 }
 
 type Coordinator struct {
@@ -37,6 +57,15 @@ type Coordinator struct {
 	LocalAddr *net.TCPAddr
 	// network topology for server cluster
 	ServerList []ServerInfo
+	// hex-encoded public keys of servers admitted without asking the operator
+	TrustedServers map[string]bool
+	// map a server's address to its pending registration
+	PendingServers map[string]*PendingServer
+	// guards ServerList and PendingServers, shared with the admin interface
+	serverLock sync.Mutex
+	// sequence number of the last event signed for clients
+	EventSeq int
+	seqLock sync.Mutex
 	// initialize the controller status
 	Status int
 
@@ -49,29 +78,90 @@ type Coordinator struct {
 	PublicKey abstract.Point
 	// generator g
 	G abstract.Point
+	// generator g of last round, used to verify bridge re-binding
+	PrevG abstract.Point
+	// current round, every signed message must carry it
+	Epoch int
 	// h for Pedersen
 
 	// store client address
 	Clients map[string]*net.TCPAddr
 	// store reputation map
 	BeginningKeyMap map[string]abstract.Point
-	BeginningCommMap map[string]abstract.Point
+	BeginningCommMap map[string][]abstract.Point
 	// we only add new clients at the beginning of each round
 	// store the new clients's one-time pseudo nym
 	NewClientsBuffer []ClientTuple
+	// public keys of the clients in NewClientsBuffer, and of the clients
+	// joining at the current round end, who register again if it is aborted
+	NewClientKeys []abstract.Point
+	JoiningClientKeys []abstract.Point
+	// pedersen base the table of the current round started from, restored
+	// if the round is aborted
+	StartGT abstract.Point
+	StartHT abstract.Point
 	// msg sender's record nym
 	MsgLog []abstract.Point
-	// map an assignment's bridge to servers' signatures
+	// map an assignment's key to servers' signatures
 	AssignmentSignaturesLog map[string]AssignmentSignatures
+	// map an assignment's key to its address sealed to the requester
+	SealedAddrs map[string][]byte
+	// map an assignment's key to the bridge address it hands out
+	AssignedAddrs map[string]string
 	// record each vote signature's y0
 	RequesterAddrs map[string]*net.TCPAddr
 	VoteRecords []*big.Int
 
-	Bridges map[string]BridgeInfo
+	BridgePool *bridge.Pool
+	// map a provider's nym to the number of bridges it posted in this round
+	PostCounts map[string]int
+	// rate limits of client actions per nym and per connection
+	Quotas *quota.Limiter
+	// decide whether a client can register
+	Admission admission.Chain
+	// public keys admitted so far, a key registers only once
+	RegisteredKeys map[string]bool
+	// map the commitments of an admitted registration on its way through the
+	// servers to the client's address, a registration comes back only once
+	AdmittedRegistrations map[string]string
 
 	EndingKeyMap map[string]abstract.Point
-	EndingCommMap map[string]abstract.Point
-	ReputationDiffMap map[string]int
+	// map a nym to its commitments, one per reputation dimension
+	EndingCommMap map[string][]abstract.Point
+	// diffs actually committed at round end after applying the policy
+	AppliedDiffMap map[string][]int
+	// and the randomness of their commitments, sealed to each nym at round end
+	AppliedRDiffMap map[string][]abstract.Secret
+	Policy *bridge.Policy
+	// votes of this round, every server keeps its own tally too
+	Tally *bridge.Tally
+	// diff table of the round end, and each server's signature agreeing on it
+	TallyKeys []abstract.Point
+	TallyTable [][]int
+	TallySignatures [][]byte
+	TallyRefused bool
+	// how long to wait for every server to sign the diff table
+	TallyTimeout time.Duration
+	// parameters of the votes accepted in this round, published at round end
+	VoteLog []map[string]interface{}
+	// what we sent to the first hop of the current announcement or round-end pass
+	PassStart map[string]interface{}
+	// chain of hops of the last announcement, handed to clients checking the shuffles
+	AnnouncementHops []byte
+	// keys of the servers of the last announcement, in the order of its hops
+	AnnouncementServers []abstract.Point
+	// table of the last announcement with its signed root, and its Merkle tree
+	Table map[string]interface{}
+	TableTree *merkle.Tree
+	// times the current pass has been restarted after a blame
+	PassRestarts int
+	MaxPassRestarts int
+	// drop a faulty server from the chain when restarting an announcement,
+	// as long as MinServers remain
+	DropFaultyServers bool
+	MinServers int
+	// signed record of every round for auditors, nil if not kept
+	Transcript *transcript.Writer
 
 	AllClientsPublicKeys []abstract.Point
 
@@ -110,8 +200,96 @@ func (c *Coordinator) AddClient(key abstract.Point, val *net.TCPAddr) {
 	c.Clients[key.String()] = val
 }
 
+// what the per connection quota of a sender is counted on: the address of a
+// registered client on the host of the connection, so that clients sharing a
+// host have their own quota. Any other sender shares the quota of its host,
+// so that changing ports does not give more actions
+func (c *Coordinator) ConnQuotaKey(host string, addr *net.TCPAddr) string {
+	if addr == nil || addr.IP.String() != host {
+		return host
+	}
+	for _,v := range c.Clients {
+		if v.String() == addr.String() {
+			return addr.String()
+		}
+	}
+	return host
+}
+
+// start a server's registration, return the nonce it has to sign
+func (c *Coordinator) AddPendingServer(key string, addr *net.TCPAddr, publicKey abstract.Point) []byte {
+	c.serverLock.Lock()
+	defer c.serverLock.Unlock()
+	nonce := random.Bytes(32, random.Stream)
+	c.PendingServers[key] = &PendingServer{Key: key, Addr: addr, PublicKey: publicKey, Nonce: nonce, Proved: false}
+	return nonce
+}
+
+// key a pending server by the host it really connects from, so that a
+// register from another host claiming the same address does not replace it
+func PendingServerKey(host string, addr *net.TCPAddr) string {
+	return host + "|" + addr.String()
+}
+
+// look up and remove a pending server, nil if there is none
+func (c *Coordinator) TakePendingServer(key string) *PendingServer {
+	c.serverLock.Lock()
+	defer c.serverLock.Unlock()
+	server, ok := c.PendingServers[key]
+	if !ok {
+		return nil
+	}
+	delete(c.PendingServers, key)
+	return server
+}
+
+// get a pending server without removing it
+func (c *Coordinator) GetPendingServer(key string) *PendingServer {
+	c.serverLock.Lock()
+	defer c.serverLock.Unlock()
+	return c.PendingServers[key]
+}
+
+// find the server at addrStr which proved its key and waits for the operator
+func (c *Coordinator) FindWaitingServer(addrStr string) *PendingServer {
+	c.serverLock.Lock()
+	defer c.serverLock.Unlock()
+	for _,server := range c.PendingServers {
+		if server.Proved && server.Addr.String() == addrStr {
+			return server
+		}
+	}
+	return nil
+}
+
+// record that a pending server holds the private key of its public key
+func (c *Coordinator) MarkServerProved(server *PendingServer) {
+	c.serverLock.Lock()
+	defer c.serverLock.Unlock()
+	server.Proved = true
+}
+
+// list servers which proved their keys and wait for the operator
+func (c *Coordinator) WaitingServers() []*PendingServer {
+	c.serverLock.Lock()
+	defer c.serverLock.Unlock()
+	res := []*PendingServer{}
+	for _,server := range c.PendingServers {
+		if server.Proved {
+			res = append(res, server)
+		}
+	}
+	return res
+}
+
+func (c *Coordinator) IsTrustedServer(publicKey abstract.Point) bool {
+	return c.TrustedServers[hex.EncodeToString(util.EncodePoint(publicKey))]
+}
+
 // add server into topology
 func (c *Coordinator) AddServer(addr *net.TCPAddr, publicKey abstract.Point){
+	c.serverLock.Lock()
+	defer c.serverLock.Unlock()
 	server := ServerInfo{Addr:addr, PublicKey: publicKey}
 	c.ServerList = append(c.ServerList, server)
 }
@@ -120,6 +298,47 @@ func (c *Coordinator) GetServerPublicKey(index int) abstract.Point {
 	return c.ServerList[index].PublicKey
 }
 
+// the keys of the servers in the order of the chain
+func (c *Coordinator) GetServerPublicKeys() []abstract.Point {
+	keys := []abstract.Point{}
+	for _,server := range c.ServerList {
+		keys = append(keys, server.PublicKey)
+	}
+	return keys
+}
+
+// take a server out of the chain, linking its previous hop to its next one
+func (c *Coordinator) RemoveServer(index int) {
+	c.serverLock.Lock()
+	defer c.serverLock.Unlock()
+	prevAddr := c.LocalAddr
+	if index > 0 {
+		prevAddr = c.ServerList[index-1].Addr
+	}
+	nextAddr := c.LocalAddr
+	if index < len(c.ServerList)-1 {
+		nextAddr = c.ServerList[index+1].Addr
+	}
+	if index > 0 {
+		pm := map[string]interface{}{
+			"reply": true,
+			"next_hop": nextAddr.String(),
+		}
+		event := &proto.Event{EventType:proto.UPDATE_NEXT_HOP, Params:pm}
+		c.SignEvent(event)
+		util.SendEvent(c.LocalAddr, prevAddr, event)
+	}
+	if index < len(c.ServerList)-1 {
+		pm := map[string]interface{}{
+			"prev_hop": prevAddr.String(),
+		}
+		event := &proto.Event{EventType:proto.UPDATE_PREVIOUS_HOP, Params:pm}
+		c.SignEvent(event)
+		util.SendEvent(c.LocalAddr, nextAddr, event)
+	}
+	c.ServerList = append(c.ServerList[:index], c.ServerList[index+1:]...)
+}
+
 func (c *Coordinator) GetServerIndex(serverAddr *net.TCPAddr) int {
 	for i,server := range c.ServerList {
 		addr := server.Addr
@@ -131,102 +350,129 @@ func (c *Coordinator) GetServerIndex(serverAddr *net.TCPAddr) int {
 }
 
 func (c *Coordinator) SignMessage(msg []byte) []byte {
-	rand := c.Suite.Cipher([]byte("example"))
-	sig := util.ElGamalSign(c.Suite, rand, msg, c.PrivateKey, c.Suite.Point())
+	rand := c.Suite.Cipher(abstract.RandomKey)
+	sig := util.ElGamalSign(c.Suite, rand, msg, c.PrivateKey, nil)
 	return sig
 }
 
+// sign an event sent to clients, so that they can check it comes from the
+// coordinator they pinned
+func (c *Coordinator) SignEvent(event *proto.Event) {
+	// each signed event gets its own sequence number, so that clients
+	// can drop replays within a round
+	c.seqLock.Lock()
+	c.EventSeq++
+	event.Params["seq"] = c.EventSeq
+	c.seqLock.Unlock()
+	event.Params["epoch"] = c.Epoch
+	event.Params["coordinator_key"] = util.EncodePoint(c.PublicKey)
+	event.Params["coordinator_signature"] = c.SignMessage(util.MessageOfEvent(event, "coordinator_signature"))
+}
+
+// record the servers and parameters the round runs with
+func (c *Coordinator) RecordSetup() {
+	servers := [][]byte{}
+	for _,server := range c.ServerList {
+		servers = append(servers, util.EncodePoint(server.PublicKey))
+	}
+	pm := map[string]interface{}{
+		"servers": util.Encode2DByteArray(servers),
+		"policy": bridge.EncodePolicy(c.Policy),
+	}
+	c.AddFujiOkamParams(pm)
+	c.Transcript.Append(transcript.SETUP, c.Epoch, pm)
+}
+
+// add the Fujisaki-Okamoto parameters, which reputation proofs are checked with
+func (c *Coordinator) AddFujiOkamParams(pm map[string]interface{}) {
+	pm["n"] = c.FujiOkamBase.N.Bytes()
+	pm["g1"] = c.FujiOkamBase.G1.ToBinary()
+	pm["g2"] = c.FujiOkamBase.G2.ToBinary()
+	pm["g3"] = c.FujiOkamBase.G3.ToBinary()
+	pm["g4"] = c.FujiOkamBase.G4.ToBinary()
+	pm["g5"] = c.FujiOkamBase.G5.ToBinary()
+	pm["g6"] = c.FujiOkamBase.G6.ToBinary()
+	pm["h1"] = c.FujiOkamBase.H1.ToBinary()
+}
+
+// record what we sent to the first hop of a pass and what we got from its last one
+func (c *Coordinator) RecordPass(kind string, final map[string]interface{}) {
+	pm := map[string]interface{}{
+		"start": transcript.EncodeParams(c.PassStart),
+		"final": transcript.EncodeParams(final),
+	}
+	c.Transcript.Append(kind, c.Epoch, pm)
+}
+
 // add msg log and return msg id
 func (c *Coordinator) AddMsgLog(log abstract.Point) int{
 	c.MsgLog = append(c.MsgLog,log)
 	return len(c.MsgLog)
 }
 
-// create an empty entry to store all servers' signatures for a bridge
-func (c *Coordinator) InitAssignmentSignatures(brdgAddr string) {
+// create an empty entry to store all servers' signatures for an assignment
+func (c *Coordinator) InitAssignmentSignatures(key string) {
 	nServers := len(c.ServerList)
 	assignmentSigs := make([][]byte, nServers+1)
 	entry := AssignmentSignatures{Signatures: assignmentSigs, Count: 0}
-	anonCoordinator.AssignmentSignaturesLog[brdgAddr] = entry
+	anonCoordinator.AssignmentSignaturesLog[key] = entry
 }
 
-// insert a server's signature for a bridge into the log
-func (c *Coordinator) AddAssignmentSignature(brdgAddr string, serverIndex int, sig []byte) {
-	oldEntry := c.AssignmentSignaturesLog[brdgAddr]
+// insert a server's signature for an assignment into the log
+func (c *Coordinator) AddAssignmentSignature(key string, serverIndex int, sig []byte) {
+	oldEntry := c.AssignmentSignaturesLog[key]
 	assignmentSigs := oldEntry.Signatures
 	assignmentSigs[serverIndex] = sig
 	newEntry := AssignmentSignatures{Signatures: assignmentSigs, Count: oldEntry.Count + 1}
-	c.AssignmentSignaturesLog[brdgAddr] = newEntry
+	c.AssignmentSignaturesLog[key] = newEntry
 }
 
-func (c *Coordinator) FinishCollectingAssignmentSignatures(brdgAddr string) bool {
+func (c *Coordinator) FinishCollectingAssignmentSignatures(key string) bool {
 	nServers := len(c.ServerList)
-	return c.AssignmentSignaturesLog[brdgAddr].Count == nServers + 1
-}
-
-func (c *Coordinator) GetAssignmentSignatures(brdgAddr string) [][]byte {
-	return c.AssignmentSignaturesLog[brdgAddr].Signatures
-}
-
-func (c *Coordinator) AddBridge(bridgeAddr string, nym abstract.Point) {
-	c.Bridges[bridgeAddr] = BridgeInfo{Nym:nym, Used:false}
+	return c.AssignmentSignaturesLog[key].Count == nServers + 1
 }
 
-func (c *Coordinator) GetBridge() (res *bridge.Bridge) {
-	for bridgeAddr,info := range c.Bridges {
-		if !info.Used {
-			res = &bridge.Bridge{Addr:bridgeAddr, Nym:info.Nym}
-			// mark the bridge as used
-			c.Bridges[bridgeAddr] = BridgeInfo{Nym:info.Nym, Used:true}
-			return
-		}
-	}
-	return nil
-}
-
-func (c *Coordinator) GetBridges(num int) []bridge.Bridge {
-	res := []bridge.Bridge{}
-	for num > 0 {
-		br := c.GetBridge()
-		if br == nil {
-			return res
-		}
-		res = append(res, *br)
-		num = num - 1
-	}
-	return res
+func (c *Coordinator) GetAssignmentSignatures(key string) [][]byte {
+	return c.AssignmentSignaturesLog[key].Signatures
 }
 
 func (c *Coordinator) AssignBridges(num int, nymR abstract.Point) []bridge.Assignment {
-	brs := c.GetBridges(num)
+	brs := c.BridgePool.Take(num, nymR)
 	res := []bridge.Assignment{}
 	for _,br := range brs {
-		assignment := bridge.Assignment{NymR:nymR, Nym:br.Nym, Addr:br.Addr}
+		// only the requester can open the address
+		comm, salt := bridge.CommitAddr(c.Suite, br.Addr)
+		assignment := bridge.Assignment{NymR:nymR, Nym:br.Nym, AddrComm:comm, Epoch:c.Epoch}
+		key := bridge.AssignmentKey(&assignment)
+		c.SealedAddrs[key] = bridge.SealAddr(c.Suite, c.G, nymR, br.Addr, salt)
+		c.AssignedAddrs[key] = br.Addr
 		res = append(res, assignment)
 	}
 	return res
 }
 
-func (c *Coordinator) ClearBridges() {
-	c.Bridges = make(map[string]BridgeInfo)
+// whether nym can post another bridge under the quota of the level it proved
+func (c *Coordinator) CanPost(nym abstract.Point, level int) bool {
+	quota := c.Policy.PostQuota(level)
+	return quota == bridge.NoLimit || c.PostCounts[nym.String()] < quota
 }
 
-// get reputation
-func (c *Coordinator) GetReputationDiff(key abstract.Point) int{
-	return c.ReputationDiffMap[key.String()]
+// count a new bridge posted by nym against its quota
+func (c *Coordinator) CountPost(nym abstract.Point) {
+	c.PostCounts[nym.String()]++
 }
 
-func (c *Coordinator) AddClientInBuffer(nym abstract.Point, PComm abstract.Point) {
+func (c *Coordinator) AddClientInBuffer(nym abstract.Point, PComm []abstract.Point) {
 	c.NewClientsBuffer = append(c.NewClientsBuffer, ClientTuple{Nym:nym, PComm:PComm})
 }
 
-func (c *Coordinator) AddIntoEndingMap(key abstract.Point, val abstract.Point) {
+func (c *Coordinator) AddIntoEndingMap(key abstract.Point, val []abstract.Point) {
 	keyStr := key.String()
 	c.EndingKeyMap[keyStr] = key
 	c.EndingCommMap[keyStr] = val
 }
 
-func (c *Coordinator) AddIntoRepMap(key abstract.Point, val abstract.Point) {
+func (c *Coordinator) AddIntoRepMap(key abstract.Point, val []abstract.Point) {
 	keyStr := key.String()
 	c.BeginningKeyMap[keyStr] = key
 	c.BeginningCommMap[keyStr] = val
@@ -1,36 +1,49 @@
 package coordinator
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
 	// "math/big"
 	"net"
 	"strconv"
 	// "strings"
+	"sync"
 	"time"
 
 	"zRep/primitive/lrs"
 	// "zRep/primitive/pedersen_fujiokam"
 	"zRep/proto"
 	"zRep/util"
+	"zRep/cmd/admission"
 	"zRep/cmd/bridge"
+	"zRep/cmd/quota"
+	"zRep/cmd/transcript"
 
 	"github.com/dedis/crypto/abstract"
 )
 
 var anonCoordinator *Coordinator
+// host the message being handled really came from, unlike the address
+// claimed in the event
+var connHost string
 
 
 // Handle Use tmpCoordinator to handle data sent from addr.
-// The data is stored at buf
-func Handle(buf []byte, tmpCoordinator *Coordinator) {
+// The data is stored at buf, and remote is the address of the connection
+func Handle(buf []byte, tmpCoordinator *Coordinator, remote net.Addr) {
 	// decode the whole message
 	anonCoordinator = tmpCoordinator
+	connHost = util.HostOf(remote)
 	event, addr := util.DecodeEvent(buf)
 
 	switch event.EventType {
 	case proto.SERVER_REGISTER:
 		handleServerRegister(event.Params, addr)
 		break
+	case proto.SERVER_CHALLENGE_RESPONSE:
+		handleServerChallengeResponse(event.Params, addr)
+		break
 	case proto.UPDATE_PEDERSEN_H:
 		handleUpdatePedersenH(event.Params)
 		break
@@ -38,7 +51,7 @@ func Handle(buf []byte, tmpCoordinator *Coordinator) {
 		handleClientRegisterControllerSide(event.Params, addr)
 		break
 	case proto.CLIENT_REGISTER_SERVERSIDE:
-		handleClientRegisterServerSide(event.Params);
+		handleClientRegisterServerSide(event.Params, addr);
 		break
 	case proto.GN_HONESTY_CHALLENGE:
 		handleGnHonestyChallenge(event.Params, addr)
@@ -46,12 +59,27 @@ func Handle(buf []byte, tmpCoordinator *Coordinator) {
 	case proto.POST_BRIDGE:
 		handlePostBridge(event.Params, addr)
 		break
+	case proto.REBIND_BRIDGE:
+		handleRebindBridge(event.Params, addr)
+		break
 	case proto.REQUEST_BRIDGES:
 		handleRequestBridges(event.Params, addr)
 		break
 	case proto.GOT_SIGNS:
 		handleGotSignatures(event.Params, addr)
 		break
+	case proto.BLAME:
+		handleBlame(event.Params, addr)
+		break
+	case proto.SHUFFLE_PROOFS_REQUEST:
+		handleShuffleProofsRequest(event.Params, addr)
+		break
+	case proto.TABLE_REQUEST:
+		handleTableRequest(event.Params, addr)
+		break
+	case proto.TALLY_SIGNATURE:
+		handleTallySignature(event.Params, addr)
+		break
 	// case proto.MESSAGE:
 	// 	handleMsg(event.Params, addr)
 	// 	break
@@ -81,6 +109,19 @@ func handleAnnouncement(params map[string]interface{}) {
 	// 	anonCoordinator.Status = MESSAGE
 	// 	return
 	// }
+	// a pass of an aborted round may still come back
+	if anonCoordinator.Status != ANNOUNCE {
+		fmt.Println("[note]** Dropped an announcement out of its pass")
+		return
+	}
+	// check the exponents and shuffle of every hop, from what we announced
+	if !verifyHops(params, true) {
+		return
+	}
+	anonCoordinator.AnnouncementHops = params["hops"].([]byte)
+	anonCoordinator.AnnouncementServers = anonCoordinator.GetServerPublicKeys()
+	anonCoordinator.RecordSetup()
+	anonCoordinator.RecordPass(transcript.ANNOUNCEMENT, params)
 	g := util.DecodePoint(anonCoordinator.Suite, params["g"].([]byte))
 	anonCoordinator.LRSBase = lrs.CreateBase(util.PointToBigInt(g))
 
@@ -92,40 +133,222 @@ func handleAnnouncement(params map[string]interface{}) {
 
 	//construct Decrypted reputation map
 	keyList := util.ProtobufDecodePointList(params["keys"].([]byte))
-	valList := util.ProtobufDecodePointList(params["vals"].([]byte))
-	anonCoordinator.EndingCommMap = make(map[string]abstract.Point)
+	records := bridge.SplitRecords(util.ProtobufDecodePointList(params["vals"].([]byte)), len(keyList))
+	anonCoordinator.EndingCommMap = make(map[string][]abstract.Point)
 	anonCoordinator.EndingKeyMap = make(map[string]abstract.Point)
-	anonCoordinator.ReputationDiffMap = make(map[string]int)
+	anonCoordinator.Tally = bridge.NewTally(anonCoordinator.Policy)
+	anonCoordinator.VoteLog = nil
+	anonCoordinator.PostCounts = make(map[string]int)
+	anonCoordinator.Quotas.Reset()
+	anonCoordinator.Admission.NewRound()
 	anonCoordinator.AllClientsPublicKeys = keyList
 
 	for i := 0; i < len(keyList); i++ {
-		anonCoordinator.AddIntoEndingMap(keyList[i], valList[i])
+		anonCoordinator.AddIntoEndingMap(keyList[i], records[i])
 	}
 
-	// distribute g and table to clients
-	pm := map[string]interface{}{
+	// commit to the table with a Merkle tree and sign its root
+	tree := bridge.TableTree(keyList, util.ProtobufDecodePointList(params["vals"].([]byte)))
+	root := map[string]interface{}{
+		"epoch": anonCoordinator.Epoch,
 		"g": params["g"].([]byte),
-		"keys": params["keys"].([]byte),
-		"vals": params["vals"].([]byte),
 		"GT": params["GT"].([]byte),
 		"HT": params["HT"].([]byte),
+		"table_root": tree.Root(),
+		"table_size": tree.Size(),
+	}
+	root["table_signature"] = anonCoordinator.SignMessage(bridge.MessageOfTableRoot(root))
+	anonCoordinator.TableTree = tree
+
+	// distribute g and the signed root to clients, which fetch their own record
+	pm := make(map[string]interface{})
+	for name,val := range root {
+		pm[name] = val
 	}
 	event := &proto.Event{EventType:proto.ANNOUNCEMENT_FINALIZE, Params:pm}
+	anonCoordinator.SignEvent(event)
 	for _,addr := range anonCoordinator.Clients {
 		util.SendEvent(anonCoordinator.LocalAddr, addr, event)
 	}
 
-	// distribute g adn table to servers
-	// event = &proto.Event{EventType:proto.ANNOUNCEMENT_FINALIZE, Params:pm}
+	// distribute g and the whole table to servers
+	root["keys"] = params["keys"].([]byte)
+	root["vals"] = params["vals"].([]byte)
+	anonCoordinator.Table = root
+	pm = make(map[string]interface{})
+	for name,val := range root {
+		pm[name] = val
+	}
+	event = &proto.Event{EventType:proto.ANNOUNCEMENT_FINALIZE, Params:pm}
+	anonCoordinator.SignEvent(event)
 	for _,server := range anonCoordinator.ServerList {
 		util.SendEvent(anonCoordinator.LocalAddr, server.Addr, event)
 	}
 
-	// set controller's new g
+	// set controller's new g, keeping the old one for bridge re-binding
+	anonCoordinator.PrevG = anonCoordinator.G
 	anonCoordinator.G = g
 	anonCoordinator.Status = MESSAGE
 }
 
+// check the chain of hops of a pass, and restart the pass without the
+// faulty hop if it fails
+func verifyHops(params map[string]interface{}, announcement bool) bool {
+	phase := proto.ROUND_END
+	if announcement {
+		phase = proto.ANNOUNCEMENT
+	}
+	// the hop that handed us the chain
+	nServers := len(anonCoordinator.ServerList)
+	last := 0
+	if announcement {
+		last = nServers - 1
+	}
+	hops := []map[string]interface{}{}
+	if data, ok := params["hops"].([]byte); ok {
+		hops = bridge.DecodeHops(data)
+	}
+	bad, err := bridge.FirstBadHop(anonCoordinator.Suite, hops, anonCoordinator.PassStart, params,
+		anonCoordinator.GetServerPublicKeys(), announcement)
+	if err == nil {
+		return true
+	}
+	// the i-th hop is sent by the i-th server of the pass, which runs backwards
+	// in round end. The last hop could have forged a hop not signed by its server.
+	faulty := last
+	if bad >= 0 && bad < nServers {
+		faulty = bad
+		if !announcement {
+			faulty = nServers - 1 - bad
+		}
+		if !bridge.SignedBy(anonCoordinator.Suite, hops[bad], anonCoordinator.GetServerPublicKey(faulty)) {
+			faulty = last
+		}
+	}
+	fmt.Println("[note]** Server " + anonCoordinator.ServerList[faulty].Addr.String() + " is faulty: " + err.Error())
+	anonCoordinator.ServerList[faulty].Faulty = true
+	restartPass(phase, faulty)
+	return false
+}
+
+// a server reports that its previous hop in a pass sent proofs that fail.
+// We check the evidence ourselves: if the signed hop fails, its sender is
+// faulty, otherwise the blame is false and the accuser is. Then the pass
+// restarts from what we sent to its first hop.
+func handleBlame(params map[string]interface{}, addr *net.TCPAddr) {
+	accuser := anonCoordinator.GetServerIndex(addr)
+	if accuser < 0 {
+		fmt.Println("[note]** Dropped a blame from unknown server " + addr.String())
+		return
+	}
+	phase := params["phase"].(int)
+	evidence := params["evidence"].([]byte)
+	reason := params["reason"].(string)
+	err := util.ElGamalVerify(anonCoordinator.Suite, bridge.MessageOfBlame(phase, evidence, reason),
+		anonCoordinator.GetServerPublicKey(accuser), params["signature"].([]byte), nil)
+	if err != nil {
+		fmt.Println("[note]** Dropped an unsigned blame from " + addr.String())
+		return
+	}
+	if (phase == proto.ANNOUNCEMENT && anonCoordinator.Status != ANNOUNCE) ||
+		(phase == proto.ROUND_END && anonCoordinator.Status != TALLY_AGREED) {
+		fmt.Println("[note]** Dropped a blame out of its pass from " + addr.String())
+		return
+	}
+
+	// the accuser received the hop from its predecessor in the pass,
+	// which runs backwards in round end
+	accused := accuser - 1
+	if phase == proto.ROUND_END {
+		accused = accuser + 1
+	}
+	faulty := accuser
+	if accused >= 0 && accused < len(anonCoordinator.ServerList) {
+		hops := bridge.DecodeHops(evidence)
+		if len(hops) == 1 && bridge.CheckBlame(anonCoordinator.Suite, hops[0],
+			anonCoordinator.GetServerPublicKey(accused), phase == proto.ANNOUNCEMENT) {
+			faulty = accused
+		}
+	}
+	fmt.Println("[note]** Server " + anonCoordinator.ServerList[faulty].Addr.String() + " is faulty: " + reason)
+	anonCoordinator.ServerList[faulty].Faulty = true
+	restartPass(phase, faulty)
+}
+
+// send the start of the pass again, without the faulty server if we may drop it.
+// A faulty server stays in the chain in round end, so a pass failing too often
+// aborts the round.
+func restartPass(phase int, faulty int) {
+	anonCoordinator.PassRestarts++
+	if anonCoordinator.PassRestarts > anonCoordinator.MaxPassRestarts {
+		abortRound("pass failed too many times")
+		return
+	}
+	if phase == proto.ANNOUNCEMENT && anonCoordinator.DropFaultyServers &&
+		len(anonCoordinator.ServerList) > anonCoordinator.MinServers {
+		// in round end every server has to take its round key off the keys
+		fmt.Println("[note]** Dropped server " + anonCoordinator.ServerList[faulty].Addr.String() + " from the chain")
+		anonCoordinator.RemoveServer(faulty)
+	}
+	fmt.Println("[debug] Restarting the pass", anonCoordinator.PassRestarts, "time(s)")
+	event := &proto.Event{EventType:phase, Params:anonCoordinator.PassStart}
+	if phase == proto.ANNOUNCEMENT {
+		util.SendEvent(anonCoordinator.LocalAddr, anonCoordinator.GetFirstServerAddr(), event)
+	} else {
+		// signed again, servers drop a start they have already seen
+		anonCoordinator.SignEvent(event)
+		util.SendEvent(anonCoordinator.LocalAddr, anonCoordinator.GetLastServerAddr(), event)
+	}
+}
+
+// hand the chain of hops of this round's announcement to a client checking the
+// shuffles, with the keys of the servers which made them in order
+func handleShuffleProofsRequest(params map[string]interface{}, addr *net.TCPAddr) {
+	servers := [][]byte{}
+	for _,key := range anonCoordinator.AnnouncementServers {
+		servers = append(servers, util.EncodePoint(key))
+	}
+	pm := map[string]interface{}{
+		"hops": anonCoordinator.AnnouncementHops,
+		"servers": util.Encode2DByteArray(servers),
+	}
+	event := &proto.Event{EventType:proto.SHUFFLE_PROOFS, Params:pm}
+	anonCoordinator.SignEvent(event)
+	util.SendEvent(anonCoordinator.LocalAddr, addr, event)
+}
+
+// hand a client its record of this round's table with its path in the
+// Merkle tree, or the whole table if it does not name its nym
+func handleTableRequest(params map[string]interface{}, addr *net.TCPAddr) {
+	if anonCoordinator.TableTree == nil {
+		return
+	}
+	pm := map[string]interface{}{}
+	if byteNym, ok := params["nym"].([]byte); ok {
+		nym := util.DecodePoint(anonCoordinator.Suite, byteNym)
+		index := util.FindIndexWithinKeyList(anonCoordinator.AllClientsPublicKeys, nym)
+		if index < 0 {
+			fmt.Println("[note] Can not find nym within keyList")
+			return
+		}
+		pm["index"] = index
+		pm["key"] = byteNym
+		pm["record"] = util.ProtobufEncodePointList(anonCoordinator.EndingCommMap[nym.String()])
+		pm["path"] = util.Encode2DByteArray(anonCoordinator.TableTree.Prove(index))
+	} else {
+		// the whole table with its signed root and what reputation proofs are
+		// checked with, so that third parties can check membership tokens of
+		// the round against this event alone
+		for name,val := range anonCoordinator.Table {
+			pm[name] = val
+		}
+		anonCoordinator.AddFujiOkamParams(pm)
+	}
+	event := &proto.Event{EventType:proto.TABLE, Params:pm}
+	anonCoordinator.SignEvent(event)
+	util.SendEvent(anonCoordinator.LocalAddr, addr, event)
+}
+
 // handle server register request
 func handleServerRegister(params map[string]interface{}, addr *net.TCPAddr) {
 	fmt.Println("[debug] Receive the registration info from server " + addr.String());
@@ -133,6 +356,60 @@ func handleServerRegister(params map[string]interface{}, addr *net.TCPAddr) {
 	publicKey := anonCoordinator.Suite.Point()
 	publicKey.UnmarshalBinary(params["public_key"].([]byte))
 
+	// ask the server to prove it holds the private key
+	nonce := anonCoordinator.AddPendingServer(PendingServerKey(connHost, addr), addr, publicKey)
+	pm := map[string]interface{}{
+		"nonce": nonce,
+	}
+	event := &proto.Event{EventType:proto.SERVER_CHALLENGE, Params:pm}
+	util.SendEvent(anonCoordinator.LocalAddr, addr, event)
+}
+
+// check the signed nonce, then admit a trusted server or leave it to the operator
+func handleServerChallengeResponse(params map[string]interface{}, addr *net.TCPAddr) {
+	key := PendingServerKey(connHost, addr)
+	server := anonCoordinator.GetPendingServer(key)
+	if server == nil || server.Proved {
+		fmt.Println("[note]** Unexpected challenge response from " + addr.String())
+		return
+	}
+	msg := bridge.MessageOfServerChallenge(server.Nonce, addr.String())
+	err := util.ElGamalVerify(anonCoordinator.Suite, msg, server.PublicKey, params["signature"].([]byte), nil)
+	if err != nil {
+		anonCoordinator.TakePendingServer(key)
+		refuseServer(addr, "fails to prove the private key")
+		return
+	}
+	if anonCoordinator.IsTrustedServer(server.PublicKey) {
+		anonCoordinator.TakePendingServer(key)
+		admitServer(server)
+		return
+	}
+	anonCoordinator.MarkServerProved(server)
+	fmt.Println("[coordinator] Unknown server " + addr.String() + " with public key " + hex.EncodeToString(util.EncodePoint(server.PublicKey)))
+	fmt.Println("[coordinator] Type 'approve " + addr.String() + "' or 'reject " + addr.String() + "'")
+}
+
+func refuseServer(addr *net.TCPAddr, reason string) {
+	fmt.Println("[note]** Refused server " + addr.String() + ": " + reason)
+	pm := map[string]interface{}{
+		"reason": reason,
+	}
+	event := &proto.Event{EventType:proto.SERVER_REGISTER_REFUSED, Params:pm}
+	util.SendEvent(anonCoordinator.LocalAddr, addr, event)
+}
+
+// servers can be admitted by the handler and the admin interface at the same time
+var admitLock sync.Mutex
+
+// link the server to the end of the chain
+func admitServer(server *PendingServer) {
+	admitLock.Lock()
+	defer admitLock.Unlock()
+	addr := server.Addr
+	publicKey := server.PublicKey
+	fmt.Println("[debug] Admitted server " + addr.String())
+
 	lastServer := anonCoordinator.GetLastServerAddr()
 
 	// link new server to the next_hop of last server
@@ -142,6 +419,7 @@ func handleServerRegister(params map[string]interface{}, addr *net.TCPAddr) {
 			"next_hop": addr.String(),
 		}
 		event2 := &proto.Event{EventType:proto.UPDATE_NEXT_HOP, Params:pm2}
+		anonCoordinator.SignEvent(event2)
 		util.SendEvent(anonCoordinator.LocalAddr, lastServer, event2)
 	}
 
@@ -156,6 +434,7 @@ func handleServerRegister(params map[string]interface{}, addr *net.TCPAddr) {
 		"reply": true,
 		"prev_server": lastServer.String(),
 		"h": byteH,
+		"policy": bridge.EncodePolicy(anonCoordinator.Policy),
 		"n": fujiokamBase.N.Bytes(),
 		"g1": fujiokamBase.G1.ToBinary(),
 		"g2": fujiokamBase.G2.ToBinary(),
@@ -166,6 +445,7 @@ func handleServerRegister(params map[string]interface{}, addr *net.TCPAddr) {
 		"h1": fujiokamBase.H1.ToBinary(),
 	}
 	event1 := &proto.Event{EventType:proto.SERVER_REGISTER_REPLY, Params:pm1}
+	anonCoordinator.SignEvent(event1)
 	util.SendEvent(anonCoordinator.LocalAddr, addr, event1)
 
 	anonCoordinator.AddServer(addr, publicKey)
@@ -176,50 +456,113 @@ func handleUpdatePedersenH(params map[string]interface{}) {
 	util.CheckErr(err)
 }
 
+var ErrRoundAborted = errors.New("the round the client would have joined was aborted")
+
+// tell the client why it is refused, with the difficulty and challenge
+// of the proof of work it can retry with, and whether to simply retry
+func refuseRegistration(err error, addr *net.TCPAddr) {
+	fmt.Println("[note]** Refused registration from " + addr.String() + ": " + err.Error())
+	pm := map[string]interface{}{
+		"reason": err.Error(),
+		"difficulty": anonCoordinator.Admission.Difficulty(),
+		"challenge": anonCoordinator.Admission.Challenge(),
+		"retry": err == ErrRoundAborted,
+	}
+	event := &proto.Event{EventType:proto.CLIENT_REGISTER_REFUSED, Params:pm}
+	anonCoordinator.SignEvent(event)
+	util.SendEvent(anonCoordinator.LocalAddr, addr, event)
+}
+
 // Handler for REGISTER event
 // send the register request to server to do encryption
 func handleClientRegisterControllerSide(params map[string]interface{}, addr *net.TCPAddr) {
 	// get client's public key
 	publicKey := anonCoordinator.Suite.Point()
 	publicKey.UnmarshalBinary(params["public_key"].([]byte))
+
+	// refuse the client before committing any credit for it
+	if anonCoordinator.RegisteredKeys[publicKey.String()] {
+		refuseRegistration(admission.ErrDuplicateKey, addr)
+		return
+	}
+	if err := anonCoordinator.Admission.Admit(params); err != nil {
+		refuseRegistration(err, addr)
+		return
+	}
+	anonCoordinator.RegisteredKeys[publicKey.String()] = true
+	anonCoordinator.NewClientKeys = append(anonCoordinator.NewClientKeys, publicKey)
 	anonCoordinator.AddClient(publicKey, addr)
 
-	// compute Pedersen commitment
-	xInit := anonCoordinator.Suite.Secret().SetInt64(int64(bridge.StartingCredit))
-	PComm, r := anonCoordinator.PedersenBase.Commit(xInit)
-	byteR, err := r.MarshalBinary()
-	util.CheckErr(err)
+	// compute Pedersen commitment for each dimension
+	xInit := anonCoordinator.Suite.Secret().SetInt64(int64(anonCoordinator.Policy.InitialCredit))
+	dims := anonCoordinator.Policy.NumDimensions()
+	PComm := make([]abstract.Point, dims)
+	r := make([]abstract.Secret, dims)
+	for i := 0; i < dims; i++ {
+		PComm[i], r[i] = anonCoordinator.PedersenBase.Commit(xInit)
+	}
 
 	// send register info to the first server
 	firstServer := anonCoordinator.GetFirstServerAddr()
+	bytePComm := util.ProtobufEncodePointList(PComm)
+	anonCoordinator.AdmittedRegistrations[hex.EncodeToString(bytePComm)] = addr.String()
 	pm := map[string]interface{}{
 		"public_key": params["public_key"],
 		"addr": addr.String(),
-		"pcomm": util.EncodePoint(PComm),
+		"pcomm": bytePComm,
+		// servers check the record opens to the initial credit, r stays with the client
+		"pcomm_proofs": util.Encode2DByteArray(bridge.ProveInitialCredit(anonCoordinator.PedersenBase, PComm, r, anonCoordinator.Policy.InitialCredit)),
 	}
 	event := &proto.Event{EventType:proto.CLIENT_REGISTER_SERVERSIDE, Params:pm}
 	util.SendEvent(anonCoordinator.LocalAddr, firstServer, event)
 
 	// send initial r to client
 	pm = map[string]interface{}{
-		"r": byteR,
+		"r": util.ProtobufEncodeSecretList(r),
 		"g": util.EncodePoint(anonCoordinator.G),
+		"credit": anonCoordinator.Policy.InitialCredit,
 	}
 	event = &proto.Event{EventType:proto.INIT_PEDERSEN_R, Params:pm}
+	anonCoordinator.SignEvent(event)
 	util.SendEvent(anonCoordinator.LocalAddr, addr, event)
 }
 
+// check that a registration comes from the last server of the chain and
+// is one we admitted, then take it away so that it is used once
+func checkClientRegister(params map[string]interface{}, senderAddr *net.TCPAddr) bool {
+	last := len(anonCoordinator.ServerList) - 1
+	if last < 0 || connHost != anonCoordinator.ServerList[last].Addr.IP.String() ||
+		senderAddr.String() != anonCoordinator.ServerList[last].Addr.String() {
+		fmt.Println("[note]** Registration does not come from the last server, dropped")
+		return false
+	}
+	sig, ok := params["signature"].([]byte)
+	if !ok || util.ElGamalVerify(anonCoordinator.Suite, bridge.MessageOfClientRegister(params),
+		anonCoordinator.GetServerPublicKey(last), sig, nil) != nil {
+		fmt.Println("[note]** Registration is not signed by the last server, dropped")
+		return false
+	}
+	key := hex.EncodeToString(params["pcomm"].([]byte))
+	if addr, ok := anonCoordinator.AdmittedRegistrations[key]; !ok || addr != params["addr"].(string) {
+		fmt.Println("[note]** Registration was not admitted by us, dropped")
+		return false
+	}
+	delete(anonCoordinator.AdmittedRegistrations, key)
+	return true
+}
+
 // handle client register successful event
-func handleClientRegisterServerSide(params map[string]interface{}) {
+func handleClientRegisterServerSide(params map[string]interface{}, senderAddr *net.TCPAddr) {
+	if !checkClientRegister(params, senderAddr) {
+		return
+	}
 	// get public key from params (it's one-time nym actually)
 	var nym = anonCoordinator.Suite.Point()
 	byteNym := params["public_key"].([]byte)
 	nym.UnmarshalBinary(byteNym)
 
-	// get PComm
-	var PComm = anonCoordinator.Suite.Point()
-	err := PComm.UnmarshalBinary(params["pcomm"].([]byte))
-	util.CheckErr(err)
+	// get PComm of each dimension
+	PComm := util.ProtobufDecodePointList(params["pcomm"].([]byte))
 
 	// encode h from Pedersen Commitment base
 	// byteHT, err := anonCoordinator.PedersenBase.HT.MarshalBinary()
@@ -241,10 +584,12 @@ func handleClientRegisterServerSide(params map[string]interface{}) {
 		"g6": fujiokamBase.G6.ToBinary(),
 		"h1": fujiokamBase.H1.ToBinary(),
 		"honesty_prf": util.ProtobufEncodeBigIntList(anonCoordinator.AllGnHonestyProofPublic),
+		"policy": bridge.EncodePolicy(anonCoordinator.Policy),
 		// "h": byteHT,
 		"public_key": bytePublicKey,
 	}
 	event := &proto.Event{EventType:proto.CLIENT_REGISTER_CONFIRMATION, Params:pm}
+	anonCoordinator.SignEvent(event)
 	util.SendEvent(anonCoordinator.LocalAddr, addr, event)
 
 	// instead of sending new client to server, we will send it when finishing this round. Currently we just add it into buffer
@@ -261,10 +606,17 @@ func handleGnHonestyChallenge(params map[string]interface{}, senderAddr *net.TCP
 		"honesty_ans": util.ProtobufEncodeBigIntList(answer),
 	}
 	event := &proto.Event{EventType:proto.GN_HONESTY_ANSWER, Params:pm}
+	anonCoordinator.SignEvent(event)
 	util.SendEvent(anonCoordinator.LocalAddr, senderAddr, event)
 }
 // verify the posting message and record the bridge
 func handlePostBridge(params map[string]interface{}, senderAddr *net.TCPAddr) {
+	if !checkConnQuota(quota.POST, senderAddr) {
+		return
+	}
+	if !checkEpoch(params) {
+		return
+	}
 	// get info from the request
 	bridgeAddr := params["bridge_addr"].(string)
 	byteSig := params["signature"].([]byte)
@@ -282,15 +634,142 @@ func handlePostBridge(params map[string]interface{}, senderAddr *net.TCPAddr) {
 		fmt.Print("[note]** Fails to verify the message...")
 		return
 	}
+	if !checkNymQuota(quota.POST, nym, senderAddr) {
+		return
+	}
 
-	// record the bridge
-	// Note: we assume the client does not provide duplicated bridges
-	anonCoordinator.AddBridge(bridgeAddr, nym)
+	// only providers with enough reputation can post, up to the quota of their level
+	if !checkPostReputation(params, nym) {
+		return
+	}
+	// renewing a bridge does not take a new slot of the quota
+	isNew := !anonCoordinator.BridgePool.Contains(bridgeAddr)
+	if isNew && !anonCoordinator.CanPost(nym, params["ind"].(int)) {
+		fmt.Println("[note]** Posting quota of the level exceeded")
+		replyQuotaExceeded(quota.POST, senderAddr)
+		return
+	}
+
+	// record the bridge, rejecting the same address posted by another nym
+	err = anonCoordinator.BridgePool.Post(bridgeAddr, nym)
+	if err != nil {
+		fmt.Println("[note]** Fails to add bridge " + bridgeAddr + ": " + err.Error())
+		return
+	}
+	if isNew {
+		anonCoordinator.CountPost(nym)
+	}
 	fmt.Println("[debug] Finished adding bridge " + bridgeAddr)
 }
 
+// check the proof that nym reaches the minimum reputation to post or re-bind bridges
+func checkPostReputation(params map[string]interface{}, nym abstract.Point) bool {
+	ind := params["ind"].(int)
+	if ind < anonCoordinator.Policy.PostMinimum || params["dim"].(int) != anonCoordinator.Policy.PostDimension() {
+		fmt.Println("[note]** Indicator is below the minimum to post")
+		return false
+	}
+	PComm := bridge.CommOfDimension(anonCoordinator.EndingCommMap[nym.String()], params)
+	if !bridge.VerifyInd(params, PComm, anonCoordinator.Policy, anonCoordinator.Suite, anonCoordinator.PedersenBase, anonCoordinator.FujiOkamBase) {
+		fmt.Println("[note]** Fails to verify the proof...")
+		return false
+	}
+	return true
+}
+
+// reject messages signed in another round
+func checkEpoch(params map[string]interface{}) bool {
+	if bridge.CheckEpoch(params, anonCoordinator.Epoch) {
+		return true
+	}
+	fmt.Println("[note]** Message is not signed for round", anonCoordinator.Epoch)
+	return false
+}
+
+// count an action from the registered client or the host of the connection,
+// checked before any signature
+func checkConnQuota(action string, addr *net.TCPAddr) bool {
+	key := anonCoordinator.ConnQuotaKey(connHost, addr)
+	if anonCoordinator.Quotas.AllowConn(action, key) {
+		return true
+	}
+	fmt.Println("[note]** Quota of " + action + " exceeded by " + key)
+	replyQuotaExceeded(action, addr)
+	return false
+}
+
+// count an action from a nym, checked after its signature but before any proof
+func checkNymQuota(action string, nym abstract.Point, addr *net.TCPAddr) bool {
+	if anonCoordinator.Quotas.AllowNym(action, nym.String()) {
+		return true
+	}
+	fmt.Println("[note]** Quota of " + action + " exceeded by nym")
+	replyQuotaExceeded(action, addr)
+	return false
+}
+
+// tell the sender its action was dropped, unless it claims an address of
+// another host, so that nobody can direct the replies to a third party
+func replyQuotaExceeded(action string, addr *net.TCPAddr) {
+	if addr.IP.String() != connHost {
+		fmt.Println("[note]** Sender claims another host than " + connHost + ", not replying")
+		return
+	}
+	pm := map[string]interface{}{
+		"action": action,
+	}
+	event := &proto.Event{EventType:proto.QUOTA_EXCEEDED, Params:pm}
+	anonCoordinator.SignEvent(event)
+	util.SendEvent(anonCoordinator.LocalAddr, addr, event)
+}
+
+// move a bridge posted in earlier rounds to its provider's new nym
+func handleRebindBridge(params map[string]interface{}, senderAddr *net.TCPAddr) {
+	if !checkEpoch(params) {
+		return
+	}
+	bridgeAddr := params["bridge_addr"].(string)
+	oldNym := util.DecodePoint(anonCoordinator.Suite, params["old_nym"].([]byte))
+	nym := util.DecodePoint(anonCoordinator.Suite, params["nym"].([]byte))
+
+	fmt.Println("[debug] Receiving re-binding from " + senderAddr.String() + ": " + bridgeAddr)
+
+	// the provider proves it owns both nyms by signing under last round's g and the current g
+	if anonCoordinator.PrevG == nil {
+		fmt.Println("[note]** No previous round to re-bind from")
+		return
+	}
+	byteMsg := bridge.MessageOfRebindBridge(params)
+	err := util.ElGamalVerify(anonCoordinator.Suite, byteMsg, oldNym, params["old_signature"].([]byte), anonCoordinator.PrevG)
+	if err != nil {
+		fmt.Println("[note]** Fails to verify the signature of old nym...")
+		return
+	}
+	err = util.ElGamalVerify(anonCoordinator.Suite, byteMsg, nym, params["signature"].([]byte), anonCoordinator.G)
+	if err != nil {
+		fmt.Println("[note]** Fails to verify the signature of new nym...")
+		return
+	}
+	if !checkPostReputation(params, nym) {
+		return
+	}
+
+	err = anonCoordinator.BridgePool.Rebind(bridgeAddr, oldNym, nym)
+	if err != nil {
+		fmt.Println("[note]** Fails to re-bind bridge " + bridgeAddr + ": " + err.Error())
+		return
+	}
+	fmt.Println("[debug] Finished re-binding bridge " + bridgeAddr)
+}
+
 // allocate bridges and ask all servers' signatures
 func handleRequestBridges(params map[string]interface{}, senderAddr *net.TCPAddr) {
+	if !checkConnQuota(quota.REQUEST, senderAddr) {
+		return
+	}
+	if !checkEpoch(params) {
+		return
+	}
 	// get info from the request
 	ind := params["ind"].(int)
 	byteSig := params["signature"].([]byte)
@@ -298,7 +777,7 @@ func handleRequestBridges(params map[string]interface{}, senderAddr *net.TCPAddr
 	byteNymR := params["nym"].([]byte)
 	err := nymR.UnmarshalBinary(byteNymR)
 	util.CheckErr(err)
-	PCommr := anonCoordinator.EndingCommMap[nymR.String()]
+	PCommr := bridge.CommOfDimension(anonCoordinator.EndingCommMap[nymR.String()], params)
 
 	fmt.Println("[debug] Receiving reqeust from " + senderAddr.String() + ": " + strconv.Itoa(ind))
 
@@ -310,8 +789,11 @@ func handleRequestBridges(params map[string]interface{}, senderAddr *net.TCPAddr
 		return
 	}
 	fmt.Println("[debug] Signature check passed")
+	if !checkNymQuota(quota.REQUEST, nymR, senderAddr) {
+		return
+	}
 
-	if !bridge.VerifyInd(params, PCommr, anonCoordinator.Suite, anonCoordinator.PedersenBase, anonCoordinator.FujiOkamBase) {
+	if !bridge.VerifyInd(params, PCommr, anonCoordinator.Policy, anonCoordinator.Suite, anonCoordinator.PedersenBase, anonCoordinator.FujiOkamBase) {
 		fmt.Print("[note]** Fails to verify the proof...")
 		return
 	}
@@ -329,32 +811,22 @@ func handleRequestBridges(params map[string]interface{}, senderAddr *net.TCPAddr
 	// sign them using coordinator's private key
 	sigs := [][]byte{}
 	for _,assignment := range assignments {
-		byteAssignment := bridge.EncodeAssignment(&assignment)
-		sig := anonCoordinator.SignMessage(byteAssignment)
+		sig := anonCoordinator.SignMessage(bridge.MessageOfAssignment(&assignment))
 		sigs = append(sigs, sig)
 	}
 
 	// create entries for these assignments, waiting for other servers' signatures
 	nServers := len(anonCoordinator.ServerList)
 	for i,assignment := range assignments {
-		brdgAddr := assignment.Addr
-		anonCoordinator.InitAssignmentSignatures(brdgAddr)
+		key := bridge.AssignmentKey(&assignment)
+		anonCoordinator.InitAssignmentSignatures(key)
 		// append coordinator's own signature to the end
-		anonCoordinator.AddAssignmentSignature(brdgAddr, nServers, sigs[i])
+		anonCoordinator.AddAssignmentSignature(key, nServers, sigs[i])
 	}
 
-	pm := map[string]interface{}{
-		"assignments" : bridge.EncodeAssignmentList(assignments),
-		"ind": ind,
-		"nym" : params["nym"].([]byte),
-		"FOCommd": params["FOCommd"].([]byte),
-		"PCommd": params["PCommd"].([]byte),
-		"PCommind": params["PCommind"].([]byte),
-		"rind": params["rind"].([]byte),
-		"arg_nonneg": params["arg_nonneg"].([]byte),
-		"arg_equal": params["arg_equal"].([]byte),
-	}
+	pm := bridge.SignAssignmentsParams(assignments, params)
 	event := &proto.Event{EventType:proto.SIGN_ASSIGNMENTS, Params:pm}
+	anonCoordinator.SignEvent(event)
 	// send to all the servers
 	for _,server := range anonCoordinator.ServerList {
 		util.SendEvent(anonCoordinator.LocalAddr, server.Addr, event)
@@ -380,23 +852,21 @@ func handleGotSignatures(params map[string]interface{}, senderAddr *net.TCPAddr)
 
 	for i,assignment := range assignments {
 		sig := sigs[i]
-		brdgAddr := assignment.Addr
+		key := bridge.AssignmentKey(&assignment)
 		// update each assignment's log entry by inserting the signature and increase count
-		anonCoordinator.AddAssignmentSignature(brdgAddr, serverIndex, sig)
+		anonCoordinator.AddAssignmentSignature(key, serverIndex, sig)
 
 		// if all servers have replied signatures for this assignment
-		if anonCoordinator.FinishCollectingAssignmentSignatures(brdgAddr) {
-			fmt.Println("[debug] collected all signatures for", brdgAddr)
-
-			// mark the bridge as used
-			info := anonCoordinator.Bridges[brdgAddr]
-			newInfo := BridgeInfo{Nym:info.Nym, Used:true}
-			anonCoordinator.Bridges[brdgAddr] = newInfo
-			
-			// send the signatures to the requester client
+		if anonCoordinator.FinishCollectingAssignmentSignatures(key) {
+			fmt.Println("[debug] collected all signatures for", key)
+			// only a completed assignment counts against the bridge's cap
+			anonCoordinator.BridgePool.Complete(anonCoordinator.AssignedAddrs[key])
+
+			// send the signatures and sealed address to the requester client
 			pm := map[string]interface{}{
 				"assignment": bridge.EncodeAssignment(&assignment),
-				"signatures": util.Encode2DByteArray(anonCoordinator.GetAssignmentSignatures(brdgAddr)),
+				"signatures": util.Encode2DByteArray(anonCoordinator.GetAssignmentSignatures(key)),
+				"sealed_addr": anonCoordinator.SealedAddrs[key],
 			}
 			// sign signatures
 			msg := bridge.MessageOfGotSignatures(pm)
@@ -404,6 +874,7 @@ func handleGotSignatures(params map[string]interface{}, senderAddr *net.TCPAddr)
 			pm["signature"] = byteSig
 			// send
 			event := &proto.Event{EventType:proto.GOT_SIGNS, Params:pm}
+			anonCoordinator.SignEvent(event)
 			util.SendEvent(anonCoordinator.LocalAddr, requesterIP, event)
 		}
 	}
@@ -493,6 +964,17 @@ func handleGotSignatures(params map[string]interface{}, senderAddr *net.TCPAddr)
 // }
 
 func handleVote(params map[string]interface{}, senderAddr *net.TCPAddr) {
+	// the tally is closed once the round end starts
+	if anonCoordinator.Status == TALLY || anonCoordinator.Status == TALLY_AGREED {
+		fmt.Println("[note] Vote arrives after the tally is closed")
+		return
+	}
+	if !checkConnQuota(quota.VOTE, senderAddr) {
+		return
+	}
+	if !checkEpoch(params) {
+		return
+	}
 	// fetch nym
 	nym := anonCoordinator.Suite.Point()
 	err := nym.UnmarshalBinary(params["nym"].([]byte))
@@ -514,33 +996,111 @@ func handleVote(params map[string]interface{}, senderAddr *net.TCPAddr) {
 		fmt.Println("[note] Fails to verify overall signature")
 		return
 	}
+	if !checkNymQuota(quota.VOTE, nym, senderAddr) {
+		return
+	}
 
 	// verify each server's signature
 	signatures := util.Decode2DByteArray(params["signatures"].([]byte))
 	byteAssignment := params["assignment"].([]byte)
 	assignment := bridge.DecodeAssignment(byteAssignment)
+	if assignment.Epoch != anonCoordinator.Epoch {
+		fmt.Println("[note] Assignment was made in another round")
+		return
+	}
+	msgAssignment := bridge.MessageOfAssignment(assignment)
 	numServers := len(anonCoordinator.ServerList)
 	for i := 0; i < numServers; i++ {
 		signature := signatures[i]
 		serverPublicKey := anonCoordinator.GetServerPublicKey(i)
-		err = util.ElGamalVerify(anonCoordinator.Suite, byteAssignment, serverPublicKey, signature, anonCoordinator.Suite.Point())
+		err = util.ElGamalVerify(anonCoordinator.Suite, msgAssignment, serverPublicKey, signature, nil)
 		if err != nil {
 			fmt.Println("[note] Fails to verify server's signature")
 			return
 		}
 	}
 	// verify coordinator's own signature
-	err = util.ElGamalVerify(anonCoordinator.Suite, byteAssignment, anonCoordinator.PublicKey, signatures[numServers], anonCoordinator.Suite.Point())
+	err = util.ElGamalVerify(anonCoordinator.Suite, msgAssignment, anonCoordinator.PublicKey, signatures[numServers], nil)
 	if err != nil {
 		fmt.Println("[note] Fails to verify coordinator's signature")
 		return
 	}
 	fmt.Println("[debug] All servers' signatures check passed")
 
-	// record feedback
-	targetNym := assignment.Nym
-	feedback := params["feedback"].(int)
-	anonCoordinator.ReputationDiffMap[targetNym.String()] += feedback
+	// record feedback, one vote for each assignment
+	category := bridge.Category(params["category"].(int))
+	if !category.Valid() {
+		fmt.Println("[note] Unknown feedback category")
+		return
+	}
+	if !assignment.NymR.Equal(nym) {
+		fmt.Println("[note] Voter is not the requester of the assignment")
+		return
+	}
+
+	// scale a weighted vote by the reputation level the voter proves
+	multiplier := anonCoordinator.Policy.UnweightedMultiplier()
+	if _, weighted := params["ind"]; weighted {
+		PCommr := bridge.CommOfDimension(anonCoordinator.EndingCommMap[nym.String()], params)
+		if !bridge.VerifyInd(params, PCommr, anonCoordinator.Policy, anonCoordinator.Suite, anonCoordinator.PedersenBase, anonCoordinator.FujiOkamBase) {
+			fmt.Println("[note] Fails to verify the voter's reputation")
+			return
+		}
+		multiplier = anonCoordinator.Policy.VoteMultiplier(params["ind"].(int))
+	}
+
+	if !anonCoordinator.Tally.Record(assignment, category, multiplier) {
+		fmt.Println("[note] Assignment has been voted")
+		return
+	}
+	anonCoordinator.Tally.CreditReport(assignment)
+	// keep the signed vote as evidence of the tally
+	anonCoordinator.VoteLog = append(anonCoordinator.VoteLog, params)
+	// every server tallies the vote on its own. Servers only take votes
+	// we signed, so sign a copy and keep the logged vote as the client sent it
+	pm := map[string]interface{}{}
+	for name,val := range params {
+		pm[name] = val
+	}
+	event := &proto.Event{EventType:proto.TALLY_VOTE, Params:pm}
+	anonCoordinator.SignEvent(event)
+	for _,server := range anonCoordinator.ServerList {
+		util.SendEvent(anonCoordinator.LocalAddr, server.Addr, event)
+	}
+	fmt.Println("[debug] Recorded feedback", category, "x", multiplier)
+}
+
+// collect a server's signature of the diff table
+func handleTallySignature(params map[string]interface{}, senderAddr *net.TCPAddr) {
+	serverIndex := anonCoordinator.GetServerIndex(senderAddr)
+	if serverIndex < 0 {
+		fmt.Println("Warning: can not find server: ", senderAddr)
+		return
+	}
+	if anonCoordinator.Status != TALLY {
+		return
+	}
+	if !params["success"].(bool) {
+		fmt.Println("[note]** Server " + senderAddr.String() + " disagrees with the tally")
+		anonCoordinator.TallyRefused = true
+		return
+	}
+	byteSig := params["signature"].([]byte)
+	msg := bridge.MessageOfDiffTable(anonCoordinator.Epoch, anonCoordinator.TallyKeys, anonCoordinator.TallyTable)
+	err := util.ElGamalVerify(anonCoordinator.Suite, msg, anonCoordinator.GetServerPublicKey(serverIndex), byteSig, nil)
+	if err != nil {
+		fmt.Println("[note]** Fails to verify the tally signature of " + senderAddr.String())
+		anonCoordinator.TallyRefused = true
+		return
+	}
+	anonCoordinator.TallySignatures[serverIndex] = byteSig
+	for _,sig := range anonCoordinator.TallySignatures {
+		if sig == nil {
+			return
+		}
+	}
+	fmt.Println("[debug] All servers agree on the tally")
+	anonCoordinator.Status = TALLY_AGREED
 }
 
 // verify the vote and reply to client
@@ -601,13 +1161,22 @@ func handleVote(params map[string]interface{}, senderAddr *net.TCPAddr) {
 // Handler for ROUND_END event
 // send user round end notification
 func handleRoundEnd(params map[string]interface{}) {
+	if anonCoordinator.Status != TALLY_AGREED {
+		fmt.Println("[note]** Dropped a round end out of its pass")
+		return
+	}
+	// check the exponents and shuffle of every hop, from the published update
+	if !verifyHops(params, false) {
+		return
+	}
+	anonCoordinator.RecordPass(transcript.ROUND_END, params)
 	// review reputation map
 	keyList := util.ProtobufDecodePointList(params["keys"].([]byte))
-	valList := util.ProtobufDecodePointList(params["vals"].([]byte))
-	anonCoordinator.BeginningCommMap = make(map[string]abstract.Point)
+	records := bridge.SplitRecords(util.ProtobufDecodePointList(params["vals"].([]byte)), len(keyList))
+	anonCoordinator.BeginningCommMap = make(map[string][]abstract.Point)
 	anonCoordinator.BeginningKeyMap = make(map[string]abstract.Point)
 	for i := 0; i < len(keyList); i++ {
-		anonCoordinator.BeginningCommMap[keyList[i].String()] = valList[i]
+		anonCoordinator.BeginningCommMap[keyList[i].String()] = records[i]
 		anonCoordinator.BeginningKeyMap[keyList[i].String()] = keyList[i]
 	}
 
@@ -618,26 +1187,36 @@ func handleRoundEnd(params map[string]interface{}) {
 	anonCoordinator.PedersenBase.HT = HT
 	// note: no need to tell clients yet
 
-	size := len(anonCoordinator.ReputationDiffMap)
+	// seal each nym's diffs, rDiffs and feedback to it, so that only its owner
+	// learns how it was rated, and publish the totals of the round
+	size := len(anonCoordinator.AppliedDiffMap)
 	keys := make([]abstract.Point,size)
-	diffs := make([]int, size)
+	sealed := make([][]byte, size)
+	diffs := make([][]int, size)
+	breakdowns := make([][]int, size)
 	i := 0
-	for k, v := range anonCoordinator.ReputationDiffMap {
+	for k, v := range anonCoordinator.AppliedDiffMap {
 		keys[i] = anonCoordinator.EndingKeyMap[k]
 		diffs[i] = v
+		breakdowns[i] = anonCoordinator.Tally.Breakdown(keys[i])
+		update := &bridge.Update{Diffs:v, RDiffs:anonCoordinator.AppliedRDiffMap[k], Breakdown:breakdowns[i]}
+		sealed[i] = bridge.SealUpdate(anonCoordinator.Suite, anonCoordinator.G, keys[i], update)
 		i++
 	}
-	byteKeys := util.ProtobufEncodePointList(keys)
-	byteDiffs := util.EncodeIntArray(diffs)
 	// send user round-end message
 	pm := map[string]interface{} {
-		"keys": byteKeys,
-		"diffs": byteDiffs,
+		"keys": util.ProtobufEncodePointList(keys),
+		"sealed": util.Encode2DByteArray(sealed),
+		"updated": size,
+		"total_diffs": util.EncodeIntArray(bridge.ColumnTotals(diffs, anonCoordinator.Policy.NumDimensions())),
+		"total_breakdown": util.EncodeIntArray(bridge.ColumnTotals(breakdowns, bridge.NumCategories)),
 	}
 	event := &proto.Event{EventType:proto.ROUND_END, Params:pm}
+	anonCoordinator.SignEvent(event)
 	for _, addr := range anonCoordinator.Clients {
 		util.SendEvent(anonCoordinator.LocalAddr, addr, event)
 	}
 	time.Sleep(500 * time.Millisecond)
+	anonCoordinator.JoiningClientKeys = nil
 	anonCoordinator.Status = READY_FOR_NEW_ROUND
 }
\ No newline at end of file
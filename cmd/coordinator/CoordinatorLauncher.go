@@ -3,17 +3,23 @@ package coordinator
 import (
 	"bufio"
 	"bytes"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"strings"
 	"time"
 
 	"zRep/primitive/fujiokam"
 	"zRep/primitive/pedersen"
 	"zRep/proto"
 	"zRep/util"
+	"zRep/cmd/admission"
+	"zRep/cmd/bridge"
+	"zRep/cmd/quota"
+	"zRep/cmd/transcript"
 
 	"github.com/dedis/crypto/abstract"
 	"github.com/dedis/crypto/nist"
@@ -35,7 +41,7 @@ func startServerListener(listener *net.TCPListener) {
 		util.CheckErr(err)
 		_, err = io.Copy(buf, conn)
 		util.CheckErr(err)
-		Handle(buf.Bytes(), anonCoordinator)
+		Handle(buf.Bytes(), anonCoordinator, conn.RemoteAddr())
 	}
 }
 
@@ -47,8 +53,10 @@ func initCoordinator() {
 	CoordinatorAddr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:"+config["local_port"])
 	util.CheckErr(err)
 	suite := nist.NewAES128SHA256QR512()
-	a := suite.Secret().Pick(random.Stream)
+	a := util.LoadPrivateKey(suite, config["coordinator_private_key_file"])
 	A := suite.Point().Mul(nil, a)
+	// clients pin this key as coordinator_public_key
+	fmt.Println("[debug] My public key is " + hex.EncodeToString(util.EncodePoint(A)))
 	pedersenBase := pedersen.CreateMinimalBaseFromSuite(suite)
 	fujiokamBase := fujiokam.CreateBaseFromSuite(suite)
 	prfSecret, prfPublic := fujiokamBase.GenerateAllGnHonestyProof()
@@ -56,6 +64,8 @@ func initCoordinator() {
 	anonCoordinator = &Coordinator{
 		LocalAddr: CoordinatorAddr,
 		ServerList: nil,
+		TrustedServers: loadTrustedServers(config["trusted_servers_file"]),
+		PendingServers: make(map[string]*PendingServer),
 		Status: CONFIGURATION,
 		Suite: suite,
 		PrivateKey: a,
@@ -63,19 +73,91 @@ func initCoordinator() {
 		G: nil,
 		Clients: make(map[string]*net.TCPAddr),
 		BeginningKeyMap: make(map[string]abstract.Point),
-		BeginningCommMap: make(map[string]abstract.Point),
+		BeginningCommMap: make(map[string][]abstract.Point),
 		NewClientsBuffer: nil,
 		MsgLog: nil,
 		AssignmentSignaturesLog: make(map[string]AssignmentSignatures),
-		Bridges: make(map[string]BridgeInfo),
-		EndingCommMap: make(map[string]abstract.Point),
+		PostCounts: make(map[string]int),
+		Quotas: quota.LoadLimiter(),
+		Admission: admission.LoadChain(),
+		RegisteredKeys: make(map[string]bool),
+		AdmittedRegistrations: make(map[string]string),
+		BridgePool: bridge.NewPool(util.GetIntParameter("bridge_lifetime", 1), util.GetIntParameter("bridge_max_handouts", 0)),
+		EndingCommMap: make(map[string][]abstract.Point),
 		EndingKeyMap: make(map[string]abstract.Point),
-		ReputationDiffMap: make(map[string]int),
+		AppliedDiffMap: make(map[string][]int),
+		AppliedRDiffMap: make(map[string][]abstract.Secret),
+		Policy: bridge.LoadPolicy(),
+		MaxPassRestarts: util.GetIntParameter("max_pass_restarts", 3),
+		TallyTimeout: time.Duration(util.GetIntParameter("tally_timeout_ms", 30000)) * time.Millisecond,
+		DropFaultyServers: util.GetIntParameter("drop_faulty_servers", 0) != 0,
+		MinServers: util.GetIntParameter("min_servers", 1),
+		Transcript: transcript.Open(config["transcript_file"], suite, a),
 		PedersenBase: pedersenBase,
 		FujiOkamBase: fujiokamBase,
 		AllGnHonestyProofSecret: prfSecret,
 		AllGnHonestyProofPublic: prfPublic,
 	}
+	anonCoordinator.Tally = bridge.NewTally(anonCoordinator.Policy)
+}
+
+/**
+  * load hex-encoded public keys of trusted servers, one per line
+  */
+func loadTrustedServers(path string) map[string]bool {
+	trusted := make(map[string]bool)
+	file, err := os.Open(path)
+	if err != nil {
+		return trusted
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if key := strings.TrimSpace(scanner.Text()); key != "" {
+			trusted[key] = true
+		}
+	}
+	return trusted
+}
+
+/**
+  * admin interface of the configuration phase,
+  * the operator approves or rejects servers not in the trusted list
+  */
+func configureServers() {
+	fmt.Println("** Note: Type ok to finish the server configuration. (servers | approve <addr> | reject <addr>) **")
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		data, _, _ := reader.ReadLine()
+		commands := strings.Fields(string(data))
+		if len(commands) == 0 {
+			continue
+		}
+		switch commands[0] {
+		case "ok":
+			return
+		case "servers":
+			for _,server := range anonCoordinator.WaitingServers() {
+				fmt.Println("[coordinator] *", server.Addr, hex.EncodeToString(util.EncodePoint(server.PublicKey)))
+			}
+		case "approve", "reject":
+			if len(commands) < 2 {
+				fmt.Println("[coordinator] Usage: " + commands[0] + " <addr>")
+				break
+			}
+			server := anonCoordinator.FindWaitingServer(commands[1])
+			if server == nil {
+				fmt.Println("[coordinator] No server waiting at " + commands[1])
+				break
+			}
+			anonCoordinator.TakePendingServer(server.Key)
+			if commands[0] == "approve" {
+				admitServer(server)
+			} else {
+				refuseServer(server.Addr, "rejected by the operator")
+			}
+		}
+	}
 }
 
 // config parameters for commitments
@@ -89,6 +171,7 @@ func configCommParams() {
 		"h": byteH,
 	}
 	event := &proto.Event{EventType: proto.BCAST_PEDERSEN_H, Params: params}
+	anonCoordinator.SignEvent(event)
 	for _, server := range anonCoordinator.ServerList {
 		util.SendEvent(anonCoordinator.LocalAddr, server.Addr, event)
 	}
@@ -98,11 +181,11 @@ func configCommParams() {
  * clear all buffer data
  */
 func clearBuffer() {
-	// clear buffer
-	anonCoordinator.NewClientsBuffer = nil
 	// msg sender's record nym
 	anonCoordinator.MsgLog = nil
 	anonCoordinator.RequesterAddrs = make(map[string]*net.TCPAddr)
+	anonCoordinator.SealedAddrs = make(map[string][]byte)
+	anonCoordinator.AssignedAddrs = make(map[string]string)
 }
 
 /**
@@ -115,10 +198,15 @@ func announce() {
 		anonCoordinator.Status = MESSAGE
 		return
 	}
+	// a new round starts, messages signed in earlier rounds are no longer accepted
+	anonCoordinator.Epoch++
+	anonCoordinator.StartGT = anonCoordinator.PedersenBase.GT
+	anonCoordinator.StartHT = anonCoordinator.PedersenBase.HT
+	fmt.Println("[debug] Starting round", anonCoordinator.Epoch)
 	// construct reputation list (public keys & reputation commitments)
 	size := len(anonCoordinator.BeginningCommMap)
 	keys := make([]abstract.Point, size)
-	vals := make([]abstract.Point, size)
+	vals := make([][]abstract.Point, size)
 	i := 0
 	for k, v := range anonCoordinator.BeginningCommMap {
 		keys[i] = anonCoordinator.BeginningKeyMap[k]
@@ -126,13 +214,16 @@ func announce() {
 		i++
 	}
 	byteKeys := util.ProtobufEncodePointList(keys)
-	byteVals := util.ProtobufEncodePointList(vals)
+	byteVals := util.ProtobufEncodePointList(bridge.FlattenRecords(vals))
 	params := map[string]interface{}{
 		"keys" : byteKeys,
 		"vals" : byteVals,
 		"GT": util.EncodePoint(anonCoordinator.PedersenBase.GT),
 		"HT": util.EncodePoint(anonCoordinator.PedersenBase.HT),
+		"epoch": anonCoordinator.Epoch,
 	}
+	anonCoordinator.PassStart = params
+	anonCoordinator.PassRestarts = 0
 	event := &proto.Event{EventType:proto.ANNOUNCEMENT, Params:params}
 	util.SendEvent(anonCoordinator.LocalAddr, firstServer, event)
 }
@@ -148,51 +239,142 @@ func roundEnd() {
 		return
 	}
 	// add new clients into reputation map
+	newClients := make(map[string]bool)
 	for _,cdata := range anonCoordinator.NewClientsBuffer {
 		anonCoordinator.AddIntoEndingMap(cdata.Nym, cdata.PComm)
+		newClients[cdata.Nym.String()] = true
 	}
+	// clients registering from now on join at the next round end
+	anonCoordinator.NewClientsBuffer = nil
+	anonCoordinator.JoiningClientKeys = anonCoordinator.NewClientKeys
+	anonCoordinator.NewClientKeys = nil
 	// add previous clients into reputation map
-	// construct the parameters
 	size := len(anonCoordinator.EndingCommMap)
 	keys := make([]abstract.Point, size)
-	vals := make([]abstract.Point, size)
-	rDiffs := make([]abstract.Secret, size)
 	i := 0
-	for k, v := range anonCoordinator.EndingCommMap {
+	for k := range anonCoordinator.EndingCommMap {
 		keys[i] = anonCoordinator.EndingKeyMap[k]
-		// update commitment by adding diff's commitment
-		diff := anonCoordinator.ReputationDiffMap[k]
-		diffSecret := anonCoordinator.Suite.Secret().SetInt64(int64(diff))
-		diffComm, rDiff := anonCoordinator.PedersenBase.Commit(diffSecret)
-		vals[i] = anonCoordinator.PedersenBase.Add(v, diffComm)
-		rDiffs[i] = rDiff
 		i++
 	}
+	// no more votes, apply the policy to the tallied diffs, except for clients registered
+	// in this round, then agree on them with every server before touching any commitment
+	anonCoordinator.Status = TALLY
+	table := anonCoordinator.Tally.Table(keys, newClients)
+	if !agreeOnTally(keys, table) {
+		anonCoordinator.BridgePool.NextRound()
+		abortRound("servers do not agree on the tally")
+		return
+	}
+
+	// construct the parameters
+	vals := make([][]abstract.Point, size)
+	// old commitments, diffs and rDiffs are flattened in the same order as the commitments
+	oldVals := []abstract.Point{}
+	flatDiffs := []int{}
+	rDiffs := []abstract.Secret{}
+	anonCoordinator.AppliedDiffMap = make(map[string][]int)
+	anonCoordinator.AppliedRDiffMap = make(map[string][]abstract.Secret)
+	for i,key := range keys {
+		v := anonCoordinator.EndingCommMap[key.String()]
+		vals[i] = make([]abstract.Point, len(v))
+		for dim := range v {
+			// update commitment by adding diff's commitment
+			diffSecret := anonCoordinator.Suite.Secret().SetInt64(int64(table[i][dim]))
+			diffComm, rDiff := anonCoordinator.PedersenBase.Commit(diffSecret)
+			vals[i][dim] = anonCoordinator.PedersenBase.Add(v[dim], diffComm)
+			rDiffs = append(rDiffs, rDiff)
+		}
+		oldVals = append(oldVals, v...)
+		flatDiffs = append(flatDiffs, table[i]...)
+		anonCoordinator.AppliedDiffMap[key.String()] = table[i]
+		anonCoordinator.AppliedRDiffMap[key.String()] = rDiffs[len(rDiffs)-len(v):]
+	}
 	byteKeys := util.ProtobufEncodePointList(keys)
-	byteVals := util.ProtobufEncodePointList(vals)
-	// send signal to server
+	byteVals := util.ProtobufEncodePointList(bridge.FlattenRecords(vals))
+	byteRDiffs := util.ProtobufEncodeSecretList(rDiffs)
+	// send signal to server, publishing the update so that servers can check it.
+	// Clients only get their own diffs and rDiffs, sealed, once the pass is done
 	pm := map[string]interface{} {
 		"keys" : byteKeys,
 		"vals" : byteVals,
 		"is_start" : true,
+		"epoch": anonCoordinator.Epoch,
 		"GT": util.EncodePoint(anonCoordinator.PedersenBase.GT),
 		"HT": util.EncodePoint(anonCoordinator.PedersenBase.HT),
+		"update_keys": byteKeys,
+		"update_old": util.ProtobufEncodePointList(oldVals),
+		"update_new": byteVals,
+		"update_diffs": util.EncodeIntArray(flatDiffs),
+		"update_rdiffs": byteRDiffs,
+		"votes": bridge.EncodeVotes(anonCoordinator.VoteLog),
+		"tally_signatures": util.Encode2DByteArray(anonCoordinator.TallySignatures),
 	}
+	anonCoordinator.PassStart = pm
+	anonCoordinator.PassRestarts = 0
 	event := &proto.Event{EventType:proto.ROUND_END, Params:pm}
+	anonCoordinator.SignEvent(event)
 	util.SendEvent(anonCoordinator.LocalAddr, lastServer, event)
 
-	// send rDiff to clients
-	pm = map[string]interface{} {
-		"keys" : byteKeys,
-		"rDiffs": util.ProtobufEncodeSecretList(rDiffs),
-	}
-	event = &proto.Event{EventType:proto.BCAST_PEDERSEN_RDIFF, Params:pm}
-	for _, addr := range anonCoordinator.Clients {
-		util.SendEvent(anonCoordinator.LocalAddr, addr, event)
+	// drop expired bridges, the rest wait for their providers to re-bind
+	anonCoordinator.BridgePool.NextRound()
+}
+
+/**
+ * give up the current round without updating any reputation. The next
+ * announcement starts again from the table of the last round end, and
+ * clients which would have joined at this round end register again.
+ */
+func abortRound(reason string) {
+	fmt.Println("[note]** Round", anonCoordinator.Epoch, "aborted:", reason + ", no reputation is updated")
+	anonCoordinator.PedersenBase.GT = anonCoordinator.StartGT
+	anonCoordinator.PedersenBase.HT = anonCoordinator.StartHT
+	for _,key := range anonCoordinator.JoiningClientKeys {
+		addr, ok := anonCoordinator.Clients[key.String()]
+		delete(anonCoordinator.RegisteredKeys, key.String())
+		delete(anonCoordinator.Clients, key.String())
+		if ok {
+			refuseRegistration(ErrRoundAborted, addr)
+		}
 	}
+	anonCoordinator.JoiningClientKeys = nil
+	anonCoordinator.Status = READY_FOR_NEW_ROUND
+}
+
+/**
+ * ask every server to sign the diff table, and wait for all of them.
+ * A server refusing the table, or not answering in time, means we can
+ * not apply diffs every server agrees on, so the round fails.
+ */
+func agreeOnTally(keys []abstract.Point, table [][]int) bool {
+	anonCoordinator.TallyKeys = keys
+	anonCoordinator.TallyTable = table
+	anonCoordinator.TallySignatures = make([][]byte, len(anonCoordinator.ServerList))
+	anonCoordinator.TallyRefused = false
 
-	// clear bridges
-	anonCoordinator.ClearBridges()
+	pm := map[string]interface{} {
+		"keys": util.ProtobufEncodePointList(keys),
+		"diffs": util.Encode2DIntArray(table),
+	}
+	event := &proto.Event{EventType:proto.TALLY_CHECK, Params:pm}
+	anonCoordinator.SignEvent(event)
+	for _,server := range anonCoordinator.ServerList {
+		util.SendEvent(anonCoordinator.LocalAddr, server.Addr, event)
+	}
+	fmt.Println("[coordinator] Waiting for servers to agree on the tally...")
+	deadline := time.Now().Add(anonCoordinator.TallyTimeout)
+	for {
+		if anonCoordinator.Status == TALLY_AGREED {
+			return true
+		}
+		if anonCoordinator.TallyRefused {
+			return false
+		}
+		if time.Now().After(deadline) {
+			fmt.Println("[note]** Not every server signed the tally in time")
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
 }
 
 /**
@@ -204,6 +386,7 @@ func vote() {
 	anonCoordinator.ClearVoteRecords()
 	pm := map[string]interface{} {}
 	event := &proto.Event{EventType:proto.VOTE, Params:pm}
+	anonCoordinator.SignEvent(event)
 	for _, addr :=  range anonCoordinator.Clients {
 		util.SendEvent(anonCoordinator.LocalAddr, addr, event)
 	}
@@ -216,9 +399,12 @@ func addFakeClients(num int) {
 		// public key = g^sk mod p
 		sk := suite.Secret().Pick(random.Stream)
 		pk := suite.Point().Mul(nil, sk)
-		// commitment = GT^0 * HT^r mod p
-		r := suite.Secret().Pick(random.Stream)
-		comm := suite.Point().Mul(HT, r)
+		// commitment = GT^0 * HT^r mod p for each dimension
+		comm := make([]abstract.Point, anonCoordinator.Policy.NumDimensions())
+		for j := range comm {
+			r := suite.Secret().Pick(random.Stream)
+			comm[j] = suite.Point().Mul(HT, r)
+		}
 		anonCoordinator.AddIntoRepMap(pk, comm)
 	}
 }
@@ -238,9 +424,14 @@ func Launch() {
 	util.CheckErr(err)
 	// start listener
 	go startServerListener(listener)
-	fmt.Println("** Note: Type ok to finish the server configuration. **")
-	// wait keypress to start life cycle
-	waitKeypress("Press ENTER to start:\n")
+	// issue invite tokens for operators to hand out, kept in the invite file
+	if invites := anonCoordinator.Admission.Invites(); invites != nil {
+		for i := 0; i < util.GetIntParameter("admission_issue_invites", 0); i++ {
+			fmt.Println("[coordinator] Invite token:", invites.Issue())
+		}
+	}
+	// approve servers, then start life cycle
+	configureServers()
 	fmt.Println("[debug] Servers in the current network:")
 	for _,info := range anonCoordinator.ServerList {
 		fmt.Println("[debug] *", info.Addr)
@@ -273,11 +464,15 @@ func Launch() {
 		fmt.Println("[coordinator] Announcement phase started...")
 		announce()
 		for {
-			if anonCoordinator.Status == MESSAGE {
+			if anonCoordinator.Status == MESSAGE || anonCoordinator.Status == READY_FOR_NEW_ROUND {
 				break
 			}
 			time.Sleep(1000 * time.Millisecond)
 		}
+		// the announcement was aborted, start over
+		if anonCoordinator.Status == READY_FOR_NEW_ROUND {
+			continue
+		}
 		// posting phase
 		fmt.Println("[coordinator] Posting phase started...")
 		waitKeypress("Press ENTER to end posting:\n")
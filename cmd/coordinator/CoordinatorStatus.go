@@ -8,3 +8,6 @@ const ANNOUNCE = 2;
 const MESSAGE = 3;
 const VOTE = 4;
 const SERVER_CONFIGURATION = 5;
+// waiting for servers to sign the diff table
+const TALLY = 6;
+const TALLY_AGREED = 7;
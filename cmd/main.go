@@ -5,10 +5,15 @@ import (
 	"zRep/cmd/coordinator"
 	"zRep/cmd/server"
 	"zRep/cmd/client"
+	"zRep/cmd/transcript"
 	// "zRep/test"
 )
 
 func main() {
+	// zrep verify <transcript>... checks recorded rounds offline
+	if len(os.Args) >= 2 && os.Args[1] == "verify" {
+		os.Exit(transcript.Main(os.Args[2:]))
+	}
 	if len(os.Args) == 2 {
 		switch role := os.Args[1]; role {
 		case "0":
@@ -0,0 +1,86 @@
+package probe
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"zRep/cmd/bridge"
+)
+
+// Prober checks whether a bridge can be reached from the client
+type Prober interface {
+	// return nil if addr is reachable
+	Probe(addr string) error
+}
+
+// TCPProber regards a bridge as reachable if a TCP connection can be set up
+type TCPProber struct {
+	Timeout time.Duration
+}
+
+func (p *TCPProber) Probe(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, p.Timeout)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+var ErrUnreachable = errors.New("bridge is unreachable")
+
+// LocalProber answers from a fixed table instead of touching the network
+type LocalProber struct {
+	Reachable map[string]bool
+}
+
+func (p *LocalProber) Probe(addr string) error {
+	if !p.Reachable[addr] {
+		return ErrUnreachable
+	}
+	return nil
+}
+
+// Result accumulates the outcome of probing one bridge
+type Result struct {
+	Attempts int
+	Successes int
+}
+
+func (r *Result) Record(reachable bool) {
+	r.Attempts++
+	if reachable {
+		r.Successes++
+	}
+}
+
+// Rule decides the feedback from the ratio of successful probes
+type Rule struct {
+	// vote "works" when at least this ratio of probes succeed
+	UpRatio float64
+	// vote "blocked" when at most this ratio of probes succeed,
+	// or "never_reachable" when no probe succeeds
+	DownRatio float64
+}
+
+// by default, a bridge reached at least half of the time works, and a bridge never reached is reported
+var DefaultRule = Rule{UpRatio: 0.5, DownRatio: 0}
+
+// return the feedback category and whether the result is conclusive
+func (rule Rule) Feedback(res Result) (bridge.Category, bool) {
+	if res.Attempts == 0 {
+		return 0, false
+	}
+	ratio := float64(res.Successes) / float64(res.Attempts)
+	if ratio >= rule.UpRatio {
+		return bridge.WORKS, true
+	}
+	if res.Successes == 0 {
+		return bridge.NEVER_REACHABLE, true
+	}
+	if ratio <= rule.DownRatio {
+		return bridge.BLOCKED, true
+	}
+	return 0, false
+}
@@ -0,0 +1,58 @@
+package probe
+import (
+	"net"
+	"testing"
+	"time"
+
+	"zRep/cmd/bridge"
+)
+
+func TestLocalProber(t *testing.T) {
+	prober := &LocalProber{Reachable: map[string]bool{"xxx": true}}
+	if prober.Probe("xxx") != nil {
+		t.Error("xxx should have been reachable")
+	}
+	if prober.Probe("yyy") == nil {
+		t.Error("yyy should have been unreachable")
+	}
+}
+
+func TestTCPProber(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	prober := &TCPProber{Timeout: time.Second}
+	if err := prober.Probe(addr); err != nil {
+		t.Error("Listening address should have been reachable:", err)
+	}
+	listener.Close()
+	if prober.Probe(addr) == nil {
+		t.Error("Closed address should have been unreachable")
+	}
+}
+
+func TestFeedback(t *testing.T) {
+	prober := &LocalProber{Reachable: map[string]bool{"xxx": true}}
+	var up, down Result
+	for i := 0; i < 3; i++ {
+		up.Record(prober.Probe("xxx") == nil)
+		down.Record(prober.Probe("yyy") == nil)
+	}
+	if feedback, ok := DefaultRule.Feedback(up); !ok || feedback != bridge.WORKS {
+		t.Error("Reachable bridge should work")
+	}
+	if feedback, ok := DefaultRule.Feedback(down); !ok || feedback != bridge.NEVER_REACHABLE {
+		t.Error("Unreachable bridge should be never reachable")
+	}
+	if feedback, ok := (Rule{UpRatio: 0.5, DownRatio: 0.4}).Feedback(Result{Attempts: 3, Successes: 1}); !ok || feedback != bridge.BLOCKED {
+		t.Error("Mostly unreachable bridge should be blocked")
+	}
+	if _, ok := DefaultRule.Feedback(Result{Attempts: 3, Successes: 1}); ok {
+		t.Error("Mostly unreachable bridge should be inconclusive")
+	}
+	if _, ok := DefaultRule.Feedback(Result{}); ok {
+		t.Error("Unprobed bridge should be inconclusive")
+	}
+}
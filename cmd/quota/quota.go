@@ -0,0 +1,78 @@
+package quota
+
+import (
+	"zRep/util"
+)
+
+// client actions limited in each round
+const POST string = "post"
+const REQUEST string = "request"
+const VOTE string = "vote"
+
+var Actions = []string{POST, REQUEST, VOTE}
+
+// a limit of NoLimit is never enforced
+const NoLimit int = -1
+
+// Limiter counts the actions of each round nym and each source connection,
+// so that a flood is rejected before any expensive proof is verified
+type Limiter struct {
+	// map an action to the limit per nym / per connection in a round
+	PerNym map[string]int
+	PerConn map[string]int
+	// map "action|key" to the number of actions seen in this round
+	nymCounts map[string]int
+	connCounts map[string]int
+}
+
+func NewLimiter(perNym, perConn map[string]int) *Limiter {
+	return &Limiter{
+		PerNym: perNym,
+		PerConn: perConn,
+		nymCounts: make(map[string]int),
+		connCounts: make(map[string]int),
+	}
+}
+
+// load limits from parameters named "quota_<action>_per_nym" and
+// "quota_<action>_per_conn", missing limits are not enforced
+func LoadLimiter() *Limiter {
+	perNym := make(map[string]int)
+	perConn := make(map[string]int)
+	for _,action := range Actions {
+		perNym[action] = util.GetIntParameter("quota_" + action + "_per_nym", NoLimit)
+		perConn[action] = util.GetIntParameter("quota_" + action + "_per_conn", NoLimit)
+	}
+	return NewLimiter(perNym, perConn)
+}
+
+func allow(limits map[string]int, counts map[string]int, action string, key string) bool {
+	limit, ok := limits[action]
+	if !ok || limit == NoLimit {
+		return true
+	}
+	countKey := action + "|" + key
+	if counts[countKey] >= limit {
+		return false
+	}
+	counts[countKey]++
+	return true
+}
+
+// AllowConn counts an action from a source connection,
+// return false if its quota has been used up
+func (l *Limiter) AllowConn(action string, conn string) bool {
+	return allow(l.PerConn, l.connCounts, action, conn)
+}
+
+// AllowNym counts an action from a round nym,
+// return false if its quota has been used up
+func (l *Limiter) AllowNym(action string, nym string) bool {
+	return allow(l.PerNym, l.nymCounts, action, nym)
+}
+
+// Reset starts counting for a new round
+func (l *Limiter) Reset() {
+	l.nymCounts = make(map[string]int)
+	l.connCounts = make(map[string]int)
+}
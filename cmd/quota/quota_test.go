@@ -0,0 +1,34 @@
+package quota
+import (
+	"testing"
+)
+
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter(map[string]int{REQUEST: 2, VOTE: NoLimit}, map[string]int{REQUEST: 3})
+	if !limiter.AllowNym(REQUEST, "a") || !limiter.AllowNym(REQUEST, "a") {
+		t.Error("First two requests should have been allowed")
+	}
+	if limiter.AllowNym(REQUEST, "a") {
+		t.Error("Third request of the same nym should have been rejected")
+	}
+	if !limiter.AllowNym(REQUEST, "b") {
+		t.Error("Nyms should have separate quotas")
+	}
+	for i := 0; i < 10; i++ {
+		if !limiter.AllowNym(VOTE, "a") || !limiter.AllowNym(POST, "a") {
+			t.Error("Unlimited actions should always be allowed")
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if !limiter.AllowConn(REQUEST, "127.0.0.1:1") {
+			t.Error("Request", i, "of the connection should have been allowed")
+		}
+	}
+	if limiter.AllowConn(REQUEST, "127.0.0.1:1") {
+		t.Error("Fourth request of the same connection should have been rejected")
+	}
+	limiter.Reset()
+	if !limiter.AllowNym(REQUEST, "a") || !limiter.AllowConn(REQUEST, "127.0.0.1:1") {
+		t.Error("Quotas should have been reset in a new round")
+	}
+}
@@ -1,9 +1,16 @@
 package server
 
 import (
+	"errors"
+	"fmt"
+	"encoding/hex"
 	"net"
+	"zRep/proto"
+	"zRep/util"
 	"zRep/primitive/pedersen"
 	"zRep/primitive/fujiokam"
+	"zRep/cmd/bridge"
+	"zRep/cmd/transcript"
 
 	"github.com/dedis/crypto/abstract"
 )
@@ -14,6 +21,13 @@ type AnonServer struct {
 	LocalAddr *net.TCPAddr
 	// client-side config
 	CoordinatorAddr *net.TCPAddr
+	// coordinator's key, pinned from config or trusted on first use
+	CoordinatorPublicKey abstract.Point
+	// trust the first coordinator key seen if none is pinned, off by default
+	TrustFirstKey bool
+	// round and sequence numbers of the coordinator's events handled in it
+	EventEpoch int
+	SeenEvents map[int]bool
 	// crypto variables
 	Suite abstract.Suite
 	PrivateKey abstract.Secret
@@ -22,7 +36,8 @@ type AnonServer struct {
 	G abstract.Point
 
 	EndingKeyMap map[string]abstract.Point
-	EndingCommMap map[string]abstract.Point
+	// map a nym to its commitments, one per reputation dimension
+	EndingCommMap map[string][]abstract.Point
 
 	// buffer data
 	IsConnected bool
@@ -32,19 +47,82 @@ type AnonServer struct {
 	PreviousHop *net.TCPAddr
 	// map current public key with previous key
 	KeyMap map[string]abstract.Point
+	// records of the clients registered in this round, keyed on the key we passed on
+	NewRecords map[string][]abstract.Point
 	// generated by elgmal encryption
 	A abstract.Point
 
 	// used for modPow encryption
 	Roundkey abstract.Secret
+	// round key and key map of the last round end, kept in case the
+	// coordinator restarts its pass
+	PrevRoundkey abstract.Secret
+	PrevKeyMap map[string]abstract.Point
+	PrevNewRecords map[string][]abstract.Point
+	// round whose round end we have passed on
+	RoundEndEpoch int
+	// current round, learnt from the coordinator's announcement
+	Epoch int
 
 	PedersenBase *pedersen.PedersenBase
 	FujiOkamBase *fujiokam.FujiOkamBase
+	Policy *bridge.Policy
+	// our own tally of the votes of this round, and the diff table
+	// we signed at round end
+	Tally *bridge.Tally
+	AgreedKeys []abstract.Point
+	AgreedTable [][]int
+	// signed record of the hops we sent, nil if not kept
+	Transcript *transcript.Writer
+}
 
+// check that an event only the coordinator may send is signed by it and
+// has not been handled before, like clients do
+func (s *AnonServer) VerifyCoordinator(event *proto.Event) error {
+	byteKey, ok := event.Params["coordinator_key"].([]byte)
+	if !ok {
+		return errors.New("event is not signed by the coordinator")
+	}
+	byteSig, ok := event.Params["coordinator_signature"].([]byte)
+	if !ok {
+		return errors.New("event is not signed by the coordinator")
+	}
+	if s.CoordinatorPublicKey == nil {
+		if !s.TrustFirstKey {
+			return errors.New("no coordinator key is pinned")
+		}
+		key := s.Suite.Point()
+		if err := key.UnmarshalBinary(byteKey); err != nil {
+			return err
+		}
+		fmt.Println("[note]** No coordinator_public_key configured, trusting coordinator key " + hex.EncodeToString(util.EncodePoint(key)))
+		s.CoordinatorPublicKey = key
+	}
+	msg := util.MessageOfEvent(event, "coordinator_signature")
+	if err := util.ElGamalVerify(s.Suite, msg, s.CoordinatorPublicKey, byteSig, nil); err != nil {
+		return err
+	}
+	epoch, ok := event.Params["epoch"].(int)
+	if !ok || epoch < s.EventEpoch {
+		return errors.New("event belongs to an earlier round")
+	}
+	seq, ok := event.Params["seq"].(int)
+	if !ok {
+		return errors.New("event has no sequence number")
+	}
+	if epoch > s.EventEpoch || s.SeenEvents == nil {
+		s.SeenEvents = make(map[int]bool)
+	}
+	if s.SeenEvents[seq] {
+		return errors.New("event has been handled in this round")
+	}
+	s.SeenEvents[seq] = true
+	s.EventEpoch = epoch
+	return nil
 }
 
-func (s *AnonServer) AddIntoEndingMap(key abstract.Point, val abstract.Point) {
+func (s *AnonServer) AddIntoEndingMap(key abstract.Point, record []abstract.Point) {
 	keyStr := key.String()
 	s.EndingKeyMap[keyStr] = key
-	s.EndingCommMap[keyStr] = val
+	s.EndingCommMap[keyStr] = record
 }
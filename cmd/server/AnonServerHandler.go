@@ -1,15 +1,20 @@
 package server
 
 import (
+	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"math/big"
 	"net"
+	"os"
 	"zRep/cmd/bridge"
+	"zRep/cmd/transcript"
 	"zRep/proto"
 	"zRep/util"
 	"zRep/util/shuffle"
 	"zRep/primitive/fujiokam"
+	"zRep/primitive/dleq"
 
 	"github.com/dedis/crypto/abstract"
 	"github.com/dedis/crypto/proof"
@@ -19,6 +24,19 @@ import (
 
 var anonServer *AnonServer
 
+// events which change our tally, registration, round state or place in the
+// chain, or make us sign, accepted only when signed by the coordinator
+var coordinatorOnly = map[int]bool{
+	proto.SERVER_REGISTER_REPLY: true,
+	proto.BCAST_PEDERSEN_H: true,
+	proto.ANNOUNCEMENT_FINALIZE: true,
+	proto.SIGN_ASSIGNMENTS: true,
+	proto.UPDATE_NEXT_HOP: true,
+	proto.UPDATE_PREVIOUS_HOP: true,
+	proto.TALLY_VOTE: true,
+	proto.TALLY_CHECK: true,
+}
+
 func Handle(buf []byte, tmpServer *AnonServer) {
 	// decode the whole message
 	byteArr := make([]util.ByteArray, 2)
@@ -26,7 +44,22 @@ func Handle(buf []byte, tmpServer *AnonServer) {
 
 	anonServer = tmpServer
 	event, addr := util.DecodeEvent(buf)
+	// drop events only the coordinator may send unless it signed them, and
+	// so the start of the round-end pass, unlike the hops after it
+	_, isStart := event.Params["is_start"]
+	if coordinatorOnly[event.EventType] || (event.EventType == proto.ROUND_END && isStart) {
+		if err := anonServer.VerifyCoordinator(event); err != nil {
+			fmt.Println("[note]** Dropped event", event.EventType, "-", err)
+			return
+		}
+	}
 	switch event.EventType {
+	case proto.SERVER_CHALLENGE:
+		handleServerChallenge(event.Params, addr)
+		break
+	case proto.SERVER_REGISTER_REFUSED:
+		handleServerRegisterRefused(event.Params)
+		break
 	case proto.SERVER_REGISTER_REPLY:
 		handleServerRegisterReply(event.Params, addr)
 		break
@@ -37,11 +70,14 @@ func Handle(buf []byte, tmpServer *AnonServer) {
 		handleAnnouncementFinalize(event.Params)
 		break
 	case proto.SIGN_ASSIGNMENTS:
-		handleSignAssignments(event.Params, addr)
+		handleSignAssignments(event.Params)
 		break
 	case proto.UPDATE_NEXT_HOP:
 		handleUpdateNextHop(event.Params)
 		break
+	case proto.UPDATE_PREVIOUS_HOP:
+		handleUpdatePreviousHop(event.Params)
+		break
 	case proto.CLIENT_REGISTER_SERVERSIDE:
 		handleClientRegisterServerSide(event.Params)
 		break
@@ -51,41 +87,201 @@ func Handle(buf []byte, tmpServer *AnonServer) {
 	case proto.BCAST_PEDERSEN_H:
 		handleBroadcastPedersenH(event.Params)
 		break
+	case proto.TALLY_VOTE:
+		handleTallyVote(event.Params)
+		break
+	case proto.TALLY_CHECK:
+		handleTallyCheck(event.Params)
+		break
 	default:
 		fmt.Println("Unrecognized request")
 		break
 	}
 }
 
-func verifyNeffShuffle(params map[string]interface{}) {
-	if _, shuffled := params["shuffled"]; shuffled {
-		// get all the necessary parameters
-		xbarList := util.ProtobufDecodePointList(params["xbar"].([]byte))
-		ybarList := util.ProtobufDecodePointList(params["ybar"].([]byte))
-		prevKeyList := util.ProtobufDecodePointList(params["prev_keys"].([]byte))
-		prevValList := util.ProtobufDecodePointList(params["prev_vals"].([]byte))
-		prePublicKey := anonServer.Suite.Point()
-		prePublicKey.UnmarshalBinary(params["public_key"].([]byte))
-
-		// verify the shuffle
-		verifier := shuffle.Verifier(anonServer.Suite, nil, prePublicKey, prevKeyList,
-			prevValList, xbarList, ybarList)
-		err := proof.HashVerify(anonServer.Suite, "PairShuffle", verifier, params["proof"].([]byte))
+// check the exponents and shuffle of the previous hop, and blame it on the
+// coordinator if they fail
+func checkPreviousHop(params map[string]interface{}, phase int) bool {
+	err := bridge.CheckHop(anonServer.Suite, params, phase == proto.ANNOUNCEMENT)
+	if err == nil {
+		return true
+	}
+	fmt.Println("[note]** Previous hop failed its proofs: " + err.Error())
+	// the signed hop is the evidence
+	evidence := bridge.EncodeHops([]map[string]interface{}{bridge.HopRecord(params)})
+	reason := err.Error()
+	rand := anonServer.Suite.Cipher(abstract.RandomKey)
+	pm := map[string]interface{}{
+		"phase": phase,
+		"evidence": evidence,
+		"reason": reason,
+		"signature": util.ElGamalSign(anonServer.Suite, rand, bridge.MessageOfBlame(phase, evidence, reason), anonServer.PrivateKey, nil),
+	}
+	event := &proto.Event{EventType:proto.BLAME, Params:pm}
+	util.SendEvent(anonServer.LocalAddr, anonServer.CoordinatorAddr, event)
+	return false
+}
+
+// attach what we received and prove that we raised it with a single round key
+// and a single E, then sign this hop and add it to the chain, see bridge.VerifyHop
+func proveHop(pm, params map[string]interface{}, announcement bool, roundkey, E abstract.Secret) {
+	pm["in_keys"] = params["keys"]
+	pm["in_vals"] = params["vals"]
+	pm["in_GT"] = params["GT"]
+	pm["in_HT"] = params["HT"]
+	if epoch, ok := params["epoch"]; ok {
+		pm["epoch"] = epoch
+	}
+	if g, ok := params["g"]; ok && announcement {
+		pm["in_g"] = g
+	}
+	P, Q := bridge.HopKeyPairs(anonServer.Suite, pm, announcement)
+	if len(P) > 0 {
+		pm["key_proof"] = dleq.Prove(anonServer.Suite, roundkey, P, Q)
+	}
+	P, Q = bridge.HopCommPairs(anonServer.Suite, pm)
+	pm["comm_proof"] = dleq.Prove(anonServer.Suite, E, P, Q)
+	rand := anonServer.Suite.Cipher(abstract.RandomKey)
+	pm["hop_signature"] = util.ElGamalSign(anonServer.Suite, rand, bridge.MessageOfHop(pm), anonServer.PrivateKey, nil)
+	pm["hops"] = bridge.AppendHop(params, pm)
+
+	// keep the signed hop for auditors
+	hop := bridge.HopRecord(pm)
+	hop["phase"] = proto.ROUND_END
+	if announcement {
+		hop["phase"] = proto.ANNOUNCEMENT
+	}
+	epoch, ok := pm["epoch"].(int)
+	if !ok {
+		epoch = anonServer.Epoch
+	}
+	anonServer.Transcript.Append(transcript.HOP, epoch, hop)
+}
+
+// check the update published by the coordinator before going on: the diffs
+// are the ones we agreed on, every record we announced is updated from what
+// we announced, clients registered in this round get no diff, every new
+// commitment opens to old * Commit(diff, rDiff), and every vote behind the
+// diffs is signed by a voter of this round. An error means the coordinator's
+// books are not what we agreed on
+func verifyUpdate(params map[string]interface{}) error {
+	keyList := util.ProtobufDecodePointList(params["update_keys"].([]byte))
+	oldVals := util.ProtobufDecodePointList(params["update_old"].([]byte))
+	newVals := util.ProtobufDecodePointList(params["update_new"].([]byte))
+	diffs := util.DecodeIntArray(params["update_diffs"].([]byte))
+	rDiffs := util.ProtobufDecodeSecretList(params["update_rdiffs"].([]byte))
+
+	err := bridge.VerifyUpdate(anonServer.PedersenBase, oldVals, newVals, diffs, rDiffs)
+	if err != nil {
+		return err
+	}
+
+	// the diffs must be the ones we agreed on
+	agreed := []int{}
+	for _,diffs := range anonServer.AgreedTable {
+		agreed = append(agreed, diffs...)
+	}
+	if len(keyList) != len(anonServer.AgreedKeys) || len(diffs) != len(agreed) {
+		return errors.New("the update is not the agreed tally")
+	}
+	for i,key := range keyList {
+		if !key.Equal(anonServer.AgreedKeys[i]) {
+			return errors.New("the update is not the agreed tally")
+		}
+	}
+	for i,diff := range diffs {
+		if diff != agreed[i] {
+			return errors.New("the update is not the agreed tally")
+		}
+	}
+
+	records := bridge.SplitRecords(oldVals, len(keyList))
+	dims := 0
+	if len(keyList) > 0 {
+		dims = len(oldVals) / len(keyList)
+	}
+	// registrations of the round we passed the round end of, if this is a restarted pass
+	newRecords := anonServer.NewRecords
+	if anonServer.RoundEndEpoch == anonServer.Epoch {
+		newRecords = anonServer.PrevNewRecords
+	}
+	seen := 0
+	for i,key := range keyList {
+		announced, ok := anonServer.EndingCommMap[key.String()]
+		if !ok {
+			// registered in this round
+			if err := checkNewClient(key, records[i], newRecords); err != nil {
+				return err
+			}
+			for _,diff := range diffs[i*dims : (i+1)*dims] {
+				if diff != 0 {
+					return errors.New("a new client got a diff")
+				}
+			}
+			continue
+		}
+		seen++
+		if len(announced) != len(records[i]) {
+			return errors.New("record of a different size")
+		}
+		for dim := range announced {
+			if !announced[dim].Equal(records[i][dim]) {
+				return errors.New("record differs from the announced one")
+			}
+		}
+	}
+	if seen != len(anonServer.EndingCommMap) {
+		return errors.New("an announced record is missing")
+	}
+
+	for _,vote := range bridge.DecodeVotes(params["votes"].([]byte)) {
+		nym, ok := anonServer.EndingKeyMap[util.DecodePoint(anonServer.Suite, vote["nym"].([]byte)).String()]
+		if !ok || !bridge.CheckEpoch(vote, anonServer.Epoch) {
+			return errors.New("a vote is not from this round")
+		}
+		err = util.ElGamalVerify(anonServer.Suite, bridge.MessageOfVote(vote), nym, vote["signature"].([]byte), anonServer.G)
 		if err != nil {
-			panic("Shuffle verify failed: " + err.Error())
+			return errors.New("a vote is not signed by its voter")
 		}
 	}
+	fmt.Println("[debug] Update check passed")
+	return nil
+}
+
+// tell the operator that we do not pass on an update of the coordinator,
+// which leaves the round end unfinished
+func refuseUpdate(err error) {
+	fmt.Println()
+	fmt.Println("[alert]** Refused the round-end update of round", anonServer.Epoch, "published by the coordinator:", err)
+	fmt.Println("  the round end is not passed on, no reputation is updated")
 }
 
 func handleRoundEnd(params map[string]interface{}) {
+	if err := verifyUpdate(params); err != nil {
+		refuseUpdate(err)
+		return
+	}
 	keyList := util.ProtobufDecodePointList(params["keys"].([]byte))
 	size := len(keyList)
 	valList := util.ProtobufDecodePointList(params["vals"].([]byte))
 	if _, ok := params["is_start"]; ok {
-		// The request is sent by coordinator
-	} else {
-		// verify neff shuffle if needed
-		verifyNeffShuffle(params)
+		// The request is sent by coordinator, it must start from the published update
+		if !bytes.Equal(params["keys"].([]byte), params["update_keys"].([]byte)) ||
+			!bytes.Equal(params["vals"].([]byte), params["update_new"].([]byte)) {
+			refuseUpdate(errors.New("the table differs from the published update"))
+			return
+		}
+	} else if !checkPreviousHop(params, proto.ROUND_END) {
+		// verify the previous hop's exponents and neff shuffle if needed
+		return
+	}
+
+	// the coordinator restarts its pass if a later hop fails, then we
+	// decrypt again with the keys of this round
+	roundkey, keyMap := anonServer.Roundkey, anonServer.KeyMap
+	restarted := anonServer.RoundEndEpoch == anonServer.Epoch
+	if restarted {
+		roundkey, keyMap = anonServer.PrevRoundkey, anonServer.PrevKeyMap
 	}
 
 	// Create a public/private keypair (X[mine],x)
@@ -103,13 +299,17 @@ func handleRoundEnd(params map[string]interface{}) {
 
 
 	newKeys := make([]abstract.Point, size)
-	newVals := make([]abstract.Point, size)
 	for i := 0 ; i < size; i++ {
-		// decrypt the public key
-		newKeys[i] = anonServer.KeyMap[keyList[i].String()]
-		// randomize PComm
-		newVals[i] = anonServer.Suite.Point().Mul(valList[i], E)
+		// decrypt the public key, which we announced or passed on at registration
+		key, ok := keyMap[keyList[i].String()]
+		if !ok {
+			refuseUpdate(errors.New("a key was neither announced nor registered through us"))
+			return
+		}
+		newKeys[i] = key
 	}
+	// randomize PComm of every dimension
+	newVals := randomizeCommitments(valList, E)
 	byteNewKeys := util.ProtobufEncodePointList(newKeys)
 	byteNewVals := util.ProtobufEncodePointList(newVals)
 
@@ -121,100 +321,86 @@ func handleRoundEnd(params map[string]interface{}) {
 			"GT": util.EncodePoint(GT),
 			"HT": util.EncodePoint(HT),
 		}
+		bridge.CopyUpdate(params, pm)
+		proveHop(pm, params, false, roundkey, E)
 		event := &proto.Event{EventType:proto.ROUND_END, Params:pm}
 		util.SendEvent(anonServer.LocalAddr, anonServer.PreviousHop, event)
-		// reset RoundKey and key map
-		anonServer.Roundkey = anonServer.Suite.Secret().Pick(random.Stream)
-		anonServer.KeyMap = make(map[string]abstract.Point)
+		finishRoundEnd(restarted)
 		return
 	}
 
-	Xori := make([]abstract.Point, len(newVals))
-	for i:=0; i < size; i++ {
-		Xori[i] = anonServer.Suite.Point().Mul(nil, anonServer.PrivateKey)
-	}
-	byteOri := util.ProtobufEncodePointList(Xori)
-
 	rand := anonServer.Suite.Cipher(abstract.RandomKey)
-	// *** perform neff shuffle here ***
-	Xbar, Ybar, _, Ytmp, prover := neffShuffle(Xori, newKeys, rand)
-	prf, err := proof.HashProve(anonServer.Suite, "PairShuffle", rand, prover)
+	// *** perform neff shuffle here, over whole records of a key and its commitments ***
+	finalKeys, finalVals, Xbar, Ybar, prover := shuffle.ShuffleRecords(anonServer.Suite, newKeys, newVals, rand)
+	prf, err := proof.HashProve(anonServer.Suite, "RecordShuffle", rand, prover)
 	util.CheckErr(err)
 
-
-	// this is the shuffled key
-	finalKeys := convertToOrigin(Ybar, Ytmp)
-	finalVals := rebindReputation(newKeys, newVals, finalKeys)
-
 	// send data to the next server
 	byteXbar := util.ProtobufEncodePointList(Xbar)
 	byteYbar := util.ProtobufEncodePointList(Ybar)
 	byteFinalKeys := util.ProtobufEncodePointList(finalKeys)
 	byteFinalVals := util.ProtobufEncodePointList(finalVals)
-	bytePublicKey, _ := anonServer.PublicKey.MarshalBinary()
-	// prev keys means the key before shuffle
+	// prev keys and vals are the records before shuffle
 	pm := map[string]interface{}{
 		"xbar" : byteXbar,
 		"ybar" : byteYbar,
 		"keys" : byteFinalKeys,
 		"vals" : byteFinalVals,
 		"proof" : prf,
-		"prev_keys": byteOri,
-		"prev_vals": byteNewKeys,
+		"prev_keys": byteNewKeys,
+		"prev_vals": byteNewVals,
 		"shuffled": true,
-		"public_key" : bytePublicKey,
 		"GT": util.EncodePoint(GT),
 		"HT": util.EncodePoint(HT),
 	}
+	bridge.CopyUpdate(params, pm)
+	proveHop(pm, params, false, roundkey, E)
 	event := &proto.Event{EventType:proto.ROUND_END, Params:pm}
 	util.SendEvent(anonServer.LocalAddr, anonServer.PreviousHop, event)
 
-	// reset RoundKey and key map
+	finishRoundEnd(restarted)
+}
+
+// reset RoundKey and key map, keeping them for a restarted pass
+func finishRoundEnd(restarted bool) {
+	if restarted {
+		return
+	}
+	anonServer.RoundEndEpoch = anonServer.Epoch
+	anonServer.PrevRoundkey = anonServer.Roundkey
+	anonServer.PrevKeyMap = anonServer.KeyMap
+	anonServer.PrevNewRecords = anonServer.NewRecords
 	anonServer.Roundkey = anonServer.Suite.Secret().Pick(random.Stream)
 	anonServer.KeyMap = make(map[string]abstract.Point)
+	anonServer.NewRecords = make(map[string][]abstract.Point)
 }
 
 func handleBroadcastPedersenH(params map[string]interface{}) {
 	anonServer.PedersenBase.HT = util.DecodePoint(anonServer.Suite, params["h"].([]byte))
 }
 
-func rebindReputation(newKeys []abstract.Point, newVals []abstract.Point, finalKeys []abstract.Point) (finalVals []abstract.Point) {
-	size := len(newKeys)
-	finalVals = make([]abstract.Point, size)
-	mapVals := make(map[string]abstract.Point)
-	for i := 0; i < size; i++ {
-		mapVals[newKeys[i].String()] = newVals[i]
-	}
-	for i := 0; i < size; i++ {
-		finalVals[i] = mapVals[finalKeys[i].String()]
-	}
-	return finalVals
-}
-
-func convertToOrigin(YbarEn, Ytmp []abstract.Point) ([]abstract.Point){
-	size := len(YbarEn)
-	yyy := make([]abstract.Point, size)
-
-	for i := 0; i < size; i++ {
-		yyy[i] = YbarEn[i]
-		Ytmp[i].Sub(yyy[i], Ytmp[i])
+// raise every commitment to E, which keeps their openings under the new GT & HT
+func randomizeCommitments(vals []abstract.Point, E abstract.Secret) []abstract.Point {
+	newVals := make([]abstract.Point, len(vals))
+	for i := 0; i < len(vals); i++ {
+		newVals[i] = anonServer.Suite.Point().Mul(vals[i], E)
 	}
-	return Ytmp
-}
-
-// Y is the keys want to shuffle
-func neffShuffle(X []abstract.Point, Y []abstract.Point, rand abstract.Cipher) (Xbar, Ybar, Xtmp, Ytmp []abstract.Point, prover proof.Prover){
-
-	Xbar, Ybar, prover, Xtmp, Ytmp = shuffle.Shuffle(anonServer.Suite, nil, anonServer.PublicKey,
-		X, Y, rand)
-	return
+	return newVals
 }
 
-// encrypt the public key and PComm, then send to next hop
+// encrypt the public key and PComm, then send to next hop, if the record
+// the client starts with opens to the initial credit
 func handleClientRegisterServerSide(params map[string]interface{}) {
 	publicKey := anonServer.Suite.Point()
 	err := publicKey.UnmarshalBinary(params["public_key"].([]byte))
 	util.CheckErr(err)
+	record := util.ProtobufDecodePointList(params["pcomm"].([]byte))
+	proofs, ok := params["pcomm_proofs"].([]byte)
+	if !ok || len(record) != anonServer.Policy.NumDimensions() || bridge.VerifyInitialCredit(anonServer.PedersenBase,
+		record, util.Decode2DByteArray(proofs), anonServer.Policy.InitialCredit) != nil {
+		fmt.Println("[alert]** Refused a registration whose record does not open to the initial credit")
+		return
+	}
 
 	newKey := anonServer.Suite.Point().Mul(publicKey, anonServer.Roundkey)
 	byteNewKey, err := newKey.MarshalBinary()
@@ -223,12 +409,48 @@ func handleClientRegisterServerSide(params map[string]interface{}) {
 		"public_key" : byteNewKey,
 		"addr" : params["addr"].(string),
 		"pcomm": params["pcomm"].([]byte),
+		"pcomm_proofs": proofs,
 	}
+	rand := anonServer.Suite.Cipher(abstract.RandomKey)
+	pm["signature"] = util.ElGamalSign(anonServer.Suite, rand, bridge.MessageOfClientRegister(pm), anonServer.PrivateKey, nil)
 	event := &proto.Event{EventType:proto.CLIENT_REGISTER_SERVERSIDE, Params:pm}
 	util.SendEvent(anonServer.LocalAddr, anonServer.NextHop, event)
 	// add into key map
 	fmt.Println("[debug] Receive client register request... ")
 	anonServer.KeyMap[newKey.String()] = publicKey
+	anonServer.NewRecords[newKey.String()] = record
+}
+
+// whether we pass on to the coordinator, and so registrations reach it
+// under the keys we send
+func isLastServer() bool {
+	return anonServer.NextHop.String() == anonServer.CoordinatorAddr.String()
+}
+
+// a key we did not announce must be a client registered in this round. The
+// last server passed its registration on to the coordinator under this very
+// key, so it checks the key and the record the client starts with, if given.
+// Other servers check their own keys of the records in the round-end pass
+func checkNewClient(key abstract.Point, record []abstract.Point, newRecords map[string][]abstract.Point) error {
+	if !isLastServer() {
+		return nil
+	}
+	registered, ok := newRecords[key.String()]
+	if !ok {
+		return errors.New("a new key was not registered through us")
+	}
+	if record == nil {
+		return nil
+	}
+	if len(record) != len(registered) {
+		return errors.New("record of a new client of a different size")
+	}
+	for dim := range record {
+		if !record[dim].Equal(registered[dim]) {
+			return errors.New("record of a new client differs from the registered one")
+		}
+	}
+	return nil
 }
 
 func handleUpdateNextHop(params map[string]interface{}) {
@@ -237,6 +459,13 @@ func handleUpdateNextHop(params map[string]interface{}) {
 	anonServer.NextHop = addr
 }
 
+// the coordinator dropped our previous hop from the chain
+func handleUpdatePreviousHop(params map[string]interface{}) {
+	addr, err := net.ResolveTCPAddr("tcp",params["prev_hop"].(string))
+	util.CheckErr(err)
+	anonServer.PreviousHop = addr
+}
+
 func handleAnnouncement(params map[string]interface{}) {
 	var g abstract.Point = nil
 	keyList := util.ProtobufDecodePointList(params["keys"].([]byte))
@@ -257,24 +486,24 @@ func handleAnnouncement(params map[string]interface{}) {
 		g = anonServer.Suite.Point()
 		g.UnmarshalBinary(byteG)
 		g = anonServer.Suite.Point().Mul(g, anonServer.Roundkey)
-		// verify the previous shuffle
-		verifyNeffShuffle(params)
+		// verify the previous hop's exponents and shuffle
+		if !checkPreviousHop(params, proto.ANNOUNCEMENT) {
+			return
+		}
 	}else {
 		g = anonServer.Suite.Point().Mul(nil, anonServer.Roundkey)
 	}
 
 	// update table
 	newKeys := make([]abstract.Point, size)
-	newVals := make([]abstract.Point, size)
 	for i := 0 ; i < len(keyList); i++ {
 		// encrypt the public key using modPow
 		newKeys[i] = anonServer.Suite.Point().Mul(keyList[i], anonServer.Roundkey)
-		// randomize PComm
-		PComm := anonServer.Suite.Point().Mul(valList[i], E)
-		newVals[i] = PComm
 		// update key map
 		anonServer.KeyMap[newKeys[i].String()] = keyList[i]
 	}
+	// randomize PComm of every dimension
+	newVals := randomizeCommitments(valList, E)
 	byteNewKeys := util.ProtobufEncodePointList(newKeys)
 	byteNewVals := util.ProtobufEncodePointList(newVals)
 	byteG := util.EncodePoint(g)
@@ -288,49 +517,38 @@ func handleAnnouncement(params map[string]interface{}) {
 			"GT": util.EncodePoint(GT),
 			"HT": util.EncodePoint(HT),
 		}
+		proveHop(pm, params, true, anonServer.Roundkey, E)
 		event := &proto.Event{EventType:proto.ANNOUNCEMENT, Params:pm}
 		util.SendEvent(anonServer.LocalAddr, anonServer.NextHop, event)
 		return
 	}
 
-	Xori := make([]abstract.Point, len(newVals))
-	for i:=0; i < size; i++ {
-		Xori[i] = anonServer.Suite.Point().Mul(nil, anonServer.PrivateKey)
-	}
-	byteOri := util.ProtobufEncodePointList(Xori)
-
 	rand := anonServer.Suite.Cipher(abstract.RandomKey)
-	// *** perform neff shuffle here ***
-	Xbar, Ybar, _, Ytmp, prover := neffShuffle(Xori,newKeys,rand)
-	prf, err := proof.HashProve(anonServer.Suite, "PairShuffle", rand, prover)
+	// *** perform neff shuffle here, over whole records of a key and its commitments ***
+	finalKeys, finalVals, Xbar, Ybar, prover := shuffle.ShuffleRecords(anonServer.Suite, newKeys, newVals, rand)
+	prf, err := proof.HashProve(anonServer.Suite, "RecordShuffle", rand, prover)
 	util.CheckErr(err)
 
-
-	// this is the shuffled key
-	finalKeys := convertToOrigin(Ybar, Ytmp)
-	finalVals := rebindReputation(newKeys, newVals, finalKeys)
-
 	// send data to the next server
 	byteXbar := util.ProtobufEncodePointList(Xbar)
 	byteYbar := util.ProtobufEncodePointList(Ybar)
 	byteFinalKeys := util.ProtobufEncodePointList(finalKeys)
 	byteFinalVals := util.ProtobufEncodePointList(finalVals)
-	bytePublicKey, _ := anonServer.PublicKey.MarshalBinary()
-	// prev keys means the key before shuffle
+	// prev keys and vals are the records before shuffle
 	pm := map[string]interface{}{
 		"xbar" : byteXbar,
 		"ybar" : byteYbar,
 		"keys" : byteFinalKeys,
 		"vals" : byteFinalVals,
 		"proof" : prf,
-		"prev_keys": byteOri,
-		"prev_vals": byteNewKeys,
+		"prev_keys": byteNewKeys,
+		"prev_vals": byteNewVals,
 		"shuffled": true,
-		"public_key" : bytePublicKey,
 		"g" : byteG,
 		"GT": util.EncodePoint(GT),
 		"HT": util.EncodePoint(HT),
 	}
+	proveHop(pm, params, true, anonServer.Roundkey, E)
 	event := &proto.Event{EventType:proto.ANNOUNCEMENT, Params:pm}
 	util.SendEvent(anonServer.LocalAddr, anonServer.NextHop, event)
 }
@@ -344,33 +562,136 @@ func handleAnnouncementFinalize(params map[string]interface{}) {
 	HT := util.DecodePoint(anonServer.Suite, params["HT"].([]byte))
 	anonServer.PedersenBase.GT = GT
 	anonServer.PedersenBase.HT = HT
+	anonServer.Epoch = params["epoch"].(int)
 
 	//construct Decrypted reputation map
 	keyList := util.ProtobufDecodePointList(params["keys"].([]byte))
 	valList := util.ProtobufDecodePointList(params["vals"].([]byte))
-	anonServer.EndingCommMap = make(map[string]abstract.Point)
+	records := bridge.SplitRecords(valList, len(keyList))
+	anonServer.EndingCommMap = make(map[string][]abstract.Point)
 	anonServer.EndingKeyMap = make(map[string]abstract.Point)
 	// anonServer.ReputationDiffMap = make(map[string]int)
 	// anonServer.AllClientsPublicKeys = keyList
 
 	for i := 0; i < len(keyList); i++ {
-		anonServer.AddIntoEndingMap(keyList[i], valList[i])
+		anonServer.AddIntoEndingMap(keyList[i], records[i])
 	}
 
 	// set new g
 	anonServer.G = g
+	// start tallying the votes of the new round
+	anonServer.Tally = bridge.NewTally(anonServer.Policy)
+	anonServer.AgreedKeys = nil
+	anonServer.AgreedTable = nil
+}
+
+// tally a vote forwarded by the coordinator after checking it on our own:
+// it is signed by a nym of this round, for an assignment we signed in this
+// round and made to the voter, with a valid proof if it is weighted
+func handleTallyVote(params map[string]interface{}) {
+	if !bridge.CheckEpoch(params, anonServer.Epoch) {
+		fmt.Println("[note]** Vote is not from this round")
+		return
+	}
+	nym, ok := anonServer.EndingKeyMap[util.DecodePoint(anonServer.Suite, params["nym"].([]byte)).String()]
+	if !ok {
+		fmt.Println("[note]** Voter is not a nym of this round")
+		return
+	}
+	err := util.ElGamalVerify(anonServer.Suite, bridge.MessageOfVote(params), nym, params["signature"].([]byte), anonServer.G)
+	if err != nil {
+		fmt.Println("[note]** Fails to verify the voter's signature")
+		return
+	}
+
+	assignment := bridge.DecodeAssignment(params["assignment"].([]byte))
+	if assignment.Epoch != anonServer.Epoch || !assignment.NymR.Equal(nym) {
+		fmt.Println("[note]** Vote is not for an assignment of the voter in this round")
+		return
+	}
+	signed := false
+	msgAssignment := bridge.MessageOfAssignment(assignment)
+	for _,sig := range util.Decode2DByteArray(params["signatures"].([]byte)) {
+		if util.ElGamalVerify(anonServer.Suite, msgAssignment, anonServer.PublicKey, sig, nil) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		fmt.Println("[note]** Vote is for an assignment we did not sign")
+		return
+	}
+
+	category := bridge.Category(params["category"].(int))
+	if !category.Valid() {
+		fmt.Println("[note]** Unknown feedback category")
+		return
+	}
+	multiplier := anonServer.Policy.UnweightedMultiplier()
+	if _, weighted := params["ind"]; weighted {
+		PCommr := bridge.CommOfDimension(anonServer.EndingCommMap[nym.String()], params)
+		if !bridge.VerifyInd(params, PCommr, anonServer.Policy, anonServer.Suite, anonServer.PedersenBase, anonServer.FujiOkamBase) {
+			fmt.Println("[note]** Fails to verify the voter's reputation")
+			return
+		}
+		multiplier = anonServer.Policy.VoteMultiplier(params["ind"].(int))
+	}
+	if !anonServer.Tally.Record(assignment, category, multiplier) {
+		fmt.Println("[note]** Assignment has been voted")
+		return
+	}
+	anonServer.Tally.CreditReport(assignment)
+	fmt.Println("[debug] Tallied feedback", category, "x", multiplier)
 }
 
-func handleSignAssignments(params map[string]interface{}, senderAddr *net.TCPAddr) {
+// sign the coordinator's diff table if it is the one our own tally gives.
+// Keys we did not announce are clients registered in this round, see checkNewClient
+func handleTallyCheck(params map[string]interface{}) {
+	keyList := util.ProtobufDecodePointList(params["keys"].([]byte))
+	table := util.Decode2DIntArray(params["diffs"].([]byte))
+	fresh := make(map[string]bool)
+	refused := false
+	for _,key := range keyList {
+		if _, ok := anonServer.EndingCommMap[key.String()]; !ok {
+			if err := checkNewClient(key, nil, anonServer.NewRecords); err != nil {
+				fmt.Println("[note]** " + err.Error())
+				refused = true
+			}
+			fresh[key.String()] = true
+		}
+	}
+	msg := bridge.MessageOfDiffTable(anonServer.Epoch, keyList, table)
+	myMsg := bridge.MessageOfDiffTable(anonServer.Epoch, keyList, anonServer.Tally.Table(keyList, fresh))
+
+	pm := map[string]interface{}{}
+	if !refused && bytes.Equal(msg, myMsg) && len(fresh) + len(anonServer.EndingCommMap) == len(keyList) {
+		rand := anonServer.Suite.Cipher(abstract.RandomKey)
+		pm["success"] = true
+		pm["signature"] = util.ElGamalSign(anonServer.Suite, rand, msg, anonServer.PrivateKey, nil)
+		anonServer.AgreedKeys = keyList
+		anonServer.AgreedTable = table
+		fmt.Println("[debug] Agreed on the tally")
+	} else {
+		pm["success"] = false
+		fmt.Println("[note]** Coordinator's tally differs from ours")
+	}
+	event := &proto.Event{EventType:proto.TALLY_SIGNATURE, Params:pm}
+	util.SendEvent(anonServer.LocalAddr, anonServer.CoordinatorAddr, event)
+}
+
+// sign the assignments the coordinator made for a request, replying to the
+// coordinator whoever relayed it
+func handleSignAssignments(params map[string]interface{}) {
+	senderAddr := anonServer.CoordinatorAddr
 	// extract info from params
 	nymR := anonServer.Suite.Point()
 	byteNymR := params["nym"].([]byte)
 	err := nymR.UnmarshalBinary(byteNymR)
 	util.CheckErr(err)
-	PCommr := anonServer.EndingCommMap[nymR.String()]
+	PCommr := bridge.CommOfDimension(anonServer.EndingCommMap[nymR.String()], params)
 
 	// verify the proof
-	if !bridge.VerifyInd(params, PCommr, anonServer.Suite, anonServer.PedersenBase, anonServer.FujiOkamBase) {
+	if !bridge.VerifyInd(params, PCommr, anonServer.Policy, anonServer.Suite, anonServer.PedersenBase, anonServer.FujiOkamBase) {
 		fmt.Print("[note]** Fails to verify the proof...")
 		pm := map[string]interface{}{
 			"success": false,
@@ -380,13 +701,21 @@ func handleSignAssignments(params map[string]interface{}, senderAddr *net.TCPAdd
 		return
 	}
 
-	// sign assignments
+	// sign assignments of this round only, made for the nym which proved its reputation
 	assignments := bridge.DecodeAssignmentList(params["assignments"].([]byte))
+	if err := bridge.CheckAssignments(assignments, nymR, anonServer.Epoch); err != nil {
+		fmt.Println("[note]** Refuse to sign assignments: " + err.Error())
+		pm := map[string]interface{}{
+			"success": false,
+		}
+		event := &proto.Event{EventType:proto.GOT_SIGNS, Params:pm}
+		util.SendEvent(anonServer.LocalAddr, senderAddr, event)
+		return
+	}
 	sigs := [][]byte{}
 	for _,assignment := range assignments {
-		byteAssignment := bridge.EncodeAssignment(&assignment)
-		rand := anonServer.Suite.Cipher([]byte("example"))
-		sig := util.ElGamalSign(anonServer.Suite, rand, byteAssignment, anonServer.PrivateKey, anonServer.Suite.Point())
+		rand := anonServer.Suite.Cipher(abstract.RandomKey)
+		sig := util.ElGamalSign(anonServer.Suite, rand, bridge.MessageOfAssignment(&assignment), anonServer.PrivateKey, nil)
 		sigs = append(sigs, sig)
 	}
 
@@ -401,6 +730,23 @@ func handleSignAssignments(params map[string]interface{}, senderAddr *net.TCPAdd
 	util.SendEvent(anonServer.LocalAddr, senderAddr, event)
 }
 
+// prove to the coordinator that we hold the private key
+func handleServerChallenge(params map[string]interface{}, addr *net.TCPAddr) {
+	msg := bridge.MessageOfServerChallenge(params["nonce"].([]byte), anonServer.LocalAddr.String())
+	rand := anonServer.Suite.Cipher(abstract.RandomKey)
+	sig := util.ElGamalSign(anonServer.Suite, rand, msg, anonServer.PrivateKey, nil)
+	pm := map[string]interface{}{
+		"signature": sig,
+	}
+	event := &proto.Event{EventType:proto.SERVER_CHALLENGE_RESPONSE, Params:pm}
+	util.SendEvent(anonServer.LocalAddr, addr, event)
+}
+
+func handleServerRegisterRefused(params map[string]interface{}) {
+	fmt.Println("[note]** Registration refused: " + params["reason"].(string))
+	os.Exit(1)
+}
+
 // handle server register reply
 func handleServerRegisterReply(params map[string]interface{}, addr *net.TCPAddr) {
 	reply := params["reply"].(bool)
@@ -425,6 +771,7 @@ func handleServerRegisterReply(params map[string]interface{}, addr *net.TCPAddr)
 	fujiokamBase.G6 = fujiokamBase.Point().FromBinary(params["g6"].([]byte))
 	fujiokamBase.H1 = fujiokamBase.Point().FromBinary(params["h1"].([]byte))
 	anonServer.FujiOkamBase = fujiokamBase
+	anonServer.Policy = bridge.DecodePolicy(params["policy"].([]byte))
 
 	// update h
 	h := anonServer.Suite.Point()
@@ -1,8 +1,10 @@
 package server
 
 import (
+	"encoding/hex"
 	"fmt"
 	"net"
+	"os"
 	"time"
 
 	// "log"
@@ -10,6 +12,7 @@ import (
 	"io"
 	"strconv"
 	"zRep/primitive/pedersen"
+	"zRep/cmd/transcript"
 	"zRep/proto"
 	"zRep/util"
 
@@ -62,28 +65,45 @@ func initAnonServer() {
 	util.CheckErr(err)
 	// initialize suite
 	suite := nist.NewAES128SHA256QR512()
-	a := suite.Secret().Pick(random.Stream)
+	a := util.LoadPrivateKey(suite, config["private_key_file"])
 	A := suite.Point().Mul(nil, a)
+	// operators add this key to the coordinator's trusted servers
+	fmt.Println("[debug] My public key is " + hex.EncodeToString(util.EncodePoint(A)))
 	RoundKey := suite.Secret().Pick(random.Stream)
+	// pin the coordinator's key, trusting the first key seen only if explicitly asked to
+	var coordinatorKey abstract.Point
+	trustFirstKey := util.GetIntParameter("trust_first_coordinator_key", 0) != 0
+	if hexKey := config["coordinator_public_key"]; hexKey != "" {
+		byteKey, err := hex.DecodeString(hexKey)
+		util.CheckErr(err)
+		coordinatorKey = util.DecodePoint(suite, byteKey)
+	} else if !trustFirstKey {
+		fmt.Println("[note]** coordinator_public_key is not configured, set it or set trust_first_coordinator_key=1")
+		os.Exit(1)
+	}
 	pedersenBase := pedersen.CreateMinimalBaseFromSuite(suite)
 
 	anonServer = &AnonServer{
 		CoordinatorAddr: CoordinatorAddr,
+		CoordinatorPublicKey: coordinatorKey,
+		TrustFirstKey: trustFirstKey,
 		Suite: suite,
 		PrivateKey: a,
 		PublicKey: A,
 		OnetimePseudoNym: suite.Point(),
 		G: nil,
-		EndingCommMap: make(map[string]abstract.Point),
+		EndingCommMap: make(map[string][]abstract.Point),
 		EndingKeyMap: make(map[string]abstract.Point),
 		IsConnected: false,
 		NextHop: CoordinatorAddr,
 		PreviousHop: CoordinatorAddr,
 		KeyMap: make(map[string]abstract.Point),
+		NewRecords: make(map[string][]abstract.Point),
 		A: nil,
 		Roundkey: RoundKey,
 		PedersenBase: pedersenBase,
 		FujiOkamBase: nil,
+		Transcript: transcript.Open(config["transcript_file"], suite, a),
 	}
 }
 
@@ -0,0 +1,141 @@
+// Package token lets a client prove to a third party, e.g. a forum or a
+// download portal, that it is a member of a round with reputation >= k in
+// some dimension, without telling which member it is. The third party checks
+// the token against the signed table of the round alone, see Round.
+//
+// A token is bound to the epoch and table root of its round, the service it
+// is made for and the service's nonce. It carries
+// * a linkable ring signature (lrs) by the keys of the table of the epoch,
+//   root and service. Its tag y0 is the same for every token of a member for
+//   one service in one round, so a service can tell a returning member apart
+//   from a new one without learning who either is,
+// * a fresh commitment comm = GT^rep * HT^r' to the member's reputation,
+// * a proof that for some i the prover knows x with keys[i] = g^x and
+//   y0 = h^x, h the link base of the ring signature, and t with
+//   records[i][dim] / comm = HT^t. So comm commits to the reputation of the
+//   member who made the ring signature, and the record itself is not shown,
+// * the proof of requestBridges that comm commits to at least ind.
+package token
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strconv"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/proof"
+	"zRep/cmd/bridge"
+	"zRep/primitive/fujiokam"
+	"zRep/primitive/lrs"
+	"zRep/primitive/pedersen"
+	"zRep/util"
+	"zRep/util/canonical"
+)
+
+// what a member knows of its own record in a round
+type Member struct {
+	Suite abstract.Suite
+	PrivateKey abstract.Secret
+	Epoch int
+	TableRoot []byte
+	G abstract.Point
+	// the whole table, in order, and our index in it
+	Keys []abstract.Point
+	Records [][]abstract.Point
+	Index int
+	// the opening of our record
+	Reputation []int
+	R []abstract.Secret
+	PedersenBase *pedersen.PedersenBase
+	FujiOkamBase *fujiokam.FujiOkamBase
+}
+
+// what the ring signature signs, the same for every token of the round and service
+func MessageOfScope(epoch int, root []byte, service string) []byte {
+	return canonical.New("token-scope").Int(epoch).Bytes(root).String(service).Encoded()
+}
+
+// the link proof is made under this name, so that it covers the whole claim
+func messageOfToken(tok map[string]interface{}) []byte {
+	e := canonical.New("membership-token")
+	e.Int(tok["epoch"].(int)).Bytes(tok["table_root"].([]byte))
+	e.String(tok["service"].(string)).Bytes(tok["nonce"].([]byte))
+	e.Int(tok["dim"].(int)).Int(tok["ind"].(int))
+	e.Bytes(tok["comm"].([]byte)).Bytes(tok["ring_signature"].([]byte))
+	return e.Encoded()
+}
+
+// OR over the records of the table of: keys[i] = x*g, y0 = x*L and
+// D[i] = t*H, with D[i] the record of i over comm
+func linkPredicate(n int) proof.Predicate {
+	branches := make([]proof.Predicate, n)
+	for i := range branches {
+		idx := strconv.Itoa(i)
+		branches[i] = proof.And(proof.Rep("K"+idx, "x", "g"), proof.Rep("Y0", "x", "L"), proof.Rep("D"+idx, "t", "H"))
+	}
+	return proof.Or(branches...)
+}
+
+func linkPoints(suite abstract.Suite, g, H, L, y0, comm abstract.Point, keys []abstract.Point, records [][]abstract.Point, dim int) map[string]abstract.Point {
+	points := map[string]abstract.Point{"g": g, "H": H, "L": L, "Y0": y0}
+	for i,key := range keys {
+		idx := strconv.Itoa(i)
+		points["K"+idx] = key
+		points["D"+idx] = suite.Point().Sub(records[i][dim], comm)
+	}
+	return points
+}
+
+// Make builds a token proving our reputation in dim is at least ind to service
+func Make(member *Member, service string, nonce []byte, dim int, ind int) []byte {
+	suite := member.Suite
+	base := member.PedersenBase
+	tok := map[string]interface{}{
+		"epoch": member.Epoch,
+		"table_root": member.TableRoot,
+		"service": service,
+		"nonce": nonce,
+		"dim": dim,
+		"ind": ind,
+	}
+
+	// ring signature of the scope by the keys of the table
+	n := len(member.Keys)
+	lrsBase := lrs.CreateBase(util.PointToBigInt(member.G))
+	scope := MessageOfScope(member.Epoch, member.TableRoot, service)
+	sig := lrsBase.Sign(scope, n, member.Index, member.PrivateKey, member.Keys)
+	tok["ring_signature"] = lrs.ProtobufEncodeSignature(sig)
+
+	// a fresh commitment to our reputation, linked to our record
+	rep := suite.Secret().SetInt64(int64(member.Reputation[dim]))
+	comm, r := base.Commit(rep)
+	tok["comm"] = util.EncodePoint(comm)
+	L := util.BigIntToPoint(suite, lrsBase.LinkBase(scope, member.Keys))
+	points := linkPoints(suite, member.G, base.HT, L, util.BigIntToPoint(suite, sig.Y0), comm, member.Keys, member.Records, dim)
+	secrets := map[string]abstract.Secret{
+		"x": member.PrivateKey,
+		"t": suite.Secret().Sub(member.R[dim], r),
+	}
+	pred := linkPredicate(n)
+	prover := pred.Prover(suite, secrets, points, map[proof.Predicate]int{pred: member.Index})
+	prf, err := proof.HashProve(suite, string(messageOfToken(tok)), suite.Cipher(abstract.RandomKey), prover)
+	util.CheckErr(err)
+	tok["link_proof"] = prf
+
+	// and the threshold proof on the fresh commitment
+	bridge.FillIndProof(tok, suite, base, member.FujiOkamBase, ind, member.Reputation[dim], comm, r)
+	return Encode(tok)
+}
+
+func Encode(tok map[string]interface{}) []byte {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(tok)
+	util.CheckErr(err)
+	return buf.Bytes()
+}
+
+func Decode(data []byte) (map[string]interface{}, error) {
+	var tok map[string]interface{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&tok)
+	return tok, err
+}
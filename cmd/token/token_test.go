@@ -0,0 +1,150 @@
+package token
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/nist"
+	"github.com/dedis/crypto/random"
+	"zRep/cmd/bridge"
+	"zRep/primitive/fujiokam"
+	"zRep/primitive/pedersen"
+	"zRep/proto"
+	"zRep/util"
+)
+
+// the TABLE event of a round whose members have reputations, signed by coordinatorKey
+func signedTable(suite abstract.Suite, coordinatorKey abstract.Secret, members []*Member, fujiokamBase *fujiokam.FujiOkamBase) map[string]interface{} {
+	base := members[0].PedersenBase
+	tree := bridge.TableTree(members[0].Keys, bridge.FlattenRecords(members[0].Records))
+	table := map[string]interface{}{
+		"epoch": members[0].Epoch,
+		"g": util.EncodePoint(members[0].G),
+		"GT": util.EncodePoint(base.GT),
+		"HT": util.EncodePoint(base.HT),
+		"table_root": tree.Root(),
+		"table_size": tree.Size(),
+		"keys": util.ProtobufEncodePointList(members[0].Keys),
+		"vals": util.ProtobufEncodePointList(bridge.FlattenRecords(members[0].Records)),
+		"n": fujiokamBase.N.Bytes(),
+		"g1": fujiokamBase.G1.ToBinary(),
+		"g2": fujiokamBase.G2.ToBinary(),
+		"g3": fujiokamBase.G3.ToBinary(),
+		"g4": fujiokamBase.G4.ToBinary(),
+		"g5": fujiokamBase.G5.ToBinary(),
+		"g6": fujiokamBase.G6.ToBinary(),
+		"h1": fujiokamBase.H1.ToBinary(),
+	}
+	table["table_signature"] = util.ElGamalSign(suite, random.Stream, bridge.MessageOfTableRoot(table), coordinatorKey, nil)
+	signTable(suite, coordinatorKey, table)
+	for _,member := range members {
+		member.TableRoot = tree.Root()
+	}
+	return table
+}
+
+func signTable(suite abstract.Suite, coordinatorKey abstract.Secret, table map[string]interface{}) {
+	delete(table, "coordinator_signature")
+	table["coordinator_key"] = util.EncodePoint(suite.Point().Mul(nil, coordinatorKey))
+	event := &proto.Event{EventType:proto.TABLE, Params:table}
+	table["coordinator_signature"] = util.ElGamalSign(suite, random.Stream, util.MessageOfEvent(event, "coordinator_signature"), coordinatorKey, nil)
+}
+
+func TestToken(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	coordinatorKey := suite.Secret().Pick(random.Stream)
+	pedersenBase := pedersen.CreateBaseFromSuite(suite)
+	fujiokamBase := fujiokam.CreateBase()
+	g := suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
+
+	// three members with a reputation in two dimensions
+	reputations := [][]int{{7, 1}, {2, 3}, {5, 0}}
+	keys := make([]abstract.Point, len(reputations))
+	records := make([][]abstract.Point, len(reputations))
+	members := make([]*Member, len(reputations))
+	for i,reputation := range reputations {
+		member := &Member{
+			Suite: suite,
+			PrivateKey: suite.Secret().Pick(random.Stream),
+			Epoch: 3,
+			G: g,
+			Keys: keys,
+			Records: records,
+			Index: i,
+			Reputation: reputation,
+			PedersenBase: pedersenBase,
+			FujiOkamBase: fujiokamBase,
+		}
+		keys[i] = suite.Point().Mul(g, member.PrivateKey)
+		records[i] = make([]abstract.Point, len(reputation))
+		member.R = make([]abstract.Secret, len(reputation))
+		for dim,rep := range reputation {
+			records[i][dim], member.R[dim] = pedersenBase.Commit(suite.Secret().SetInt64(int64(rep)))
+		}
+		members[i] = member
+	}
+	table := signedTable(suite, coordinatorKey, members, fujiokamBase)
+	coordinator := suite.Point().Mul(nil, coordinatorKey)
+	round, err := NewRound(suite, coordinator, table)
+	if err != nil {
+		t.Fatal("Fails to check the signed table:", err)
+	}
+
+	nonce := []byte("nonce")
+	tok := Make(members[0], "forum", nonce, 0, 5)
+	tag, err := round.Verify(tok, "forum", nonce, 0, 5)
+	if err != nil {
+		t.Fatal("Honest token rejected:", err)
+	}
+	expected := map[string]error{
+		"higher threshold": ErrThreshold,
+		"other dimension": ErrThreshold,
+		"other service": ErrScope,
+		"other nonce": ErrScope,
+		"garbage": ErrMalformed,
+	}
+	got := map[string]error{}
+	_, got["higher threshold"] = round.Verify(tok, "forum", nonce, 0, 6)
+	_, got["other dimension"] = round.Verify(tok, "forum", nonce, 1, 5)
+	_, got["other service"] = round.Verify(tok, "portal", nonce, 0, 5)
+	_, got["other nonce"] = round.Verify(tok, "forum", []byte("other"), 0, 5)
+	_, got["garbage"] = round.Verify([]byte("garbage"), "forum", nonce, 0, 5)
+	for name,err := range expected {
+		if got[name] != err {
+			t.Error("Token checked with", name, "gives", got[name], "instead of", err)
+		}
+	}
+
+	// tokens of a member for a service are linked, those of others are not
+	tag2, err := round.Verify(Make(members[0], "forum", []byte("again"), 0, 1), "forum", []byte("again"), 0, 1)
+	if err != nil || !bytes.Equal(tag, tag2) {
+		t.Error("Tokens of the same member for the same service are not linked")
+	}
+	tag3, err := round.Verify(Make(members[1], "forum", nonce, 1, 3), "forum", nonce, 1, 3)
+	if err != nil || bytes.Equal(tag, tag3) {
+		t.Error("Tokens of different members are linked:", err)
+	}
+
+	// a member claiming more than its record commits to
+	liar := *members[1]
+	liar.Reputation = []int{7, 3}
+	if _, err := round.Verify(Make(&liar, "forum", nonce, 0, 5), "forum", nonce, 0, 5); err != ErrLink {
+		t.Error("Token of a member lying on its reputation gives", err)
+	}
+
+	// tokens of another round, and tables not signed by the coordinator
+	other := *members[0]
+	other.Epoch = 4
+	if _, err := round.Verify(Make(&other, "forum", nonce, 0, 5), "forum", nonce, 0, 5); err != ErrRound {
+		t.Error("Token of another round gives", err)
+	}
+	table["vals"] = table["keys"]
+	if _, err := NewRound(suite, coordinator, table); err != ErrTableSignature {
+		t.Error("Tampered table gives", err)
+	}
+	signTable(suite, coordinatorKey, table)
+	if _, err := NewRound(suite, coordinator, table); err != ErrTable {
+		t.Error("Table not matching its signed root gives", err)
+	}
+}
@@ -0,0 +1,131 @@
+package token
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/proof"
+	"zRep/cmd/bridge"
+	"zRep/primitive/fujiokam"
+	"zRep/primitive/lrs"
+	"zRep/primitive/pedersen"
+	"zRep/proto"
+	"zRep/util"
+)
+
+var ErrTableSignature = errors.New("table is not signed by the coordinator")
+var ErrTable = errors.New("table does not match its signed root")
+var ErrMalformed = errors.New("token is malformed")
+var ErrRound = errors.New("token is made for another round")
+var ErrScope = errors.New("token is made for another service or nonce")
+var ErrRing = errors.New("ring signature does not verify against the table")
+var ErrLink = errors.New("commitment is not linked to a record of the signer")
+var ErrThreshold = errors.New("token does not prove the reputation asked for")
+
+// Round is what a third party needs to check tokens of a round, all of which
+// comes from the coordinator's signed table, the TABLE event it answers to a
+// TABLE_REQUEST without a nym.
+type Round struct {
+	Suite abstract.Suite
+	Epoch int
+	TableRoot []byte
+	G abstract.Point
+	Keys []abstract.Point
+	Records [][]abstract.Point
+	PedersenBase *pedersen.PedersenBase
+	FujiOkamBase *fujiokam.FujiOkamBase
+}
+
+// NewRound checks the signed table, params of the TABLE event, against the
+// coordinator's key and keeps what tokens of its round are checked against
+func NewRound(suite abstract.Suite, coordinatorKey abstract.Point, table map[string]interface{}) (round *Round, err error) {
+	defer func() {
+		if recover() != nil {
+			round, err = nil, ErrTable
+		}
+	}()
+	event := &proto.Event{EventType:proto.TABLE, Params:table}
+	sig, ok := table["coordinator_signature"].([]byte)
+	if !ok || util.ElGamalVerify(suite, util.MessageOfEvent(event, "coordinator_signature"), coordinatorKey, sig, nil) != nil {
+		return nil, ErrTableSignature
+	}
+	if err := bridge.CheckTableRoot(suite, table, coordinatorKey); err != nil {
+		return nil, ErrTable
+	}
+	keys := util.ProtobufDecodePointList(table["keys"].([]byte))
+	N := new(big.Int).SetBytes(table["n"].([]byte))
+	fujiokamBase := fujiokam.CreateMinimumBase(suite, N)
+	fujiokamBase.G1 = fujiokamBase.Point().FromBinary(table["g1"].([]byte))
+	fujiokamBase.G2 = fujiokamBase.Point().FromBinary(table["g2"].([]byte))
+	fujiokamBase.G3 = fujiokamBase.Point().FromBinary(table["g3"].([]byte))
+	fujiokamBase.G4 = fujiokamBase.Point().FromBinary(table["g4"].([]byte))
+	fujiokamBase.G5 = fujiokamBase.Point().FromBinary(table["g5"].([]byte))
+	fujiokamBase.G6 = fujiokamBase.Point().FromBinary(table["g6"].([]byte))
+	fujiokamBase.H1 = fujiokamBase.Point().FromBinary(table["h1"].([]byte))
+	return &Round{
+		Suite: suite,
+		Epoch: table["epoch"].(int),
+		TableRoot: table["table_root"].([]byte),
+		G: util.DecodePoint(suite, table["g"].([]byte)),
+		Keys: keys,
+		Records: bridge.SplitRecords(util.ProtobufDecodePointList(table["vals"].([]byte)), len(keys)),
+		PedersenBase: &pedersen.PedersenBase{
+			Suite: suite,
+			GT: util.DecodePoint(suite, table["GT"].([]byte)),
+			HT: util.DecodePoint(suite, table["HT"].([]byte)),
+		},
+		FujiOkamBase: fujiokamBase,
+	}, nil
+}
+
+// Verify checks that the token was made for service and nonce in this round
+// by a member whose reputation in dim is at least k. It returns the member's
+// tag, which is the same for all its tokens for service in this round.
+func (round *Round) Verify(byteToken []byte, service string, nonce []byte, dim int, k int) (tag []byte, err error) {
+	defer func() {
+		if recover() != nil {
+			tag, err = nil, ErrMalformed
+		}
+	}()
+	tok, err := Decode(byteToken)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if tok["epoch"].(int) != round.Epoch || !bytes.Equal(tok["table_root"].([]byte), round.TableRoot) {
+		return nil, ErrRound
+	}
+	if tok["service"].(string) != service || !bytes.Equal(tok["nonce"].([]byte), nonce) {
+		return nil, ErrScope
+	}
+	ind := tok["ind"].(int)
+	if tok["dim"].(int) != dim || ind < k {
+		return nil, ErrThreshold
+	}
+
+	// a member of the table signed the scope
+	n := len(round.Keys)
+	lrsBase := lrs.CreateBase(util.PointToBigInt(round.G))
+	scope := MessageOfScope(round.Epoch, round.TableRoot, service)
+	sig := lrs.ProtobufDecodeSignature(tok["ring_signature"].([]byte))
+	if len(sig.S) != n || len(sig.C) != n || !lrsBase.Verify(scope, n, 0, sig, round.Keys) {
+		return nil, ErrRing
+	}
+
+	// the same member's record commits to what comm does
+	suite := round.Suite
+	comm := util.DecodePoint(suite, tok["comm"].([]byte))
+	L := util.BigIntToPoint(suite, lrsBase.LinkBase(scope, round.Keys))
+	points := linkPoints(suite, round.G, round.PedersenBase.HT, L, util.BigIntToPoint(suite, sig.Y0), comm, round.Keys, round.Records, dim)
+	verifier := linkPredicate(n).Verifier(suite, points)
+	if proof.HashVerify(suite, string(messageOfToken(tok)), verifier, tok["link_proof"].([]byte)) != nil {
+		return nil, ErrLink
+	}
+
+	// and comm commits to at least ind
+	if !bridge.VerifyIndProof(tok, ind, comm, suite, round.PedersenBase, round.FujiOkamBase) {
+		return nil, ErrThreshold
+	}
+	return sig.Y0.Bytes(), nil
+}
@@ -0,0 +1,61 @@
+package transcript
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/nist"
+	"zRep/util"
+)
+
+// Main runs `zrep verify [-coordinator <hex key>] <transcript>...` and
+// returns the exit code: 0 if every entry of every transcript verifies.
+// Pass the coordinator's transcript first, so that the entries of servers
+// and clients are checked against the rounds it recorded.
+func Main(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	hexKey := flags.String("coordinator", "", "hex-encoded public key of the coordinator, pinned from the first setup entry if empty")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		fmt.Println("usage: zrep verify [-coordinator <hex key>] <transcript>...")
+		return 2
+	}
+	suite := nist.NewAES128SHA256QR512()
+	var coordinator abstract.Point
+	if *hexKey != "" {
+		byteKey, err := hex.DecodeString(*hexKey)
+		if err != nil {
+			fmt.Println("[note]** Bad coordinator key: " + err.Error())
+			return 2
+		}
+		coordinator = util.DecodePoint(suite, byteKey)
+	}
+
+	verifier := NewVerifier(suite, coordinator)
+	failed := 0
+	for _,path := range flags.Args() {
+		entries, err := Read(path)
+		if err != nil {
+			fmt.Println("[note]** Fails to read " + path + ": " + err.Error())
+			failed++
+		}
+		for i,entry := range entries {
+			if err := verifier.Verify(entry); err != nil {
+				fmt.Printf("[note]** %s: entry %d (%s, round %d) failed: %s\n", path, i, entry.Kind, entry.Epoch, err)
+				failed++
+				continue
+			}
+			fmt.Printf("[debug] %s: entry %d (%s, round %d) passed\n", path, i, entry.Kind, entry.Epoch)
+		}
+	}
+	if failed > 0 {
+		fmt.Println("[verify] Transcripts failed,", failed, "error(s)")
+		return 1
+	}
+	fmt.Println("[verify] All transcripts passed")
+	return 0
+}
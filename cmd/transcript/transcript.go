@@ -0,0 +1,146 @@
+// Package transcript keeps a file of the signed artefacts of each round, so
+// that a round can be checked offline by anyone with `zrep verify`.
+//
+// A transcript is a sequence of entries, each of them a 4-byte big-endian
+// length followed by the gob encoding of an Entry. Every party appends to its
+// own file (`transcript_file`) and signs each entry with its long-term key.
+package transcript
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/dedis/crypto/abstract"
+	"zRep/proto"
+	"zRep/util"
+	"zRep/util/canonical"
+)
+
+// kinds of entries
+const (
+	// coordinator: the servers' keys, the commitment parameters and the policy
+	// of the round, as the announcement ran with them
+	SETUP = "setup"
+	// coordinator: what it sent to the first hop of the announcement (start),
+	// and what it received from the last one with the chain of hops (final)
+	ANNOUNCEMENT = "announcement"
+	// coordinator: the same for the round end, the start carries the
+	// published update, the votes and the servers' signatures of the tally
+	ROUND_END = "round_end"
+	// server: a hop it sent, with the proofs and hop_signature, and the phase
+	HOP = "hop"
+	// client: an event received from the coordinator, with its signature
+	EVENT = "event"
+)
+
+type Entry struct {
+	Kind string
+	Epoch int
+	// encoded public key of the party who appended the entry
+	Party []byte
+	Params map[string]interface{}
+	Signature []byte
+}
+
+// what a party signs for an entry
+func MessageOfEntry(entry *Entry) []byte {
+	params := util.MessageOfEvent(&proto.Event{EventType:0, Params:entry.Params}, "")
+	return canonical.New("transcript-entry").String(entry.Kind).Int(entry.Epoch).Bytes(entry.Party).Bytes(params).Encoded()
+}
+
+// Writer appends signed entries to a transcript file
+type Writer struct {
+	Path string
+	Suite abstract.Suite
+	PrivateKey abstract.Secret
+	PublicKey abstract.Point
+	lock sync.Mutex
+}
+
+// open the transcript at path, nil if path is empty, which records nothing
+func Open(path string, suite abstract.Suite, privateKey abstract.Secret) *Writer {
+	if path == "" {
+		return nil
+	}
+	return &Writer{
+		Path: path,
+		Suite: suite,
+		PrivateKey: privateKey,
+		PublicKey: suite.Point().Mul(nil, privateKey),
+	}
+}
+
+// sign and append an entry
+func (w *Writer) Append(kind string, epoch int, params map[string]interface{}) {
+	if w == nil {
+		return
+	}
+	entry := &Entry{
+		Kind: kind,
+		Epoch: epoch,
+		Party: util.EncodePoint(w.PublicKey),
+		Params: params,
+	}
+	rand := w.Suite.Cipher(abstract.RandomKey)
+	entry.Signature = util.ElGamalSign(w.Suite, rand, MessageOfEntry(entry), w.PrivateKey, nil)
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(entry)
+	util.CheckErr(err)
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(buf.Len()))
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	file, err := os.OpenFile(w.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	util.CheckErr(err)
+	defer file.Close()
+	_, err = file.Write(append(length[:], buf.Bytes()...))
+	util.CheckErr(err)
+}
+
+// read all the entries of a transcript
+func Read(path string) ([]*Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries := []*Entry{}
+	for {
+		var length [4]byte
+		if _, err := io.ReadFull(file, length[:]); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return entries, err
+		}
+		data := make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(file, data); err != nil {
+			return entries, err
+		}
+		entry := &Entry{}
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(entry); err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// encode the parameters of a message kept in an entry
+func EncodeParams(params map[string]interface{}) []byte {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(params)
+	util.CheckErr(err)
+	return buf.Bytes()
+}
+
+func DecodeParams(data []byte) map[string]interface{} {
+	var params map[string]interface{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&params)
+	util.CheckErr(err)
+	return params
+}
@@ -0,0 +1,145 @@
+package transcript
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/nist"
+	"github.com/dedis/crypto/random"
+	"zRep/cmd/bridge"
+	"zRep/cmd/bridge/bridgetest"
+	"zRep/primitive/fujiokam"
+	"zRep/proto"
+	"zRep/util"
+)
+
+func setupParams(suite abstract.Suite, servers []abstract.Point) map[string]interface{} {
+	byteServers := [][]byte{}
+	for _,server := range servers {
+		byteServers = append(byteServers, util.EncodePoint(server))
+	}
+	// the verifier only decodes the Fujisaki-Okamoto parameters
+	base := fujiokam.CreateMinimumBase(suite, big.NewInt(23))
+	g := base.Point().SetBigInt(big.NewInt(2)).ToBinary()
+	return map[string]interface{}{
+		"servers": util.Encode2DByteArray(byteServers),
+		"policy": bridge.EncodePolicy(&bridge.DefaultPolicy),
+		"n": base.N.Bytes(),
+		"g1": g, "g2": g, "g3": g, "g4": g, "g5": g, "g6": g, "h1": g,
+	}
+}
+
+// the signed root of the table of final, with vals as its commitments
+func rootParams(suite abstract.Suite, coordinatorKey abstract.Secret, final map[string]interface{}, vals []byte) map[string]interface{} {
+	tree := bridge.TableTree(util.ProtobufDecodePointList(final["keys"].([]byte)), util.ProtobufDecodePointList(vals))
+	pm := map[string]interface{}{
+		"epoch": 1,
+		"table_root": tree.Root(),
+		"table_size": tree.Size(),
+	}
+	for _,name := range []string{"g", "GT", "HT"} {
+		pm[name] = final[name]
+	}
+	pm["table_signature"] = util.ElGamalSign(suite, random.Stream, bridge.MessageOfTableRoot(pm), coordinatorKey, nil)
+	return pm
+}
+
+// an event signed by the coordinator, as a client records it
+func signedEvent(suite abstract.Suite, coordinatorKey abstract.Secret, eventType int, pm map[string]interface{}) map[string]interface{} {
+	event := &proto.Event{EventType:eventType, Params:pm}
+	event.Params["epoch"] = 1
+	event.Params["coordinator_key"] = util.EncodePoint(suite.Point().Mul(nil, coordinatorKey))
+	rand := suite.Cipher(abstract.RandomKey)
+	event.Params["coordinator_signature"] = util.ElGamalSign(suite, rand, util.MessageOfEvent(event, "coordinator_signature"), coordinatorKey, nil)
+	return map[string]interface{}{
+		"event_type": eventType,
+		"event": EncodeParams(event.Params),
+	}
+}
+
+func TestAnnouncementTranscript(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	dir, err := ioutil.TempDir("", "transcript")
+	util.CheckErr(err)
+	defer os.RemoveAll(dir)
+	coordinatorKey := suite.Secret().Pick(random.Stream)
+	serverKey := suite.Secret().Pick(random.Stream)
+	clientKey := suite.Secret().Pick(random.Stream)
+	coordinator := Open(filepath.Join(dir, "coordinator"), suite, coordinatorKey)
+	server := Open(filepath.Join(dir, "server"), suite, serverKey)
+	client := Open(filepath.Join(dir, "client"), suite, clientKey)
+	if Open("", suite, coordinatorKey) != nil {
+		t.Error("A transcript without a path is kept")
+	}
+
+	// one server announces a table of two records of two commitments
+	start := map[string]interface{}{
+		"keys": util.ProtobufEncodePointList(bridgetest.RandomPoints(suite, 2)),
+		"vals": util.ProtobufEncodePointList(bridgetest.RandomPoints(suite, 4)),
+		"GT": util.EncodePoint(bridgetest.RandomPoints(suite, 1)[0]),
+		"HT": util.EncodePoint(bridgetest.RandomPoints(suite, 1)[0]),
+		"epoch": 1,
+	}
+	final := bridgetest.NextHop(suite, start, serverKey)
+	coordinator.Append(SETUP, 1, setupParams(suite, []abstract.Point{suite.Point().Mul(nil, serverKey)}))
+	coordinator.Append(ANNOUNCEMENT, 1, map[string]interface{}{
+		"start": EncodeParams(start),
+		"final": EncodeParams(final),
+	})
+	hop := bridge.HopRecord(final)
+	hop["phase"] = proto.ANNOUNCEMENT
+	server.Append(HOP, 1, hop)
+	client.Append(EVENT, 1, signedEvent(suite, coordinatorKey, proto.ANNOUNCEMENT_FINALIZE,
+		rootParams(suite, coordinatorKey, final, final["vals"].([]byte))))
+	// a table the announcement did not end with
+	client.Append(EVENT, 1, signedEvent(suite, coordinatorKey, proto.ANNOUNCEMENT_FINALIZE,
+		rootParams(suite, coordinatorKey, final, util.ProtobufEncodePointList(bridgetest.RandomPoints(suite, 4)))))
+
+	verifier := NewVerifier(suite, nil)
+	expected := map[string][]error{
+		"coordinator": {nil, nil},
+		"server": {nil},
+		"client": {nil, ErrTable},
+	}
+	for _,name := range []string{"coordinator", "server", "client"} {
+		entries, err := Read(filepath.Join(dir, name))
+		if err != nil || len(entries) != len(expected[name]) {
+			t.Fatal("Fails to read back the transcript of the", name, err)
+		}
+		for i,entry := range entries {
+			if err := verifier.Verify(entry); err != expected[name][i] {
+				t.Error("Entry", i, "of the", name, "gives", err, "instead of", expected[name][i])
+			}
+		}
+	}
+
+	// entries must be signed by their party, and the coordinator's by the pinned key
+	entries, _ := Read(filepath.Join(dir, "coordinator"))
+	entries[1].Epoch = 2
+	if verifier.Verify(entries[1]) != ErrEntrySignature {
+		t.Error("A tampered entry passes")
+	}
+	entries, _ = Read(filepath.Join(dir, "server"))
+	entries[0].Kind = ANNOUNCEMENT
+	entries[0].Signature = util.ElGamalSign(suite, random.Stream, MessageOfEntry(entries[0]), serverKey, nil)
+	if verifier.Verify(entries[0]) != ErrNotCoordinator {
+		t.Error("A server records an announcement")
+	}
+
+	// the hop must be signed by the server of the round
+	other := Open(filepath.Join(dir, "other"), suite, coordinatorKey)
+	otherKey := suite.Secret().Pick(random.Stream)
+	final = bridgetest.NextHop(suite, start, otherKey)
+	other.Append(ANNOUNCEMENT, 1, map[string]interface{}{
+		"start": EncodeParams(start),
+		"final": EncodeParams(final),
+	})
+	entries, _ = Read(filepath.Join(dir, "other"))
+	if verifier.Verify(entries[0]) != ErrHopSigner {
+		t.Error("An announcement by another server passes")
+	}
+}
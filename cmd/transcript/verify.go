@@ -0,0 +1,439 @@
+package transcript
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+
+	"github.com/dedis/crypto/abstract"
+	"zRep/cmd/bridge"
+	"zRep/primitive/fujiokam"
+	"zRep/primitive/pedersen"
+	"zRep/proto"
+	"zRep/util"
+)
+
+var ErrEntrySignature = errors.New("entry is not signed by its party")
+var ErrNotCoordinator = errors.New("entry is not appended by the coordinator")
+var ErrNoCoordinator = errors.New("no coordinator key, pass the coordinator's transcript first or -coordinator")
+var ErrUnknownRound = errors.New("entry belongs to a round without a setup or an announcement")
+var ErrEntryMalformed = errors.New("entry is missing or has malformed parameters")
+var ErrHopSigner = bridge.ErrHopSigner
+var ErrTable = errors.New("table differs from the one of the round")
+var ErrVote = errors.New("a vote behind the diffs does not verify")
+var ErrTally = errors.New("the diffs are not the tally of the votes")
+var ErrTallySignature = errors.New("the diffs are not signed by every server")
+
+// what the verifier learnt of a round from the entries so far
+type round struct {
+	servers []abstract.Point
+	policy *bridge.Policy
+	fujiokamBase *fujiokam.FujiOkamBase
+
+	// the table the announcement ended with
+	announced bool
+	final map[string]interface{}
+	g abstract.Point
+	pedersenBase *pedersen.PedersenBase
+	keys map[string]abstract.Point
+	records map[string][]abstract.Point
+
+	// the diffs applied at round end, and the table after it
+	ended bool
+	diffs map[string][]int
+	breakdown []int
+	endRecords map[string][]abstract.Point
+}
+
+// Verifier replays transcripts. Entries must come in the order of their
+// rounds, and the coordinator's before those of servers and clients, which
+// are checked against what the coordinator recorded when it is known.
+type Verifier struct {
+	Suite abstract.Suite
+	// pinned from the first setup entry if not given
+	Coordinator abstract.Point
+	rounds map[int]*round
+}
+
+func NewVerifier(suite abstract.Suite, coordinator abstract.Point) *Verifier {
+	return &Verifier{
+		Suite: suite,
+		Coordinator: coordinator,
+		rounds: make(map[int]*round),
+	}
+}
+
+// Verify checks an entry and what it records, and learns the round from it
+func (v *Verifier) Verify(entry *Entry) (err error) {
+	defer func() {
+		if recover() != nil {
+			err = ErrEntryMalformed
+		}
+	}()
+	party := util.DecodePoint(v.Suite, entry.Party)
+	if util.ElGamalVerify(v.Suite, MessageOfEntry(entry), party, entry.Signature, nil) != nil {
+		return ErrEntrySignature
+	}
+	switch entry.Kind {
+	case SETUP, ANNOUNCEMENT, ROUND_END:
+		if v.Coordinator == nil && entry.Kind == SETUP {
+			v.Coordinator = party
+		}
+		if v.Coordinator == nil {
+			return ErrNoCoordinator
+		}
+		if !party.Equal(v.Coordinator) {
+			return ErrNotCoordinator
+		}
+	}
+	switch entry.Kind {
+	case SETUP:
+		return v.verifySetup(entry)
+	case ANNOUNCEMENT:
+		return v.verifyAnnouncement(entry)
+	case ROUND_END:
+		return v.verifyRoundEnd(entry)
+	case HOP:
+		return v.verifyHop(entry, party)
+	case EVENT:
+		return v.verifyEvent(entry)
+	}
+	return errors.New("unknown kind of entry " + entry.Kind)
+}
+
+func (v *Verifier) verifySetup(entry *Entry) error {
+	params := entry.Params
+	servers := []abstract.Point{}
+	for _,byteKey := range util.Decode2DByteArray(params["servers"].([]byte)) {
+		servers = append(servers, util.DecodePoint(v.Suite, byteKey))
+	}
+	N := new(big.Int).SetBytes(params["n"].([]byte))
+	fujiokamBase := fujiokam.CreateMinimumBase(v.Suite, N)
+	fujiokamBase.G1 = fujiokamBase.Point().FromBinary(params["g1"].([]byte))
+	fujiokamBase.G2 = fujiokamBase.Point().FromBinary(params["g2"].([]byte))
+	fujiokamBase.G3 = fujiokamBase.Point().FromBinary(params["g3"].([]byte))
+	fujiokamBase.G4 = fujiokamBase.Point().FromBinary(params["g4"].([]byte))
+	fujiokamBase.G5 = fujiokamBase.Point().FromBinary(params["g5"].([]byte))
+	fujiokamBase.G6 = fujiokamBase.Point().FromBinary(params["g6"].([]byte))
+	fujiokamBase.H1 = fujiokamBase.Point().FromBinary(params["h1"].([]byte))
+	v.rounds[entry.Epoch] = &round{
+		servers: servers,
+		policy: bridge.DecodePolicy(params["policy"].([]byte)),
+		fujiokamBase: fujiokamBase,
+	}
+	return nil
+}
+
+// the records of a table by key
+func (v *Verifier) recordsOf(params map[string]interface{}) (map[string]abstract.Point, map[string][]abstract.Point) {
+	keyList := util.ProtobufDecodePointList(params["keys"].([]byte))
+	records := bridge.SplitRecords(util.ProtobufDecodePointList(params["vals"].([]byte)), len(keyList))
+	keys := make(map[string]abstract.Point)
+	recordMap := make(map[string][]abstract.Point)
+	for i,key := range keyList {
+		keys[key.String()] = key
+		recordMap[key.String()] = records[i]
+	}
+	return keys, recordMap
+}
+
+func (v *Verifier) verifyAnnouncement(entry *Entry) error {
+	r, ok := v.rounds[entry.Epoch]
+	if !ok {
+		return ErrUnknownRound
+	}
+	start := DecodeParams(entry.Params["start"].([]byte))
+	final := DecodeParams(entry.Params["final"].([]byte))
+	if start["epoch"] != entry.Epoch {
+		return bridge.ErrHopChain
+	}
+	hops := bridge.DecodeHops(final["hops"].([]byte))
+	if err := bridge.VerifyHops(v.Suite, hops, start, final, r.servers, true); err != nil {
+		return err
+	}
+
+	// the round starts from the table the last round ended with, skipping
+	// rounds aborted before their round end
+	for epoch := entry.Epoch-1; ; epoch-- {
+		prev, ok := v.rounds[epoch]
+		if !ok {
+			break
+		}
+		if !prev.ended {
+			continue
+		}
+		_, records := v.recordsOf(start)
+		if !sameRecords(records, prev.endRecords) {
+			return ErrTable
+		}
+		break
+	}
+
+	r.announced = true
+	r.final = final
+	r.g = util.DecodePoint(v.Suite, final["g"].([]byte))
+	r.pedersenBase = &pedersen.PedersenBase{
+		Suite: v.Suite,
+		GT: util.DecodePoint(v.Suite, final["GT"].([]byte)),
+		HT: util.DecodePoint(v.Suite, final["HT"].([]byte)),
+	}
+	r.keys, r.records = v.recordsOf(final)
+	return nil
+}
+
+func (v *Verifier) verifyRoundEnd(entry *Entry) error {
+	r, ok := v.rounds[entry.Epoch]
+	if !ok || !r.announced {
+		return ErrUnknownRound
+	}
+	start := DecodeParams(entry.Params["start"].([]byte))
+	final := DecodeParams(entry.Params["final"].([]byte))
+	if start["epoch"] != entry.Epoch {
+		return bridge.ErrHopChain
+	}
+	hops := bridge.DecodeHops(final["hops"].([]byte))
+	if err := bridge.VerifyHops(v.Suite, hops, start, final, r.servers, false); err != nil {
+		return err
+	}
+
+	// the pass starts from the published update, which must hold
+	if !bytes.Equal(start["keys"].([]byte), start["update_keys"].([]byte)) ||
+		!bytes.Equal(start["vals"].([]byte), start["update_new"].([]byte)) {
+		return ErrTable
+	}
+	keyList := util.ProtobufDecodePointList(start["update_keys"].([]byte))
+	oldVals := util.ProtobufDecodePointList(start["update_old"].([]byte))
+	newVals := util.ProtobufDecodePointList(start["update_new"].([]byte))
+	diffs := util.DecodeIntArray(start["update_diffs"].([]byte))
+	rDiffs := util.ProtobufDecodeSecretList(start["update_rdiffs"].([]byte))
+	if err := bridge.VerifyUpdate(r.pedersenBase, oldVals, newVals, diffs, rDiffs); err != nil {
+		return err
+	}
+
+	// every announced record is updated from what was announced,
+	// the other keys are clients registered in this round
+	records := bridge.SplitRecords(oldVals, len(keyList))
+	fresh := make(map[string]bool)
+	for i,key := range keyList {
+		announced, ok := r.records[key.String()]
+		if !ok {
+			fresh[key.String()] = true
+			continue
+		}
+		if len(announced) != len(records[i]) {
+			return ErrTable
+		}
+		for dim := range announced {
+			if !announced[dim].Equal(records[i][dim]) {
+				return ErrTable
+			}
+		}
+	}
+	if len(keyList) != len(fresh) + len(r.records) {
+		return ErrTable
+	}
+
+	// replay the tally from the signed votes
+	tally := bridge.NewTally(r.policy)
+	for _,vote := range bridge.DecodeVotes(start["votes"].([]byte)) {
+		if err := v.recordVote(r, tally, vote, entry.Epoch); err != nil {
+			return err
+		}
+	}
+	table := tally.Table(keyList, fresh)
+	flat := []int{}
+	for _,row := range table {
+		flat = append(flat, row...)
+	}
+	if len(flat) != len(diffs) {
+		return ErrTally
+	}
+	for i := range flat {
+		if flat[i] != diffs[i] {
+			return ErrTally
+		}
+	}
+
+	// and every server signed these diffs
+	msg := bridge.MessageOfDiffTable(entry.Epoch, keyList, table)
+	signatures := util.Decode2DByteArray(start["tally_signatures"].([]byte))
+	if len(signatures) != len(r.servers) {
+		return ErrTallySignature
+	}
+	for i,server := range r.servers {
+		if util.ElGamalVerify(v.Suite, msg, server, signatures[i], nil) != nil {
+			return ErrTallySignature
+		}
+	}
+
+	r.ended = true
+	r.diffs = make(map[string][]int)
+	breakdowns := make([][]int, len(keyList))
+	for i,key := range keyList {
+		r.diffs[key.String()] = table[i]
+		breakdowns[i] = tally.Breakdown(key)
+	}
+	r.breakdown = bridge.ColumnTotals(breakdowns, bridge.NumCategories)
+	_, r.endRecords = v.recordsOf(final)
+	return nil
+}
+
+// check a vote the way the coordinator and servers did, and tally it
+func (v *Verifier) recordVote(r *round, tally *bridge.Tally, vote map[string]interface{}, epoch int) error {
+	nym, ok := r.keys[util.DecodePoint(v.Suite, vote["nym"].([]byte)).String()]
+	if !ok || !bridge.CheckEpoch(vote, epoch) {
+		return ErrVote
+	}
+	if util.ElGamalVerify(v.Suite, bridge.MessageOfVote(vote), nym, vote["signature"].([]byte), r.g) != nil {
+		return ErrVote
+	}
+	assignment := bridge.DecodeAssignment(vote["assignment"].([]byte))
+	if assignment.Epoch != epoch || !assignment.NymR.Equal(nym) {
+		return ErrVote
+	}
+	// signed by every server and then the coordinator
+	signatures := util.Decode2DByteArray(vote["signatures"].([]byte))
+	if len(signatures) != len(r.servers) + 1 {
+		return ErrVote
+	}
+	msgAssignment := bridge.MessageOfAssignment(assignment)
+	for i,key := range append(r.servers, v.Coordinator) {
+		if util.ElGamalVerify(v.Suite, msgAssignment, key, signatures[i], nil) != nil {
+			return ErrVote
+		}
+	}
+	category := bridge.Category(vote["category"].(int))
+	if !category.Valid() {
+		return ErrVote
+	}
+	multiplier := 1
+	if _, weighted := vote["ind"]; weighted {
+		PCommr := bridge.CommOfDimension(r.records[nym.String()], vote)
+		if !bridge.VerifyInd(vote, PCommr, r.policy, v.Suite, r.pedersenBase, r.fujiokamBase) {
+			return ErrVote
+		}
+		multiplier = r.policy.VoteMultiplier(vote["ind"].(int))
+	}
+	if !tally.Record(assignment, category, multiplier) {
+		return ErrVote
+	}
+	return nil
+}
+
+func (v *Verifier) verifyHop(entry *Entry, party abstract.Point) error {
+	hop := entry.Params
+	if hop["epoch"] != entry.Epoch {
+		return bridge.ErrHopChain
+	}
+	if !bridge.SignedBy(v.Suite, hop, party) {
+		return ErrHopSigner
+	}
+	if r, ok := v.rounds[entry.Epoch]; ok {
+		found := false
+		for _,server := range r.servers {
+			if server.Equal(party) {
+				found = true
+			}
+		}
+		if !found {
+			return ErrHopSigner
+		}
+	}
+	return bridge.CheckHop(v.Suite, hop, hop["phase"].(int) == proto.ANNOUNCEMENT)
+}
+
+// an event a client received, which must be signed by the coordinator and,
+// if the round is known, carry what the coordinator recorded: the signed root
+// of the announced table, and the totals of the round end
+func (v *Verifier) verifyEvent(entry *Entry) error {
+	if v.Coordinator == nil {
+		return ErrNoCoordinator
+	}
+	event := &proto.Event{
+		EventType: entry.Params["event_type"].(int),
+		Params: DecodeParams(entry.Params["event"].([]byte)),
+	}
+	msg := util.MessageOfEvent(event, "coordinator_signature")
+	sig, ok := event.Params["coordinator_signature"].([]byte)
+	if !ok || util.ElGamalVerify(v.Suite, msg, v.Coordinator, sig, nil) != nil {
+		return ErrNotCoordinator
+	}
+	r, ok := v.rounds[entry.Epoch]
+	if !ok {
+		return nil
+	}
+	switch event.EventType {
+	case proto.ANNOUNCEMENT_FINALIZE:
+		if !r.announced {
+			return nil
+		}
+		for _,name := range []string{"g", "GT", "HT"} {
+			if !bytes.Equal(event.Params[name].([]byte), r.final[name].([]byte)) {
+				return ErrTable
+			}
+		}
+		// the signed root commits to the table the announcement ended with
+		table := make(map[string]interface{})
+		for name,val := range event.Params {
+			table[name] = val
+		}
+		table["keys"] = r.final["keys"]
+		table["vals"] = r.final["vals"]
+		if bridge.CheckTableRoot(v.Suite, table, v.Coordinator) != nil {
+			return ErrTable
+		}
+	case proto.ROUND_END:
+		if !r.ended {
+			return nil
+		}
+		// the diffs are sealed to each nym, only the keys and totals can be checked
+		keyList := util.ProtobufDecodePointList(event.Params["keys"].([]byte))
+		sealed := util.Decode2DByteArray(event.Params["sealed"].([]byte))
+		if len(keyList) != len(r.diffs) || len(sealed) != len(keyList) || event.Params["updated"].(int) != len(keyList) {
+			return ErrTally
+		}
+		table := [][]int{}
+		for _,key := range keyList {
+			diffs, ok := r.diffs[key.String()]
+			if !ok {
+				return ErrTally
+			}
+			table = append(table, diffs)
+		}
+		if !sameInts(util.DecodeIntArray(event.Params["total_diffs"].([]byte)), bridge.ColumnTotals(table, r.policy.NumDimensions())) ||
+			!sameInts(util.DecodeIntArray(event.Params["total_breakdown"].([]byte)), r.breakdown) {
+			return ErrTally
+		}
+	}
+	return nil
+}
+
+func sameInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameRecords(a, b map[string][]abstract.Point) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key,recordA := range a {
+		recordB, ok := b[key]
+		if !ok || len(recordA) != len(recordB) {
+			return false
+		}
+		for dim := range recordA {
+			if !recordA[dim].Equal(recordB[dim]) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+// Package dleq proves that a list of points are all raised to the same
+// secret exponent, Q[i] = x * P[i], without revealing x.
+//
+// The pairs after the first are batched into one with random weights hashed
+// from all the points, A = sum w_i * P[i], B = sum w_i * Q[i], and a
+// Chaum-Pedersen proof shows log_P[0] Q[0] = log_A B.
+package dleq
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/dedis/crypto/abstract"
+	"zRep/util/canonical"
+)
+
+var ErrLength = errors.New("dleq: lists of different or zero length")
+var ErrProof = errors.New("dleq: invalid proof")
+
+type dleqProof struct {
+	C abstract.Secret // challenge
+	R abstract.Secret // response
+}
+
+// batch the pairs after the first one
+func batch(suite abstract.Suite, P, Q []abstract.Point) (A, B abstract.Point) {
+	e := canonical.New("dleq-weights").Points(P).Points(Q)
+	c := suite.Cipher(e.Sum(sha256.New()))
+	A = suite.Point().Null()
+	B = suite.Point().Null()
+	tmp := suite.Point()
+	for i := 1; i < len(P); i++ {
+		w := suite.Secret().Pick(c)
+		A.Add(A, tmp.Mul(P[i], w))
+		B.Add(B, tmp.Mul(Q[i], w))
+	}
+	return
+}
+
+func challenge(suite abstract.Suite, P, Q []abstract.Point, T1, T2 abstract.Point) abstract.Secret {
+	e := canonical.New("dleq").Points(P).Points(Q).Point(T1).Point(T2)
+	return suite.Secret().Pick(suite.Cipher(e.Sum(sha256.New())))
+}
+
+// prove Q[i] = x * P[i] for every i
+func Prove(suite abstract.Suite, x abstract.Secret, P, Q []abstract.Point) []byte {
+	if len(P) == 0 || len(P) != len(Q) {
+		panic(ErrLength.Error())
+	}
+	A, _ := batch(suite, P, Q)
+
+	// commit with a random v, then respond r = v - c*x
+	v := suite.Secret().Pick(suite.Cipher(abstract.RandomKey))
+	T1 := suite.Point().Mul(P[0], v)
+	T2 := suite.Point().Mul(A, v)
+	c := challenge(suite, P, Q, T1, T2)
+	r := suite.Secret()
+	r.Mul(x, c).Sub(v, r)
+
+	buf := bytes.Buffer{}
+	prf := dleqProof{c, r}
+	abstract.Write(&buf, &prf, suite)
+	return buf.Bytes()
+}
+
+// verify Q[i] = x * P[i] for every i, for the x the proof was made with
+func Verify(suite abstract.Suite, P, Q []abstract.Point, proof []byte) error {
+	if len(P) == 0 || len(P) != len(Q) {
+		return ErrLength
+	}
+	prf := dleqProof{}
+	if err := abstract.Read(bytes.NewBuffer(proof), &prf, suite); err != nil {
+		return err
+	}
+	A, B := batch(suite, P, Q)
+
+	// T = r*P + c*Q, which is v*P for the right x
+	tmp := suite.Point()
+	T1 := suite.Point().Mul(P[0], prf.R)
+	T1.Add(T1, tmp.Mul(Q[0], prf.C))
+	T2 := suite.Point().Mul(A, prf.R)
+	T2.Add(T2, tmp.Mul(B, prf.C))
+	if !challenge(suite, P, Q, T1, T2).Equal(prf.C) {
+		return ErrProof
+	}
+	return nil
+}
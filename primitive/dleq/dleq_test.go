@@ -0,0 +1,53 @@
+package dleq
+
+import (
+	"testing"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/nist"
+	"github.com/dedis/crypto/random"
+)
+
+func raise(suite abstract.Suite, x abstract.Secret, n int) (P, Q []abstract.Point) {
+	P = make([]abstract.Point, n)
+	Q = make([]abstract.Point, n)
+	for i := 0; i < n; i++ {
+		P[i] = suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
+		Q[i] = suite.Point().Mul(P[i], x)
+	}
+	return
+}
+
+func TestDLEQ(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	x := suite.Secret().Pick(random.Stream)
+	for _,n := range []int{1, 2, 5} {
+		P, Q := raise(suite, x, n)
+		if err := Verify(suite, P, Q, Prove(suite, x, P, Q)); err != nil {
+			t.Error("Fails to verify", n, "pairs:", err)
+		}
+	}
+}
+
+func TestDLEQWrongExponent(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	x := suite.Secret().Pick(random.Stream)
+	P, Q := raise(suite, x, 4)
+	proof := Prove(suite, x, P, Q)
+
+	// one point raised to another exponent
+	Q[2] = suite.Point().Mul(P[2], suite.Secret().Pick(random.Stream))
+	if Verify(suite, P, Q, proof) == nil {
+		t.Error("A point raised to another exponent passes")
+	}
+	// a proof made with another exponent
+	Q[2] = suite.Point().Mul(P[2], x)
+	if Verify(suite, P, Q, Prove(suite, suite.Secret().Pick(random.Stream), P, Q)) == nil {
+		t.Error("A proof with another exponent passes")
+	}
+	// two points swapped
+	Q[1], Q[2] = Q[2], Q[1]
+	if Verify(suite, P, Q, proof) == nil {
+		t.Error("Swapped points pass")
+	}
+}
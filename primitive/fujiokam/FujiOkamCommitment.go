@@ -7,6 +7,7 @@ import (
 	"math"
 	"crypto/sha256"
 	"os/exec"
+	"zRep/util/canonical"
 )
 
 type FujiOkamBase struct {
@@ -459,11 +460,7 @@ func (base *FujiOkamBase) ProveNonnegHelper(x *big.Int, commitx *Point, rc *big.
 	// commitrx = g^rx * h^rrx (mod n)
 	commitrx, rrx := base.Commit(rx)
 	// e = hash(commitx, C, Cr)
-	h := sha256.New()
-	h.Write(commitx.V.Bytes())
-	h.Write(C.V.Bytes())
-	h.Write(Cr.V.Bytes())
-	eBuf := h.Sum(nil)
+	eBuf := canonical.New("fujiokam-nonneg").BigInts([]*big.Int{&commitx.V, &C.V, &Cr.V}).Sum(sha256.New())
 	e := new(big.Int)
 	e.SetBytes(eBuf)
 	// x' := xe + rx
@@ -497,11 +494,7 @@ func (base *FujiOkamBase) VerifyNonneg(commitx *Point, arg *ARGnonneg) bool {
 
 func (base *FujiOkamBase) VerifyNonnegHelper(commitx, commitrx, C, Cr *Point, R, x_, a_, b_, d_, r_ *big.Int) bool {
 	// e := hash(commitx, C, Cr)
-	h := sha256.New()
-	h.Write(commitx.V.Bytes())
-	h.Write(C.V.Bytes())
-	h.Write(Cr.V.Bytes())
-	eBuf := h.Sum(nil)
+	eBuf := canonical.New("fujiokam-nonneg").BigInts([]*big.Int{&commitx.V, &C.V, &Cr.V}).Sum(sha256.New())
 	e := new(big.Int)
 	e.SetBytes(eBuf)
 	// delta' := e*(4*x' + e) - a'^2 - b'^2 - d'^2
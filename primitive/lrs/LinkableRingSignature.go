@@ -100,6 +100,17 @@ func (base *LRSBase) computeh(m []byte, L []byte) *big.Int {
 	return base.H2(buf.Bytes())
 }
 
+// LinkBase returns h, the base of the linking tag y0 = h^x{pi} of a
+// signature of m by the ring y, so that other proofs can show they are
+// made with the same key as the signature
+func (base *LRSBase) LinkBase(m []byte, y []abstract.Point) *big.Int {
+	yRaw := make([]*big.Int, len(y))
+	for i, yi := range y {
+		yRaw[i] = util.PointToBigInt(yi)
+	}
+	return base.computeh(m, computeL(yRaw))
+}
+
 func (base *LRSBase) Sign(m []byte, n int, pi int, xpi abstract.Secret, y []abstract.Point) *Signature {
 	xpiRaw := util.SecretToBigInt(xpi)
 	yRaw := make([]*big.Int, len(y))
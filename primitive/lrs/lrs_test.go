@@ -4,6 +4,12 @@ import (
 	"testing"
 	"math/big"
 	// "fmt"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/nist"
+	"github.com/dedis/crypto/random"
+
+	"zRep/util"
 )
 
 func TestSign(t *testing.T) {
@@ -49,6 +55,29 @@ func TestLinkable(t *testing.T) {
 	}
 }
 
+func TestLinkBase(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	g := suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
+	base := CreateBase(util.PointToBigInt(g))
+
+	m := []byte("hello world")
+	n := 2
+	x := make([]abstract.Secret, n)
+	y := make([]abstract.Point, n)
+	for i := range x {
+		x[i] = suite.Secret().Pick(random.Stream)
+		y[i] = suite.Point().Mul(g, x[i])
+	}
+	sig := base.Sign(m, n, 1, x[1], y)
+	if !base.Verify(m, n, 1, sig, y) {
+		t.Error("verification failed")
+	}
+	h := util.BigIntToPoint(suite, base.LinkBase(m, y))
+	if util.PointToBigInt(suite.Point().Mul(h, x[1])).Cmp(sig.Y0) != 0 {
+		t.Error("Y0 should have been h^x of the signer")
+	}
+}
+
 func TestEncoding(t *testing.T) {
 	g := new(big.Int).SetInt64(4)
 	base := CreateBase(g)
@@ -5,6 +5,7 @@ import (
 
 	"zRep/primitive/fujiokam"
 	"zRep/primitive/pedersen"
+	"zRep/util/canonical"
 
 	"github.com/dedis/crypto/abstract"
 	"github.com/dedis/crypto/nist"
@@ -52,10 +53,8 @@ func ProveEqual(pedersenBase *pedersen.PedersenBase, fujiokamBase *fujiokam.Fuji
 	byteT2 := T2.ToBinary()
 
 	// c := hash(T1 || T2)
-	hash := suite.Hash()
-	hash.Write(byteT1)
-	hash.Write(byteT2)
-	cBuf := hash.Sum(nil)
+	hash := canonical.New("pedersen-fujiokam-equal").Bytes(byteT1).Bytes(byteT2)
+	cBuf := hash.Sum(suite.Hash())
 	cRaw := new(big.Int)
 	cRaw.SetBytes(cBuf)
 
@@ -100,10 +99,8 @@ func VerifyEqual(pedersenBase *pedersen.PedersenBase, fujiokamBase *fujiokam.Fuj
 	byteT2 := T2.ToBinary()
 
 	// c := hash(T1 || T2)
-	hash := pedersenBase.Suite.Hash()
-	hash.Write(byteT1)
-	hash.Write(byteT2)
-	RSideBuf := hash.Sum(nil)
+	hash := canonical.New("pedersen-fujiokam-equal").Bytes(byteT1).Bytes(byteT2)
+	RSideBuf := hash.Sum(pedersenBase.Suite.Hash())
 	RSide := new(big.Int)
 	RSide.SetBytes(RSideBuf)
 
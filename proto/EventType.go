@@ -38,8 +38,8 @@ const GN_HONESTY_CHALLENGE = 16
 const GN_HONESTY_ANSWER = 17
 // update H for Pedersen Commitment
 const UPDATE_PEDERSEN_H = 18
-
-const BCAST_PEDERSEN_RDIFF = 19
+// rDiffs are now sealed to each nym in ROUND_END
+// const BCAST_PEDERSEN_RDIFF = 19
 
 const INIT_PEDERSEN_R = 20
 // client posts a new bridge
@@ -51,4 +51,34 @@ const SIGN_ASSIGNMENTS = 23
 // servers sends back signatures for assignments
 const GOT_SIGNS = 24
 
-const ANNOUNCEMENT_FINALIZE = 25
\ No newline at end of file
+const ANNOUNCEMENT_FINALIZE = 25
+// bridge provider moves its bridge to the nym of the new round
+const REBIND_BRIDGE = 26
+// coordinator tells a client that its quota of an action is used up
+const QUOTA_EXCEEDED = 27
+// coordinator refuses a client registration
+const CLIENT_REGISTER_REFUSED = 28
+// coordinator asks a registering server to sign a nonce
+const SERVER_CHALLENGE = 29
+// server sends back the signed nonce
+const SERVER_CHALLENGE_RESPONSE = 30
+// coordinator refuses a server registration
+const SERVER_REGISTER_REFUSED = 31
+// coordinator forwards an accepted vote to every server to tally
+const TALLY_VOTE = 32
+// coordinator asks every server to sign the diff table of the round end
+const TALLY_CHECK = 33
+// server replies its signature of the diff table, or refuses it
+const TALLY_SIGNATURE = 34
+// client asks for the chain of hops of this round's announcement
+const SHUFFLE_PROOFS_REQUEST = 35
+// coordinator replies the chain of hops with their shuffle proofs
+const SHUFFLE_PROOFS = 36
+// server reports a previous hop whose proofs fail, with the signed hop as evidence
+const BLAME = 37
+// coordinator dropped a server, the receiving server links to a new previous hop
+const UPDATE_PREVIOUS_HOP = 38
+// client asks for its record of this round's table, or the whole table
+const TABLE_REQUEST = 39
+// coordinator replies the record with its path in the Merkle tree, or the whole table
+const TABLE = 40
@@ -4,6 +4,7 @@ import (
 	"log"
 	"bufio"
 	"strings"
+	"strconv"
 )
 
 
@@ -25,6 +26,15 @@ func GetParameter(name string) string {
 	return config[name]
 }
 
+// return the parameter as an integer, or def if it is missing or malformed
+func GetIntParameter(name string, def int) int {
+	val, err := strconv.Atoi(GetParameter(name))
+	if err != nil {
+		return def
+	}
+	return val
+}
+
 func readLocalProperties() {
 	readConfig("config/local.properties")
 }
@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"crypto/cipher"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"io/ioutil"
 	"log"
+	"sort"
+	"strings"
 
 	"github.com/dedis/crypto/abstract"
 
@@ -24,6 +28,7 @@ import (
 	"zRep/primitive/fujiokam"
 	"zRep/primitive/pedersen_fujiokam"
 	"zRep/proto"
+	"zRep/util/canonical"
 )
 
 func SerializeTwoDimensionArray(arr [][]byte) []ByteArray{
@@ -78,6 +83,15 @@ func DecodeEvent(content []byte) (*proto.Event, *net.TCPAddr) {
 	return event, addr
 }
 
+// the host part of a connection's address, e.g. of conn.RemoteAddr()
+func HostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
 func CheckErr(err error) {
 	if err != nil {
 		panic(err.Error())
@@ -254,6 +268,27 @@ func DecodeIntArray(data []byte) []int {
 	return arr
 }
 
+func Encode2DIntArray(arr [][]int) []byte {
+	var buf bytes.Buffer
+	encoder := gob.NewEncoder(&buf)
+	err := encoder.Encode(arr)
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func Decode2DIntArray(data []byte) [][]int {
+	var arr [][]int
+	buf := bytes.NewReader(data)
+	decoder := gob.NewDecoder(buf)
+	err := decoder.Decode(&arr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return arr
+}
+
 func ProtobufEncodePointList(plist []abstract.Point) []byte {
 	byteNym, err := protobuf.Encode(&PointList{plist})
 	if err != nil {
@@ -441,7 +476,61 @@ signatureBuffer []byte, g abstract.Point) error {
 }
 
 
-func ElGamalEncrypt(suite abstract.Suite, pubkey abstract.Point, M abstract.Point) (
+// MessageOfEvent builds the message signed for an event: the event type, then
+// every parameter but skip in the order of their names, with the canonical
+// encoding. Values are tagged with their type, so that no two different
+// events have the same message.
+func MessageOfEvent(event *proto.Event, skip string) []byte {
+	names := []string{}
+	for name,_ := range event.Params {
+		if name != skip {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	e := canonical.New("event")
+	e.Int(event.EventType)
+	e.Int(len(names))
+	for _,name := range names {
+		e.String(name)
+		switch v := event.Params[name].(type) {
+		case []byte:
+			e.Int(0).Bytes(v)
+		case int:
+			e.Int(1).Int(v)
+		case string:
+			e.Int(2).String(v)
+		case bool:
+			e.Int(3).Bool(v)
+		default:
+			e.Int(4).Bytes(Encode(v))
+		}
+	}
+	return e.Encoded()
+}
+
+// load a long-term private key kept in hex in path, generating and saving
+// it on first use. An empty path gives a fresh key every run.
+func LoadPrivateKey(suite abstract.Suite, path string) abstract.Secret {
+	if path == "" {
+		return suite.Secret().Pick(random.Stream)
+	}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		byteKey, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		CheckErr(err)
+		return DecodeSecret(suite, byteKey)
+	}
+	a := suite.Secret().Pick(random.Stream)
+	byteKey, err := a.MarshalBinary()
+	CheckErr(err)
+	err = ioutil.WriteFile(path, []byte(hex.EncodeToString(byteKey)), 0600)
+	CheckErr(err)
+	return a
+}
+
+// pubkey should be g^x, where g is the base used by the key owner (nil for standard base)
+func ElGamalEncrypt(suite abstract.Suite, pubkey abstract.Point, M abstract.Point, g abstract.Point) (
 K, C abstract.Point, remainder []byte) {
 
 	// Embed the message (or as much of it as will fit) into a curve point.
@@ -449,7 +538,7 @@ K, C abstract.Point, remainder []byte) {
 
 	// ElGamal-encrypt the point to produce ciphertext (K,C).
 	k := suite.Secret().Pick(random.Stream) // ephemeral private key
-	K = suite.Point().Mul(nil, k)           // ephemeral DH public key
+	K = suite.Point().Mul(g, k)             // ephemeral DH public key
 	S := suite.Point().Mul(pubkey, k)       // ephemeral DH shared secret
 	C = S.Add(S, M)                         // message blinded with secret
 	return
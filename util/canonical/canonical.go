@@ -0,0 +1,128 @@
+// Package canonical builds the bytes that get signed or hashed.
+//
+// Every message starts with a domain string naming what it is, followed by
+// its fields in a fixed order. Each field is encoded so that its end is known
+// without looking at the next one:
+//
+//	bytes, string   4-byte big-endian length, then the bytes
+//	int             8-byte big-endian two's complement
+//	bool            1 byte, 0 or 1
+//	big integer     1 sign byte (0 for >= 0, 1 for < 0), then the magnitude as bytes
+//	point, secret   their MarshalBinary output as bytes
+//	list            4-byte big-endian count, then each element
+//
+// So two different messages never have the same encoding, and messages of
+// different domains never collide.
+package canonical
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"math/big"
+
+	"github.com/dedis/crypto/abstract"
+)
+
+// prefix of every domain
+const Prefix string = "zRep/v1/"
+
+type Encoder struct {
+	buf bytes.Buffer
+}
+
+// start a message of the given domain
+func New(domain string) *Encoder {
+	e := &Encoder{}
+	e.String(Prefix + domain)
+	return e
+}
+
+func (e *Encoder) length(n int) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(n))
+	e.buf.Write(b[:])
+}
+
+func (e *Encoder) Bytes(data []byte) *Encoder {
+	e.length(len(data))
+	e.buf.Write(data)
+	return e
+}
+
+func (e *Encoder) String(s string) *Encoder {
+	return e.Bytes([]byte(s))
+}
+
+func (e *Encoder) Int(n int) *Encoder {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(int64(n)))
+	e.buf.Write(b[:])
+	return e
+}
+
+func (e *Encoder) Bool(v bool) *Encoder {
+	if v {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+	return e
+}
+
+// unlike big.Int.Bytes, keeps the sign, so that n and -n differ
+func (e *Encoder) BigInt(n *big.Int) *Encoder {
+	e.Bool(n.Sign() < 0)
+	return e.Bytes(new(big.Int).Abs(n).Bytes())
+}
+
+func (e *Encoder) Point(p abstract.Point) *Encoder {
+	data, err := p.MarshalBinary()
+	if err != nil {
+		panic(err.Error())
+	}
+	return e.Bytes(data)
+}
+
+func (e *Encoder) Secret(s abstract.Secret) *Encoder {
+	data, err := s.MarshalBinary()
+	if err != nil {
+		panic(err.Error())
+	}
+	return e.Bytes(data)
+}
+
+func (e *Encoder) BytesList(list [][]byte) *Encoder {
+	e.length(len(list))
+	for _,data := range list {
+		e.Bytes(data)
+	}
+	return e
+}
+
+func (e *Encoder) Points(list []abstract.Point) *Encoder {
+	e.length(len(list))
+	for _,p := range list {
+		e.Point(p)
+	}
+	return e
+}
+
+func (e *Encoder) BigInts(list []*big.Int) *Encoder {
+	e.length(len(list))
+	for _,n := range list {
+		e.BigInt(n)
+	}
+	return e
+}
+
+// the encoded message
+func (e *Encoder) Encoded() []byte {
+	return e.buf.Bytes()
+}
+
+// hash the encoded message with h
+func (e *Encoder) Sum(h hash.Hash) []byte {
+	h.Write(e.buf.Bytes())
+	return h.Sum(nil)
+}
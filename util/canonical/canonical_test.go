@@ -0,0 +1,47 @@
+package canonical
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+)
+
+func TestSignedBigInt(t *testing.T) {
+	// big.Int.Bytes drops the sign
+	a := New("test").BigInt(big.NewInt(1)).Encoded()
+	b := New("test").BigInt(big.NewInt(-1)).Encoded()
+	if bytes.Equal(a, b) {
+		t.Error("1 and -1 have the same encoding")
+	}
+}
+
+func TestLengthPrefix(t *testing.T) {
+	// the same bytes split differently between fields
+	a := New("test").Bytes([]byte("ab")).Bytes([]byte("c")).Encoded()
+	b := New("test").Bytes([]byte("a")).Bytes([]byte("bc")).Encoded()
+	if bytes.Equal(a, b) {
+		t.Error("fields are not length-prefixed")
+	}
+	c := New("test").BytesList([][]byte{[]byte("a"), []byte("b")}).Encoded()
+	d := New("test").BytesList([][]byte{[]byte("ab")}).Encoded()
+	if bytes.Equal(c, d) {
+		t.Error("lists are not length-prefixed")
+	}
+}
+
+func TestDomain(t *testing.T) {
+	a := New("vote").Int(1).Encoded()
+	b := New("post-bridge").Int(1).Encoded()
+	if bytes.Equal(a, b) {
+		t.Error("domains are not separated")
+	}
+}
+
+func TestInt(t *testing.T) {
+	// a fixed width, so that other implementations can reproduce it
+	e := New("").Int(-1).Encoded()
+	tail := e[len(e)-8:]
+	if !bytes.Equal(tail, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}) {
+		t.Error("unexpected encoding of -1:", tail)
+	}
+}
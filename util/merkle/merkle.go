@@ -0,0 +1,123 @@
+// Package merkle builds a Merkle tree over a list of leaves, and proves and
+// checks that a leaf is at some index of the list the root commits to.
+//
+// The tree is the one of RFC 6962: a leaf hashes as SHA-256(0x00 || leaf),
+// a node as SHA-256(0x01 || left || right), and a list of n > 1 leaves
+// splits into the first k leaves, k the largest power of two below n, and
+// the rest. The root of an empty list is SHA-256 of nothing.
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+type Tree struct {
+	// hashes of the leaves
+	leaves [][]byte
+	root []byte
+}
+
+func hashLeaf(leaf []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+func hashNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// largest power of two below n, n > 1
+func split(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+func New(leaves [][]byte) *Tree {
+	t := &Tree{leaves: make([][]byte, len(leaves))}
+	for i,leaf := range leaves {
+		t.leaves[i] = hashLeaf(leaf)
+	}
+	if len(leaves) == 0 {
+		sum := sha256.Sum256(nil)
+		t.root = sum[:]
+	} else {
+		t.root = subtreeRoot(t.leaves)
+	}
+	return t
+}
+
+func subtreeRoot(hashes [][]byte) []byte {
+	if len(hashes) == 1 {
+		return hashes[0]
+	}
+	k := split(len(hashes))
+	return hashNode(subtreeRoot(hashes[:k]), subtreeRoot(hashes[k:]))
+}
+
+func (t *Tree) Root() []byte {
+	return t.root
+}
+
+func (t *Tree) Size() int {
+	return len(t.leaves)
+}
+
+// the hashes of the siblings on the path from the leaf at index to the
+// root, from the bottom up
+func (t *Tree) Prove(index int) [][]byte {
+	return path(t.leaves, index)
+}
+
+func path(hashes [][]byte, index int) [][]byte {
+	if len(hashes) <= 1 {
+		return [][]byte{}
+	}
+	k := split(len(hashes))
+	if index < k {
+		return append(path(hashes[:k], index), subtreeRoot(hashes[k:]))
+	}
+	return append(path(hashes[k:], index-k), subtreeRoot(hashes[:k]))
+}
+
+// Verify tells whether leaf is at index of a list of size leaves whose
+// root is root, given the path from Prove. The path does not fix the size
+// for every index, so the size has to be signed along with the root.
+func Verify(root []byte, size, index int, leaf []byte, proof [][]byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+	hash, rest, ok := walk(size, index, hashLeaf(leaf), proof)
+	return ok && len(rest) == 0 && bytes.Equal(hash, root)
+}
+
+// recompute the root of a subtree of size leaves from the path of the leaf
+// at index, returning what is left of the path for the upper levels
+func walk(size, index int, hash []byte, proof [][]byte) ([]byte, [][]byte, bool) {
+	if size == 1 {
+		return hash, proof, true
+	}
+	k := split(size)
+	var ok bool
+	if index < k {
+		hash, proof, ok = walk(k, index, hash, proof)
+	} else {
+		hash, proof, ok = walk(size-k, index-k, hash, proof)
+	}
+	if !ok || len(proof) == 0 {
+		return nil, nil, false
+	}
+	if index < k {
+		return hashNode(hash, proof[0]), proof[1:], true
+	}
+	return hashNode(proof[0], hash), proof[1:], true
+}
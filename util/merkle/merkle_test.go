@@ -0,0 +1,51 @@
+package merkle
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+func leaves(n int) [][]byte {
+	list := make([][]byte, n)
+	for i := range list {
+		list[i] = []byte("leaf " + strconv.Itoa(i))
+	}
+	return list
+}
+
+func TestProve(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		list := leaves(n)
+		tree := New(list)
+		for i := 0; i < n; i++ {
+			proof := tree.Prove(i)
+			if !Verify(tree.Root(), n, i, list[i], proof) {
+				t.Error("Fails to verify leaf", i, "of", n)
+			}
+			if Verify(tree.Root(), n, i, []byte("other"), proof) {
+				t.Error("Another leaf passes at", i, "of", n)
+			}
+			if n > 1 && Verify(tree.Root(), n, (i+1)%n, list[i], proof) {
+				t.Error("Leaf", i, "of", n, "passes at another index")
+			}
+		}
+	}
+}
+
+func TestRoot(t *testing.T) {
+	a := New(leaves(5)).Root()
+	list := leaves(5)
+	list[3] = []byte("other")
+	if bytes.Equal(a, New(list).Root()) {
+		t.Error("Changing a leaf keeps the root")
+	}
+	if bytes.Equal(a, New(leaves(4)).Root()) {
+		t.Error("Dropping a leaf keeps the root")
+	}
+	// a node is not a leaf
+	two := New(leaves(2))
+	if bytes.Equal(two.Root(), New([][]byte{two.Root()}).Root()) {
+		t.Error("A node hashes as a leaf")
+	}
+}
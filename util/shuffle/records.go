@@ -0,0 +1,152 @@
+package shuffle
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/proof"
+	"github.com/dedis/crypto/random"
+	"zRep/util/canonical"
+)
+
+// A record is a key followed by a fixed number of commitments.
+// Records are shuffled as a whole, so that each commitment stays with its key.
+//
+// The records are public on both sides of the shuffle,
+// so the shuffle only has to prove that the output records
+// are a permutation of the input records.
+// Each record is compressed into a single point,
+// key + z_1*c_1 + ... + z_d*c_d,
+// with weights z hashed from the input and output records,
+// and the compressed points are shuffled as ElGamal pairs (0, Y)
+// with g = h = the standard base.
+// The verifier strips the blinding of each output pair as Ybar - Xbar,
+// which must be the compressed output record.
+// A record moved apart from its key would change its compressed point
+// without the prover being able to predict the weights.
+
+var ErrRecordLength = errors.New("records of inconsistent length")
+var ErrRecordMismatch = errors.New("shuffled record does not match the shuffle proof")
+
+// Randomly shuffle a set of records given as keys and their flattened
+// commitments, producing a correctness proof in the process.
+// Returns the shuffled keys and commitments, and the blinded pairs
+// (Xbar,Ybar) the proof is about.
+func ShuffleRecords(suite abstract.Suite, keys, vals []abstract.Point,
+	rand cipher.Stream) (newKeys, newVals, Xbar, Ybar []abstract.Point, P proof.Prover) {
+
+	k := len(keys)
+	if k == 0 || len(vals)%k != 0 {
+		panic("keys and commitments have inconsistent length")
+	}
+	dims := len(vals) / k
+
+	ps := PairShuffle{}
+	ps.Init(suite, k)
+
+	// Pick a random permutation
+	pi := make([]int, k)
+	for i := 0; i < k; i++ {
+		pi[i] = i
+	}
+	for i := k - 1; i > 0; i-- {
+		j := int(random.Uint64(rand) % uint64(i+1))
+		pi[i], pi[j] = pi[j], pi[i]
+	}
+
+	// Move every record as a whole
+	newKeys = make([]abstract.Point, k)
+	newVals = make([]abstract.Point, len(vals))
+	for i := 0; i < k; i++ {
+		newKeys[i] = keys[pi[i]]
+		copy(newVals[i*dims:(i+1)*dims], vals[pi[i]*dims:(pi[i]+1)*dims])
+	}
+
+	z := recordWeights(suite, dims, keys, vals, newKeys, newVals)
+	X := nullPoints(suite, k)
+	Y := compressRecords(suite, dims, keys, vals, z)
+
+	beta := make([]abstract.Secret, k)
+	for i := 0; i < k; i++ {
+		beta[i] = suite.Secret().Pick(rand)
+	}
+	Xbar = make([]abstract.Point, k)
+	Ybar = make([]abstract.Point, k)
+	for i := 0; i < k; i++ {
+		Xbar[i] = suite.Point().Mul(nil, beta[pi[i]])
+		Xbar[i].Add(Xbar[i], X[pi[i]])
+		Ybar[i] = suite.Point().Mul(nil, beta[pi[i]])
+		Ybar[i].Add(Ybar[i], Y[pi[i]])
+	}
+
+	prover := func(ctx proof.ProverContext) error {
+		return ps.Prove(pi, nil, nil, beta, X, Y, rand, ctx)
+	}
+	return newKeys, newVals, Xbar, Ybar, prover
+}
+
+// Produce a Sigma-protocol verifier to check that newKeys and newVals
+// are a shuffle of the records in keys and vals.
+// Returns an error if the records do not match the blinded pairs at all.
+func RecordVerifier(suite abstract.Suite, keys, vals, newKeys, newVals,
+	Xbar, Ybar []abstract.Point) (proof.Verifier, error) {
+
+	k := len(keys)
+	if k <= 1 || len(newKeys) != k || len(Xbar) != k || len(Ybar) != k ||
+		len(vals) != len(newVals) || len(vals)%k != 0 {
+		return nil, ErrRecordLength
+	}
+	dims := len(vals) / k
+
+	z := recordWeights(suite, dims, keys, vals, newKeys, newVals)
+	X := nullPoints(suite, k)
+	Y := compressRecords(suite, dims, keys, vals, z)
+	newY := compressRecords(suite, dims, newKeys, newVals, z)
+	P := suite.Point()
+	for i := 0; i < k; i++ {
+		if !P.Sub(Ybar[i], Xbar[i]).Equal(newY[i]) {
+			return nil, ErrRecordMismatch
+		}
+	}
+	return Verifier(suite, nil, nil, X, Y, Xbar, Ybar), nil
+}
+
+// The weights of each commitment in a compressed record,
+// bound to both sides of the shuffle.
+func recordWeights(suite abstract.Suite, dims int,
+	keys, vals, newKeys, newVals []abstract.Point) []abstract.Secret {
+
+	e := canonical.New("record-shuffle")
+	e.Int(dims).Points(keys).Points(vals).Points(newKeys).Points(newVals)
+	c := suite.Cipher(e.Sum(sha256.New()))
+	z := make([]abstract.Secret, dims)
+	for d := 0; d < dims; d++ {
+		z[d] = suite.Secret().Pick(c)
+	}
+	return z
+}
+
+func compressRecords(suite abstract.Suite, dims int,
+	keys, vals []abstract.Point, z []abstract.Secret) []abstract.Point {
+
+	Y := make([]abstract.Point, len(keys))
+	P := suite.Point() // scratch
+	for i := range keys {
+		Y[i] = suite.Point().Null()
+		Y[i].Add(Y[i], keys[i])
+		for d := 0; d < dims; d++ {
+			Y[i].Add(Y[i], P.Mul(vals[i*dims+d], z[d]))
+		}
+	}
+	return Y
+}
+
+func nullPoints(suite abstract.Suite, k int) []abstract.Point {
+	X := make([]abstract.Point, k)
+	for i := 0; i < k; i++ {
+		X[i] = suite.Point().Null()
+	}
+	return X
+}
@@ -1,9 +1,11 @@
 package shuffle
 
 import (
+	"github.com/dedis/crypto/abstract"
 	"github.com/dedis/crypto/edwards"
 	"github.com/dedis/crypto/nist"
 	"github.com/dedis/crypto/openssl"
+	"github.com/dedis/crypto/proof"
 	"testing"
 )
 
@@ -46,3 +48,44 @@ func Benchmark10PairShuffleEd25519(b *testing.B) {
 func Benchmark100PairShuffleEd25519(b *testing.B) {
 	TestShuffle(edwards.NewAES128SHA256Ed25519(false), 100, b.N)
 }
+
+func TestRecordShuffle(t *testing.T) {
+	suite := nist.NewAES128SHA256P256()
+	rand := suite.Cipher(abstract.RandomKey)
+
+	// 5 records of a key and 2 commitments
+	k, dims := 5, 2
+	keys := make([]abstract.Point, k)
+	vals := make([]abstract.Point, k*dims)
+	for i := 0; i < k; i++ {
+		keys[i] = suite.Point().Mul(nil, suite.Secret().Pick(rand))
+		for d := 0; d < dims; d++ {
+			vals[i*dims+d] = suite.Point().Mul(nil, suite.Secret().Pick(rand))
+		}
+	}
+
+	newKeys, newVals, Xbar, Ybar, prover := ShuffleRecords(suite, keys, vals, rand)
+	prf, err := proof.HashProve(suite, "RecordShuffle", rand, prover)
+	if err != nil {
+		t.Fatal("Record shuffle proof failed: " + err.Error())
+	}
+	verifier, err := RecordVerifier(suite, keys, vals, newKeys, newVals, Xbar, Ybar)
+	if err != nil {
+		t.Fatal("Record shuffle verify failed: " + err.Error())
+	}
+	if err := proof.HashVerify(suite, "RecordShuffle", verifier, prf); err != nil {
+		t.Fatal("Record shuffle verify failed: " + err.Error())
+	}
+
+	// swap the commitments of two records, keeping their keys in place
+	for d := 0; d < dims; d++ {
+		newVals[d], newVals[dims+d] = newVals[dims+d], newVals[d]
+	}
+	verifier, err = RecordVerifier(suite, keys, vals, newKeys, newVals, Xbar, Ybar)
+	if err == nil {
+		err = proof.HashVerify(suite, "RecordShuffle", verifier, prf)
+	}
+	if err == nil {
+		t.Error("Commitments are moved apart from their keys")
+	}
+}
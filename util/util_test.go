@@ -5,6 +5,10 @@ import (
 	"fmt"
 	"github.com/dedis/crypto/random"
 	"math/big"
+	"net"
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/nist"
+	"zRep/proto"
 	// "github.com/dedis/protobuf"
 )
 
@@ -73,4 +77,53 @@ func TestBigIntEncoding (t *testing.T) {
 // 		panic(err)
 // 	}
 // 	fmt.Println(m)
-// }
\ No newline at end of file
+// }
+
+func TestMessageOfEvent(t *testing.T) {
+	pm := map[string]interface{}{
+		"keys": []byte{1, 2},
+		"round": 3,
+		"reason": "quota",
+		"signature": []byte{9},
+	}
+	event := &proto.Event{EventType:proto.ROUND_END, Params:pm}
+	msg := MessageOfEvent(event, "signature")
+
+	// the skipped parameter does not change the message
+	pm["signature"] = []byte{8}
+	if string(MessageOfEvent(event, "signature")) != string(msg) {
+		t.Error("skipped parameter changed the message")
+	}
+	// moving bytes between parameters does
+	pm["keys"] = []byte{1}
+	pm["reason"] = "\x02quota"
+	if string(MessageOfEvent(event, "signature")) == string(msg) {
+		t.Error("different events have the same message")
+	}
+}
+
+func TestElGamalSignature(t *testing.T) {
+	suite := nist.NewAES128SHA256QR512()
+	a := suite.Secret().Pick(random.Stream)
+	A := suite.Point().Mul(nil, a)
+	msg := []byte("announcement")
+
+	sig := ElGamalSign(suite, suite.Cipher(abstract.RandomKey), msg, a, nil)
+	if ElGamalVerify(suite, msg, A, sig, nil) != nil {
+		t.Error("valid signature rejected")
+	}
+	if ElGamalVerify(suite, []byte("other"), A, sig, nil) == nil {
+		t.Error("signature accepted for another message")
+	}
+	B := suite.Point().Mul(nil, suite.Secret().Pick(random.Stream))
+	if ElGamalVerify(suite, msg, B, sig, nil) == nil {
+		t.Error("signature accepted for another key")
+	}
+}
+
+func TestHostOf(t *testing.T) {
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:40213")
+	if host := HostOf(addr); host != "127.0.0.1" {
+		t.Error("wrong host of a connection", host)
+	}
+}